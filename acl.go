@@ -0,0 +1,626 @@
+package meshboi
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+)
+
+// How long a flow allowed by the ACL can go unused before replies to it are
+// no longer let through
+const aclFlowTimeout = 10 * time.Minute
+
+// The most flows the ACL remembers. Once it's full the least recently seen
+// flow is forgotten to make room, so that a peer can't grow the flows without
+// limit by sending to many ports.
+const aclMaxFlows = 16384
+
+// The flows are split into shards, each with its own lock, so that packets
+// in different flows don't all wait on the same lock
+const aclFlowShards = 16
+
+// ACLPolicy lists the traffic that's allowed between members. Anything that
+// isn't allowed by a rule, or a reply to traffic that was, is dropped.
+type ACLPolicy struct {
+	// Newer policies have higher versions, so that an older one can't
+	// replace a newer one
+	Version uint64
+	Rules   []ACLRule
+}
+
+// ACLRule allows traffic from any of the sources to any of the destinations.
+// Sources and destinations are each a VPN IP, a subnet, the hostname in a
+// member's certificate or * for anything. A hostname only matches the
+// member's own VPN IPs and subnets, not the traffic it relays for others.
+type ACLRule struct {
+	From []string
+	To   []string
+	// One of tcp, udp, icmp or any. Empty means any.
+	Protocol string `json:",omitempty"`
+	// A comma separated list of destination ports and port ranges, eg:
+	// 22,8000-8100. Empty means any port.
+	Ports string `json:",omitempty"`
+}
+
+const (
+	protocolICMP   = 1
+	protocolTCP    = 6
+	protocolUDP    = 17
+	protocolICMPv6 = 58
+)
+
+// aclMatch is a parsed source or destination of a rule
+type aclMatch struct {
+	any      bool
+	prefix   netaddr.IPPrefix
+	hostname string
+}
+
+func parseACLMatch(s string) aclMatch {
+	s = strings.TrimSpace(s)
+
+	if s == "*" {
+		return aclMatch{any: true}
+	}
+
+	if prefix, err := netaddr.ParseIPPrefix(s); err == nil {
+		return aclMatch{prefix: prefix}
+	}
+
+	if ip, err := netaddr.ParseIP(s); err == nil {
+		return aclMatch{prefix: netaddr.IPPrefix{IP: ip, Bits: ip.BitLen()}}
+	}
+
+	return aclMatch{hostname: s}
+}
+
+func (m aclMatch) matches(ip netaddr.IP, identity *CertIdentity) bool {
+	if m.any {
+		return true
+	}
+
+	if m.hostname != "" {
+		return identity != nil && identity.Hostname == m.hostname && ownedBy(ip, identity)
+	}
+
+	return m.prefix.Contains(ip)
+}
+
+// ownedBy reports whether the IP is one of the member's VPN IPs or in one of
+// the subnets it routes to, so that hostname rules don't match the traffic a
+// member relays for others
+func ownedBy(ip netaddr.IP, identity *CertIdentity) bool {
+	if containsIP(identity.VpnIPs, ip) {
+		return true
+	}
+
+	for _, subnet := range identity.Subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type portRange struct {
+	first uint16
+	last  uint16
+}
+
+func parsePorts(s string) ([]portRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var ports []portRange
+
+	for _, portString := range strings.Split(s, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(portString), "-", 2)
+		first, err := strconv.ParseUint(bounds[0], 10, 16)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", portString)
+		}
+
+		last := first
+
+		if len(bounds) == 2 {
+			last, err = strconv.ParseUint(bounds[1], 10, 16)
+
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid port range %q", portString)
+			}
+		}
+
+		ports = append(ports, portRange{first: uint16(first), last: uint16(last)})
+	}
+
+	return ports, nil
+}
+
+// aclRule is a parsed ACLRule
+type aclRule struct {
+	from []aclMatch
+	to   []aclMatch
+	// the protocol numbers allowed, or nil for any
+	protocols []uint8
+	ports     []portRange
+}
+
+func parseACLRule(rule ACLRule) (aclRule, error) {
+	parsed := aclRule{}
+
+	for _, from := range rule.From {
+		parsed.from = append(parsed.from, parseACLMatch(from))
+	}
+
+	for _, to := range rule.To {
+		parsed.to = append(parsed.to, parseACLMatch(to))
+	}
+
+	switch strings.ToLower(rule.Protocol) {
+	case "", "any":
+	case "tcp":
+		parsed.protocols = []uint8{protocolTCP}
+	case "udp":
+		parsed.protocols = []uint8{protocolUDP}
+	case "icmp":
+		parsed.protocols = []uint8{protocolICMP, protocolICMPv6}
+	default:
+		return aclRule{}, fmt.Errorf("unknown protocol %q", rule.Protocol)
+	}
+
+	ports, err := parsePorts(rule.Ports)
+
+	if err != nil {
+		return aclRule{}, err
+	}
+
+	if ports != nil && !(len(parsed.protocols) == 1 && (parsed.protocols[0] == protocolTCP || parsed.protocols[0] == protocolUDP)) {
+		return aclRule{}, errors.New("ports can only be given for tcp or udp")
+	}
+
+	parsed.ports = ports
+
+	return parsed, nil
+}
+
+func matchesAny(matches []aclMatch, ip netaddr.IP, identity *CertIdentity) bool {
+	for _, m := range matches {
+		if m.matches(ip, identity) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r aclRule) allows(packet packetInfo, from *CertIdentity, to *CertIdentity) bool {
+	if !matchesAny(r.from, packet.src, from) || !matchesAny(r.to, packet.dst, to) {
+		return false
+	}
+
+	if r.protocols != nil {
+		found := false
+
+		for _, protocol := range r.protocols {
+			found = found || protocol == packet.protocol
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if r.ports == nil {
+		return true
+	}
+
+	// Packets without ports, such as later fragments, can't be matched
+	if !packet.hasPorts {
+		return false
+	}
+
+	for _, ports := range r.ports {
+		if packet.dstPort >= ports.first && packet.dstPort <= ports.last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseACLPolicy parses a JSON encoded ACL policy, checking that its rules
+// are valid
+func ParseACLPolicy(b []byte) (*ACLPolicy, error) {
+	var policy ACLPolicy
+
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, err
+	}
+
+	if _, err := policy.parse(); err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+func LoadACLPolicy(path string) (*ACLPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseACLPolicy(b)
+}
+
+func (p *ACLPolicy) parse() ([]aclRule, error) {
+	rules := make([]aclRule, 0, len(p.Rules))
+
+	for i, rule := range p.Rules {
+		parsed, err := parseACLRule(rule)
+
+		if err != nil {
+			return nil, fmt.Errorf("rule %v: %w", i, err)
+		}
+
+		rules = append(rules, parsed)
+	}
+
+	return rules, nil
+}
+
+// packetInfo is what the ACL needs to know about a packet
+type packetInfo struct {
+	src      netaddr.IP
+	dst      netaddr.IP
+	protocol uint8
+	hasPorts bool
+	srcPort  uint16
+	dstPort  uint16
+}
+
+func parsePacketInfo(packet []byte) (packetInfo, error) {
+	if len(packet) == 0 {
+		return packetInfo{}, errors.New("empty packet")
+	}
+
+	var info packetInfo
+	var payload []byte
+	fragment := false
+
+	switch version := int(packet[0] >> 4); version {
+	case ipv4.Version:
+		if len(packet) < ipv4.HeaderLen {
+			return packetInfo{}, errors.New("short IPv4 packet")
+		}
+
+		headerLen := int(packet[0]&0x0f) * 4
+
+		if headerLen < ipv4.HeaderLen || len(packet) < headerLen {
+			return packetInfo{}, errors.New("invalid IPv4 header length")
+		}
+
+		info.src = netaddr.IPv4(packet[12], packet[13], packet[14], packet[15])
+		info.dst = netaddr.IPv4(packet[16], packet[17], packet[18], packet[19])
+		info.protocol = packet[9]
+		// Only the first fragment has the ports
+		fragment = binary.BigEndian.Uint16(packet[6:8])&0x1fff != 0
+		payload = packet[headerLen:]
+	case ipv6.Version:
+		if len(packet) < ipv6.HeaderLen {
+			return packetInfo{}, errors.New("short IPv6 packet")
+		}
+
+		var src, dst [16]byte
+		copy(src[:], packet[8:24])
+		copy(dst[:], packet[24:40])
+		info.src = netaddr.IPFrom16(src)
+		info.dst = netaddr.IPFrom16(dst)
+		// Extension headers aren't followed, so packets with them can only
+		// match rules without ports
+		info.protocol = packet[6]
+		payload = packet[ipv6.HeaderLen:]
+	default:
+		return packetInfo{}, fmt.Errorf("unknown IP version %v", version)
+	}
+
+	if (info.protocol == protocolTCP || info.protocol == protocolUDP) && !fragment && len(payload) >= 4 {
+		info.hasPorts = true
+		info.srcPort = binary.BigEndian.Uint16(payload[0:2])
+		info.dstPort = binary.BigEndian.Uint16(payload[2:4])
+	}
+
+	return info, nil
+}
+
+// flowKey identifies the traffic in one direction between two endpoints and
+// the peers it goes between, where nil is this member. Having the peers means
+// that replies are only accepted from the peer the flow was opened to.
+type flowKey struct {
+	from     *PeerConn
+	to       *PeerConn
+	src      netaddr.IP
+	dst      netaddr.IP
+	protocol uint8
+	srcPort  uint16
+	dstPort  uint16
+}
+
+func (p packetInfo) flow(from *PeerConn, to *PeerConn) flowKey {
+	return flowKey{from: from, to: to, src: p.src, dst: p.dst, protocol: p.protocol, srcPort: p.srcPort, dstPort: p.dstPort}
+}
+
+func (f flowKey) reverse() flowKey {
+	return flowKey{from: f.to, to: f.from, src: f.dst, dst: f.src, protocol: f.protocol, srcPort: f.dstPort, dstPort: f.srcPort}
+}
+
+// shard returns which shard the flow is kept in. The flow and its reverse
+// are always kept in the same shard.
+func (f flowKey) shard() int {
+	src, dst := f.src.As16(), f.dst.As16()
+	sum := uint32(f.protocol) ^ uint32(f.srcPort^f.dstPort)
+
+	for i := range src {
+		sum ^= uint32(src[i]^dst[i]) << (8 * (i % 4))
+	}
+
+	return int(sum % aclFlowShards)
+}
+
+// flowShard holds some of the flows allowed by the ACL, with when each was
+// last seen
+type flowShard struct {
+	flows     map[flowKey]time.Time
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+func (s *flowShard) reset() {
+	s.lock.Lock()
+	s.flows = make(map[flowKey]time.Time)
+	s.lastPrune = time.Now()
+	s.lock.Unlock()
+}
+
+// add remembers the flow, forgetting the least recently seen flow if the
+// shard is full. The lock must be held.
+func (s *flowShard) add(flow flowKey, now time.Time) {
+	if _, ok := s.flows[flow]; !ok && len(s.flows) >= aclMaxFlows/aclFlowShards {
+		s.prune(now)
+
+		if len(s.flows) >= aclMaxFlows/aclFlowShards {
+			s.forgetOldest()
+		}
+	}
+
+	s.flows[flow] = now
+}
+
+// forgetOldest forgets the least recently seen flow. The lock must be held.
+func (s *flowShard) forgetOldest() {
+	var oldest flowKey
+	var oldestSeen time.Time
+
+	for flow, lastSeen := range s.flows {
+		if oldestSeen.IsZero() || lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = flow, lastSeen
+		}
+	}
+
+	delete(s.flows, oldest)
+}
+
+// prune forgets flows that have timed out. The lock must be held.
+func (s *flowShard) prune(now time.Time) {
+	for flow, lastSeen := range s.flows {
+		if now.Sub(lastSeen) >= aclFlowTimeout {
+			delete(s.flows, flow)
+		}
+	}
+
+	s.lastPrune = now
+}
+
+// ACL enforces an ACLPolicy on the packets sent to and received from peers.
+// Replies to allowed traffic are let through so that rules only need to be
+// written for the side that starts the conversation. Until a policy is given,
+// all traffic is allowed.
+type ACL struct {
+	// the identity of this member, if it has a certificate
+	self *CertIdentity
+
+	rules   []aclRule
+	version uint64
+	// whether a policy has been given yet
+	enabled bool
+	lock    sync.RWMutex
+
+	// when each allowed flow was last seen
+	flows [aclFlowShards]flowShard
+
+	ingressDropped uint64
+	egressDropped  uint64
+}
+
+func NewACL(self *CertIdentity) *ACL {
+	a := &ACL{self: self}
+
+	for i := range a.flows {
+		a.flows[i].reset()
+	}
+
+	return a
+}
+
+// Update replaces the policy, as long as it's newer than the one in use. It
+// returns whether the policy was used.
+func (a *ACL) Update(policy *ACLPolicy) (bool, error) {
+	rules, err := policy.parse()
+
+	if err != nil {
+		return false, err
+	}
+
+	a.lock.Lock()
+
+	if a.enabled && policy.Version <= a.version {
+		a.lock.Unlock()
+		return false, nil
+	}
+
+	a.rules = rules
+	a.version = policy.Version
+	a.enabled = true
+	a.lock.Unlock()
+
+	// Flows allowed by the old policy may not be allowed by the new one
+	for i := range a.flows {
+		a.flows[i].reset()
+	}
+
+	log.Info("Using ACL policy version ", policy.Version, " with ", len(rules), " rules")
+
+	return true, nil
+}
+
+// Dropped returns how many packets have been dropped from and to peers
+func (a *ACL) Dropped() (ingress uint64, egress uint64) {
+	if a == nil {
+		return 0, 0
+	}
+
+	return atomic.LoadUint64(&a.ingressDropped), atomic.LoadUint64(&a.egressDropped)
+}
+
+// allowEgress reports whether the packet can be sent to the peer
+func (a *ACL) allowEgress(packet []byte, peer *PeerConn) bool {
+	if a == nil || a.allows(packet, nil, peer) {
+		return true
+	}
+
+	atomic.AddUint64(&a.egressDropped, 1)
+
+	return false
+}
+
+// allowIngress reports whether the packet received from the peer can be
+// written to the tun
+func (a *ACL) allowIngress(packet []byte, peer *PeerConn) bool {
+	if a == nil || a.allows(packet, peer, nil) {
+		return true
+	}
+
+	atomic.AddUint64(&a.ingressDropped, 1)
+
+	return false
+}
+
+// allowForward reports whether the packet received from one peer can be
+// relayed on to another. Dropped packets are counted as ingress drops.
+func (a *ACL) allowForward(packet []byte, from *PeerConn, to *PeerConn) bool {
+	if a == nil || a.allows(packet, from, to) {
+		return true
+	}
+
+	atomic.AddUint64(&a.ingressDropped, 1)
+
+	return false
+}
+
+// identity returns the identity of the peer, or of this member if it's nil
+func (a *ACL) identity(peer *PeerConn) *CertIdentity {
+	if peer == nil {
+		return a.self
+	}
+
+	return peer.identity
+}
+
+// allows reports whether the packet can go from one peer to another, where a
+// nil peer is this member
+func (a *ACL) allows(packet []byte, from *PeerConn, to *PeerConn) bool {
+	a.lock.RLock()
+	enabled := a.enabled
+	rules := a.rules
+	a.lock.RUnlock()
+
+	if !enabled {
+		return true
+	}
+
+	info, err := parsePacketInfo(packet)
+
+	if err != nil {
+		log.Debug("Dropping packet that couldn't be parsed for the ACL: ", err)
+		return false
+	}
+
+	now := time.Now()
+	flow := info.flow(from, to)
+
+	shard := &a.flows[flow.shard()]
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	// Flows that have timed out are forgotten at most once per timeout
+	if now.Sub(shard.lastPrune) >= aclFlowTimeout {
+		shard.prune(now)
+	}
+
+	if lastSeen, ok := shard.flows[flow.reverse()]; ok && now.Sub(lastSeen) < aclFlowTimeout {
+		shard.flows[flow.reverse()] = now
+		return true
+	}
+
+	for _, rule := range rules {
+		if rule.allows(info, a.identity(from), a.identity(to)) {
+			shard.add(flow, now)
+			return true
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"src":      info.src,
+		"dst":      info.dst,
+		"protocol": info.protocol,
+		"dstPort":  info.dstPort,
+	}).Debug("Dropping packet not allowed by the ACL")
+
+	return false
+}
+
+// forgetPeer forgets the flows to and from the peer, once it's closed
+func (a *ACL) forgetPeer(peer *PeerConn) {
+	if a == nil {
+		return
+	}
+
+	for i := range a.flows {
+		shard := &a.flows[i]
+		shard.lock.Lock()
+
+		for flow := range shard.flows {
+			if flow.from == peer || flow.to == peer {
+				delete(shard.flows, flow)
+			}
+		}
+
+		shard.lock.Unlock()
+	}
+}
@@ -0,0 +1,173 @@
+package meshboi
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"inet.af/netaddr"
+)
+
+// ipv4Packet makes an IPv4 packet with the ports at the start of the payload
+func ipv4Packet(src string, dst string, protocol int, srcPort uint16, dstPort uint16) []byte {
+	hdr := ipv4.Header{
+		Src:      net.ParseIP(src),
+		Dst:      net.ParseIP(dst),
+		Len:      ipv4.HeaderLen,
+		Version:  ipv4.Version,
+		Protocol: protocol,
+	}
+
+	hdrBytes, _ := hdr.Marshal()
+	ports := make([]byte, 8)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+
+	return append(hdrBytes, ports...)
+}
+
+func TestACL(t *testing.T) {
+	web := &CertIdentity{Hostname: "web", VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.4.3")}}
+	client := &PeerConn{identity: &CertIdentity{Hostname: "client", VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.4.2")}}}
+	other := &PeerConn{identity: &CertIdentity{Hostname: "other", VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.4.4")}}}
+	acl := NewACL(web)
+
+	if !acl.allowIngress(ipv4Packet("192.168.4.2", "192.168.4.3", protocolTCP, 50000, 22), client) {
+		t.Fatalf("Traffic dropped before a policy was given")
+	}
+
+	policy, err := ParseACLPolicy([]byte(`{"Version": 1, "Rules": [
+		{"From": ["192.168.4.0/24"], "To": ["web"], "Protocol": "tcp", "Ports": "80,8000-8100"},
+		{"From": ["web"], "To": ["192.168.4.0/24"], "Protocol": "udp", "Ports": "53"}
+	]}`))
+
+	if err != nil {
+		t.Fatal("Error parsing policy: ", err)
+	}
+
+	if _, err := acl.Update(policy); err != nil {
+		t.Fatal("Error using policy: ", err)
+	}
+
+	if !acl.allowIngress(ipv4Packet("192.168.4.2", "192.168.4.3", protocolTCP, 50000, 8080), client) {
+		t.Fatalf("Allowed traffic was dropped")
+	}
+
+	// Replies to allowed traffic are let through
+	if !acl.allowEgress(ipv4Packet("192.168.4.3", "192.168.4.2", protocolTCP, 8080, 50000), client) {
+		t.Fatalf("Reply to allowed traffic was dropped")
+	}
+
+	// Replies are only accepted from the peer the flow was opened to
+	if !acl.allowEgress(ipv4Packet("192.168.4.3", "192.168.4.2", protocolUDP, 40000, 53), client) {
+		t.Fatalf("Allowed traffic was dropped")
+	}
+
+	if acl.allowIngress(ipv4Packet("192.168.4.2", "192.168.4.3", protocolUDP, 53, 40000), other) {
+		t.Fatalf("Reply from another peer was allowed")
+	}
+
+	if !acl.allowIngress(ipv4Packet("192.168.4.2", "192.168.4.3", protocolUDP, 53, 40000), client) {
+		t.Fatalf("Reply to allowed traffic was dropped")
+	}
+
+	if acl.allowIngress(ipv4Packet("192.168.4.2", "192.168.4.3", protocolTCP, 50000, 22), client) {
+		t.Fatalf("Traffic to another port was allowed")
+	}
+
+	if acl.allowIngress(ipv4Packet("192.168.4.2", "192.168.4.3", protocolUDP, 50000, 80), client) {
+		t.Fatalf("Traffic with another protocol was allowed")
+	}
+
+	if acl.allowEgress(ipv4Packet("192.168.4.3", "192.168.4.2", protocolTCP, 50000, 80), client) {
+		t.Fatalf("Traffic to another member was allowed")
+	}
+
+	if ingress, egress := acl.Dropped(); ingress != 3 || egress != 1 {
+		t.Fatalf("Expected 3 ingress and 1 egress drops but got %v and %v", ingress, egress)
+	}
+
+	// Older policies can't replace newer ones
+	if used, _ := acl.Update(&ACLPolicy{Version: 0}); used {
+		t.Fatalf("Used an older policy")
+	}
+}
+
+func TestBadACLPolicy(t *testing.T) {
+	policies := []string{
+		`{"Rules": [{"From": ["*"], "To": ["*"], "Protocol": "sctp"}]}`,
+		`{"Rules": [{"From": ["*"], "To": ["*"], "Protocol": "icmp", "Ports": "80"}]}`,
+		`{"Rules": [{"From": ["*"], "To": ["*"], "Protocol": "tcp", "Ports": "100-80"}]}`,
+	}
+
+	for _, policy := range policies {
+		if _, err := ParseACLPolicy([]byte(policy)); err == nil {
+			t.Errorf("Parsed bad policy %v", policy)
+		}
+	}
+}
+
+// Tests that packets relayed between peers are checked against the ACL, and
+// that hostname rules only match the member's own traffic
+func TestACLForward(t *testing.T) {
+	client := &PeerConn{identity: &CertIdentity{Hostname: "client", VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.4.2")}}}
+	web := &PeerConn{identity: &CertIdentity{Hostname: "web", VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.4.3")}}}
+	acl := NewACL(&CertIdentity{Hostname: "relay", VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.4.1")}})
+	acl.Update(&ACLPolicy{Version: 1, Rules: []ACLRule{{From: []string{"client"}, To: []string{"web"}, Protocol: "tcp", Ports: "80"}}})
+
+	if !acl.allowForward(ipv4Packet("192.168.4.2", "192.168.4.3", protocolTCP, 50000, 80), client, web) {
+		t.Fatalf("Allowed traffic wasn't forwarded")
+	}
+
+	if !acl.allowForward(ipv4Packet("192.168.4.3", "192.168.4.2", protocolTCP, 80, 50000), web, client) {
+		t.Fatalf("Reply to allowed traffic wasn't forwarded")
+	}
+
+	if acl.allowForward(ipv4Packet("192.168.4.2", "192.168.4.3", protocolTCP, 50000, 22), client, web) {
+		t.Fatalf("Traffic to another port was forwarded")
+	}
+
+	// client relaying traffic from another member doesn't make it client's
+	if acl.allowForward(ipv4Packet("192.168.4.9", "192.168.4.3", protocolTCP, 50000, 80), client, web) {
+		t.Fatalf("Hostname rule matched traffic from another member")
+	}
+
+	if ingress, _ := acl.Dropped(); ingress != 2 {
+		t.Fatalf("Expected 2 dropped packets but got %v", ingress)
+	}
+}
+
+// Tests that the flows are limited, and forgotten once the peer is closed
+func TestACLFlowLimit(t *testing.T) {
+	client := &PeerConn{identity: &CertIdentity{Hostname: "client", VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.4.2")}}}
+	acl := NewACL(&CertIdentity{Hostname: "web", VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.4.3")}})
+	acl.Update(&ACLPolicy{Version: 1, Rules: []ACLRule{{From: []string{"client"}, To: []string{"web"}, Protocol: "udp"}}})
+
+	for port := 0; port < 2*aclMaxFlows; port++ {
+		acl.allowIngress(ipv4Packet("192.168.4.2", "192.168.4.3", protocolUDP, uint16(port), 53), client)
+	}
+
+	flows := 0
+
+	for i := range acl.flows {
+		flows += len(acl.flows[i].flows)
+	}
+
+	if flows > aclMaxFlows {
+		t.Fatalf("Expected at most %v flows but got %v", aclMaxFlows, flows)
+	}
+
+	// The latest flow is kept
+	if !acl.allowEgress(ipv4Packet("192.168.4.3", "192.168.4.2", protocolUDP, 53, 2*aclMaxFlows-1), client) {
+		t.Fatalf("Reply to the latest flow was dropped")
+	}
+
+	acl.forgetPeer(client)
+
+	for i := range acl.flows {
+		if len(acl.flows[i].flows) != 0 {
+			t.Fatalf("Flows kept for closed peer")
+		}
+	}
+}
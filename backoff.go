@@ -0,0 +1,73 @@
+package meshboi
+
+import (
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+type backoffState struct {
+	failures    uint
+	nextAttempt time.Time
+}
+
+// backoff tracks failed connections to peers so that reconnection attempts to
+// a peer that keeps failing are spaced out exponentially, rather than being
+// retried on every NetworkMap from the rolodex
+type backoff struct {
+	min   time.Duration
+	max   time.Duration
+	peers map[netaddr.IPPort]backoffState
+	lock  sync.Mutex
+}
+
+func newBackoff(min time.Duration, max time.Duration) *backoff {
+	return &backoff{
+		min:   min,
+		max:   max,
+		peers: make(map[netaddr.IPPort]backoffState),
+	}
+}
+
+// ready returns whether a connection to the peer can be attempted now
+func (b *backoff) ready(addr netaddr.IPPort) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state, ok := b.peers[addr]
+
+	return !ok || !time.Now().Before(state.nextAttempt)
+}
+
+// failed records a failed connection to the peer and returns how long until
+// the next attempt should be made
+func (b *backoff) failed(addr netaddr.IPPort) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	state := b.peers[addr]
+	state.failures++
+
+	delay := b.max
+
+	// Avoid overflowing the shift for peers that have failed many times
+	if state.failures < 32 {
+		if d := b.min << (state.failures - 1); d > 0 && d < b.max {
+			delay = d
+		}
+	}
+
+	state.nextAttempt = time.Now().Add(delay)
+	b.peers[addr] = state
+
+	return delay
+}
+
+// succeeded resets the backoff for the peer
+func (b *backoff) succeeded(addr netaddr.IPPort) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.peers, addr)
+}
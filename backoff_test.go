@@ -0,0 +1,39 @@
+package meshboi
+
+import (
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestBackoffDoubles(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second)
+	addr := netaddr.MustParseIPPort("192.168.33.1:5000")
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+
+	for _, e := range expected {
+		if delay := b.failed(addr); delay != e {
+			t.Fatalf("Expected delay of %v but got %v", e, delay)
+		}
+	}
+
+	if b.ready(addr) {
+		t.Fatalf("Shouldn't be ready straight after a failure")
+	}
+
+	b.succeeded(addr)
+
+	if !b.ready(addr) {
+		t.Fatalf("Should be ready after a success")
+	}
+}
+
+func TestBackoffUnknownPeerReady(t *testing.T) {
+	b := newBackoff(time.Second, time.Minute)
+
+	if !b.ready(netaddr.MustParseIPPort("192.168.33.1:5000")) {
+		t.Fatalf("Peer that has never failed should be ready")
+	}
+}
@@ -0,0 +1,268 @@
+package meshboi
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// The certificate extension that lists the subnets a member may advertise.
+// The OID sits under a randomly chosen number in the 2.25 arc, which is set
+// aside for OIDs that don't need registering. Each component is kept small
+// enough for the x509 parser.
+var allowedSubnetsOID = asn1.ObjectIdentifier{2, 25, 1497212430, 1}
+
+// CertIdentity is who a member certificate says its holder is
+type CertIdentity struct {
+	Hostname string
+	VpnIPs   []netaddr.IP
+	// The subnets that the member is allowed to advertise routes to
+	Subnets []netaddr.IPPrefix
+	// The serial number of the certificate, which is how it's revoked
+	Serial *big.Int
+}
+
+// AllowsRoute reports whether the prefix is within one of the subnets the
+// member is allowed to advertise
+func (c *CertIdentity) AllowsRoute(prefix netaddr.IPPrefix) bool {
+	for _, subnet := range c.Subnets {
+		if subnet.Bits <= prefix.Bits && subnet.Contains(prefix.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// NewCA creates a self signed CA certificate that member certificates are
+// issued by. Both are returned PEM encoded.
+func NewCA(name string, validity time.Duration) (certPEM []byte, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerial()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encodeCertAndKey(der, key)
+}
+
+// SignMemberCert issues a certificate for a member with the given hostname,
+// VPN IPs and the subnets it's allowed to advertise
+func SignMemberCert(caCert *x509.Certificate, caKey crypto.Signer, identity CertIdentity, validity time.Duration) (certPEM []byte, keyPEM []byte, err error) {
+	if len(identity.VpnIPs) == 0 {
+		return nil, nil, errors.New("member certificates need at least one VPN IP")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerial()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subnets := make([]string, 0, len(identity.Subnets))
+
+	for _, subnet := range identity.Subnets {
+		subnets = append(subnets, subnet.String())
+	}
+
+	subnetsExtension, err := asn1.Marshal(subnets)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: identity.Hostname},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		// Members are both the client and the server of DTLS connections
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: []pkix.Extension{{Id: allowedSubnetsOID, Value: subnetsExtension}},
+	}
+
+	if identity.Hostname != "" {
+		template.DNSNames = []string{identity.Hostname}
+	}
+
+	for _, ip := range identity.VpnIPs {
+		template.IPAddresses = append(template.IPAddresses, ip.IPAddr().IP)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encodeCertAndKey(der, key)
+}
+
+func encodeCertAndKey(certDER []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// identityFromCert reads the member identity from its certificate, which must
+// already have been verified
+func identityFromCert(cert *x509.Certificate) (*CertIdentity, error) {
+	identity := &CertIdentity{Hostname: cert.Subject.CommonName, Serial: cert.SerialNumber}
+
+	for _, stdIP := range cert.IPAddresses {
+		ip, ok := netaddr.FromStdIP(stdIP)
+
+		if !ok {
+			return nil, errors.New("invalid VPN IP in certificate")
+		}
+
+		identity.VpnIPs = append(identity.VpnIPs, ip)
+	}
+
+	if len(identity.VpnIPs) == 0 {
+		return nil, errors.New("certificate has no VPN IPs")
+	}
+
+	for _, extension := range cert.Extensions {
+		if !extension.Id.Equal(allowedSubnetsOID) {
+			continue
+		}
+
+		var subnets []string
+
+		if _, err := asn1.Unmarshal(extension.Value, &subnets); err != nil {
+			return nil, err
+		}
+
+		for _, subnetString := range subnets {
+			subnet, err := netaddr.ParseIPPrefix(subnetString)
+
+			if err != nil {
+				return nil, err
+			}
+
+			identity.Subnets = append(identity.Subnets, subnet)
+		}
+	}
+
+	return identity, nil
+}
+
+func identityFromRawCert(raw []byte) (*CertIdentity, error) {
+	cert, err := x509.ParseCertificate(raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return identityFromCert(cert)
+}
+
+// verifyMemberCert checks that the certificate was issued by the CA and
+// returns the identity in it
+func verifyMemberCert(raw []byte, caPool *x509.CertPool) (*CertIdentity, error) {
+	cert, err := x509.ParseCertificate(raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     caPool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return identityFromCert(cert)
+}
+
+// LoadCA reads a PEM encoded CA certificate
+func LoadCA(path string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found in " + path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// LoadCAKey reads a PEM encoded CA private key
+func LoadCAKey(path string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, errors.New("no EC private key found in " + path)
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
@@ -0,0 +1,169 @@
+package meshboi
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+type testCA struct {
+	t    *testing.T
+	cert *x509.Certificate
+	key  crypto.Signer
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	caCertPEM, caKeyPEM, err := NewCA("test", time.Hour)
+
+	if err != nil {
+		t.Fatal("Error creating CA: ", err)
+	}
+
+	caBlock, _ := pem.Decode(caCertPEM)
+	caCert, _ := x509.ParseCertificate(caBlock.Bytes)
+	keyBlock, _ := pem.Decode(caKeyPEM)
+	caKey, _ := x509.ParseECPrivateKey(keyBlock.Bytes)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	return &testCA{t: t, cert: caCert, key: caKey, pool: pool}
+}
+
+func (ca *testCA) sign(identity CertIdentity) tls.Certificate {
+	certPEM, keyPEM, err := SignMemberCert(ca.cert, ca.key, identity, time.Hour)
+
+	if err != nil {
+		ca.t.Fatal("Error signing member certificate: ", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+
+	if err != nil {
+		ca.t.Fatal("Error loading member certificate: ", err)
+	}
+
+	return cert
+}
+
+func TestSignAndVerifyMemberCert(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	identity := CertIdentity{
+		Hostname: "laptop",
+		VpnIPs:   []netaddr.IP{netaddr.MustParseIP("192.168.50.1"), netaddr.MustParseIP("fd00:50::1")},
+		Subnets:  []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/16")},
+	}
+
+	cert := ca.sign(identity)
+	verified, err := verifyMemberCert(cert.Certificate[0], ca.pool)
+
+	if err != nil {
+		t.Fatal("Error verifying member certificate: ", err)
+	}
+
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	identity.Serial = leaf.SerialNumber
+
+	if !reflect.DeepEqual(*verified, identity) {
+		t.Fatalf("Expected identity %v got %v", identity, *verified)
+	}
+
+	if !verified.AllowsRoute(netaddr.MustParseIPPrefix("10.0.5.0/24")) {
+		t.Fatalf("Identity doesn't allow a route within its subnets")
+	}
+
+	if verified.AllowsRoute(netaddr.MustParseIPPrefix("10.0.0.0/8")) {
+		t.Fatalf("Identity allows a route wider than its subnets")
+	}
+
+	if verified.AllowsRoute(netaddr.MustParseIPPrefix("0.0.0.0/0")) {
+		t.Fatalf("Identity allows a default route")
+	}
+
+	if _, err := verifyMemberCert(cert.Certificate[0], otherCA.pool); err == nil {
+		t.Fatalf("Certificate verified by a different CA")
+	}
+}
+
+// Tests that members learn each other's identity from their certificates
+func TestCertHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	localhost := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	serverIP := netaddr.MustParseIP("192.168.50.1")
+	clientIP := netaddr.MustParseIP("192.168.50.2")
+
+	serverCert := ca.sign(CertIdentity{Hostname: "server", VpnIPs: []netaddr.IP{serverIP}})
+	clientCert := ca.sign(CertIdentity{Hostname: "client", VpnIPs: []netaddr.IP{clientIP}})
+
+	server, err := NewMultiplexedDTLSConn(localhost, getCertDtlsConfig(serverCert, ca.pool, nil, nil))
+
+	if err != nil {
+		t.Fatal("Error creating server: ", err)
+	}
+
+	defer server.Close()
+
+	client, err := NewMultiplexedDTLSConn(localhost, getCertDtlsConfig(clientCert, ca.pool, nil, nil))
+
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	defer client.Close()
+
+	accepted := make(chan MeshConn)
+
+	go func() {
+		conn, err := server.AcceptMesh()
+
+		if err != nil {
+			t.Error("Error accepting: ", err)
+			close(accepted)
+			return
+		}
+
+		accepted <- conn
+	}()
+
+	clientConn, err := client.DialMesh(server.listener.Addr())
+
+	if err != nil {
+		t.Fatal("Error dialing: ", err)
+	}
+
+	defer clientConn.Close()
+
+	serverConn, ok := <-accepted
+
+	if !ok {
+		t.FailNow()
+	}
+
+	defer serverConn.Close()
+
+	if identity := clientConn.RemoteIdentity(); identity == nil || identity.Hostname != "server" {
+		t.Fatalf("Client got server identity %v", identity)
+	}
+
+	if !reflect.DeepEqual(clientConn.RemoteMeshAddrs(), []netaddr.IP{serverIP}) {
+		t.Fatalf("Client got server VPN IPs %v", clientConn.RemoteMeshAddrs())
+	}
+
+	if identity := serverConn.RemoteIdentity(); identity == nil || identity.Hostname != "client" {
+		t.Fatalf("Server got client identity %v", identity)
+	}
+
+	if !reflect.DeepEqual(serverConn.RemoteMeshAddrs(), []netaddr.IP{clientIP}) {
+		t.Fatalf("Server got client VPN IPs %v", serverConn.RemoteMeshAddrs())
+	}
+}
@@ -0,0 +1,81 @@
+package meshboi
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cachedFile holds what was parsed from a file, only reading and parsing the
+// file again once its modification time or size changes. This lets a file be
+// changed without restarting, without reading it every time it's used.
+type cachedFile struct {
+	path  string
+	parse func([]byte) (interface{}, error)
+
+	modTime time.Time
+	size    int64
+	value   interface{}
+	// whether the file couldn't be read last time, so the error is only
+	// logged once
+	failed bool
+	lock   sync.Mutex
+}
+
+func newCachedFile(path string, parse func([]byte) (interface{}, error)) *cachedFile {
+	return &cachedFile{
+		path:  path,
+		parse: parse,
+	}
+}
+
+// get returns what was parsed from the file, or nil if the file can't be
+// read. If the file has changed but can't be parsed, what was parsed from it
+// before is kept.
+func (c *cachedFile) get() interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	info, err := os.Stat(c.path)
+
+	if err != nil {
+		c.readFailed(err)
+		c.modTime, c.size, c.value = time.Time{}, 0, nil
+		return nil
+	}
+
+	if info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return c.value
+	}
+
+	b, err := ioutil.ReadFile(c.path)
+
+	if err != nil {
+		c.readFailed(err)
+		return c.value
+	}
+
+	c.failed = false
+	c.modTime, c.size = info.ModTime(), info.Size()
+	value, err := c.parse(b)
+
+	if err != nil {
+		log.Warn("Error parsing ", c.path, ": ", err)
+		return c.value
+	}
+
+	c.value = value
+
+	return value
+}
+
+func (c *cachedFile) readFailed(err error) {
+	if !c.failed {
+		log.Warn("Error reading ", c.path, ": ", err)
+	}
+
+	c.failed = true
+}
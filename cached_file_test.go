@@ -0,0 +1,53 @@
+package meshboi
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	parses := 0
+	cached := newCachedFile(path, func(b []byte) (interface{}, error) {
+		parses++
+
+		if string(b) == "bad" {
+			return nil, errors.New("bad file")
+		}
+
+		return string(b), nil
+	})
+
+	if cached.get() != nil {
+		t.Fatalf("Got something from a file that doesn't exist")
+	}
+
+	ioutil.WriteFile(path, []byte("first"), 0600)
+	cached.get()
+
+	if value := cached.get(); value != "first" || parses != 1 {
+		t.Fatalf("Expected the file to be parsed once but got %v after %v parses", value, parses)
+	}
+
+	// Changing the size changes the file even within the mtime resolution
+	ioutil.WriteFile(path, []byte("second"), 0600)
+
+	if value := cached.get(); value != "second" || parses != 2 {
+		t.Fatalf("Changed file wasn't parsed again: %v", value)
+	}
+
+	ioutil.WriteFile(path, []byte("bad"), 0600)
+
+	if value := cached.get(); value != "second" {
+		t.Fatalf("Didn't keep what was parsed before: %v", value)
+	}
+
+	os.Remove(path)
+
+	if value := cached.get(); value != nil {
+		t.Fatalf("Got %v from a removed file", value)
+	}
+}
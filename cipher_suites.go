@@ -0,0 +1,96 @@
+package meshboi
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+)
+
+// The cipher suites members can be configured to use, by name. Only AEAD
+// suites are offered. pion/dtls doesn't support ECDHE-PSK, so only the
+// certificate suites have forward secrecy.
+var cipherSuiteNames = []struct {
+	name string
+	id   dtls.CipherSuiteID
+}{
+	{"ecdhe-ecdsa-aes128-gcm", dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	{"ecdhe-ecdsa-aes128-ccm", dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM},
+	{"ecdhe-ecdsa-aes128-ccm8", dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8},
+	{"psk-aes128-gcm", dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+	{"psk-aes128-ccm", dtls.TLS_PSK_WITH_AES_128_CCM},
+	// Only for talking to older members, as the tag is truncated to 8 bytes
+	{"psk-aes128-ccm8", dtls.TLS_PSK_WITH_AES_128_CCM_8},
+}
+
+// Members from before cipher suites could be chosen only use CCM_8 with the
+// PSK, so can't connect to members using the PSK default until they're given
+// psk-aes128-ccm8 as well
+var (
+	defaultCertCipherSuites = []dtls.CipherSuiteID{dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	defaultPSKCipherSuites  = []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256}
+)
+
+func isPSKCipherSuite(id dtls.CipherSuiteID) bool {
+	switch id {
+	case dtls.TLS_PSK_WITH_AES_128_GCM_SHA256, dtls.TLS_PSK_WITH_AES_128_CCM, dtls.TLS_PSK_WITH_AES_128_CCM_8:
+		return true
+	}
+
+	return false
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names, in
+// order of preference
+func ParseCipherSuites(s string) ([]dtls.CipherSuiteID, error) {
+	var suites []dtls.CipherSuiteID
+
+	for _, name := range strings.Split(s, ",") {
+		id, ok := cipherSuiteByName(strings.TrimSpace(name))
+
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q, expected one of %v", name, strings.Join(CipherSuiteNames(), ", "))
+		}
+
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
+
+func cipherSuiteByName(name string) (dtls.CipherSuiteID, bool) {
+	for _, suite := range cipherSuiteNames {
+		if suite.name == name {
+			return suite.id, true
+		}
+	}
+
+	return 0, false
+}
+
+// CipherSuiteNames lists the names of the cipher suites that can be chosen
+func CipherSuiteNames() []string {
+	names := make([]string, 0, len(cipherSuiteNames))
+
+	for _, suite := range cipherSuiteNames {
+		names = append(names, suite.name)
+	}
+
+	return names
+}
+
+// checkCipherSuites makes sure the cipher suites can be used with the way
+// members are identified, which is either by certificate or PSK
+func checkCipherSuites(suites []dtls.CipherSuiteID, useCerts bool) error {
+	for _, suite := range suites {
+		if isPSKCipherSuite(suite) == useCerts {
+			if useCerts {
+				return fmt.Errorf("cipher suite %v needs a PSK but certificates are being used", suite)
+			}
+
+			return fmt.Errorf("cipher suite %v needs certificates but a PSK is being used", suite)
+		}
+	}
+
+	return nil
+}
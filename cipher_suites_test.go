@@ -0,0 +1,54 @@
+package meshboi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pion/dtls/v2"
+	"inet.af/netaddr"
+)
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites("psk-aes128-gcm, psk-aes128-ccm8")
+
+	if err != nil {
+		t.Fatal("Error parsing cipher suites: ", err)
+	}
+
+	expected := []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256, dtls.TLS_PSK_WITH_AES_128_CCM_8}
+
+	if !reflect.DeepEqual(suites, expected) {
+		t.Fatalf("Expected %v but got %v", expected, suites)
+	}
+
+	if _, err := ParseCipherSuites("psk-aes128-cbc"); err == nil {
+		t.Fatalf("Parsed an unknown cipher suite")
+	}
+
+	if err := checkCipherSuites(suites, true); err == nil {
+		t.Fatalf("Allowed PSK cipher suites with certificates")
+	}
+
+	if err := checkCipherSuites(suites, false); err != nil {
+		t.Fatal("Didn't allow PSK cipher suites with a PSK: ", err)
+	}
+}
+
+// Tests that peers can only connect with the cipher suites both allow
+func TestCipherSuiteNegotiation(t *testing.T) {
+	ring := NewPSKRing(0, []byte("password"))
+	serverIP := []netaddr.IP{netaddr.MustParseIP("192.168.50.1")}
+	clientIP := []netaddr.IP{netaddr.MustParseIP("192.168.50.2")}
+	ccm8 := []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8}
+	both := []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256, dtls.TLS_PSK_WITH_AES_128_CCM_8}
+
+	if _, _, err := handshake(t, getDtlsConfig(serverIP, ring, nil), getDtlsConfig(clientIP, ring, ccm8)); err == nil {
+		t.Fatalf("Peer connected with a cipher suite that isn't allowed")
+	}
+
+	serverConn, _, err := handshake(t, getDtlsConfig(serverIP, ring, nil), getDtlsConfig(clientIP, ring, both))
+
+	if err != nil || serverConn == nil {
+		t.Fatal("Peer couldn't connect with a common cipher suite: ", err)
+	}
+}
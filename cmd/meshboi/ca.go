@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/samvrlewis/meshboi"
+	log "github.com/sirupsen/logrus"
+)
+
+const caUsage = `usage: meshboi ca <cmd> args
+
+Command can be one of
+
+	init	Create a CA for issuing member certificates
+	sign	Issue a certificate for a member
+	revoke	Revoke the certificate of a member
+
+More information on each command and the arguments needed can be found with
+meshboi ca <cmd> -help.`
+
+// loadCertificates loads this member's certificate and key along with the CA
+// used to check the certificates of other members
+func loadCertificates(certPath string, keyPath string, caPath string) (*tls.Certificate, *x509.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caCert, err := meshboi.LoadCA(caPath)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &cert, caCert, nil
+}
+
+// loadCA loads the CA certificate and key, exiting if they can't be loaded
+func loadCA(certPath string, keyPath string) (*x509.Certificate, crypto.Signer) {
+	caCert, err := meshboi.LoadCA(certPath)
+
+	if err != nil {
+		log.Fatalln("Error loading CA certificate: ", err)
+	}
+
+	caKey, err := meshboi.LoadCAKey(keyPath)
+
+	if err != nil {
+		log.Fatalln("Error loading CA key: ", err)
+	}
+
+	return caCert, caKey
+}
+
+// certSerial reads the serial number of a member certificate
+func certSerial(path string) (*big.Int, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(b)
+
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found in " + path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cert.SerialNumber, nil
+}
+
+func writeCertAndKey(certPath string, certPEM []byte, keyPath string, keyPEM []byte) {
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		log.Fatalln("Error writing certificate: ", err)
+	}
+
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		log.Fatalln("Error writing key: ", err)
+	}
+}
+
+func runCA(args []string) {
+	initCommand := flag.NewFlagSet("init", flag.ExitOnError)
+	initName := initCommand.String("name", "meshboi", "The name of the CA")
+	initValidity := initCommand.Duration("validity", 10*365*24*time.Hour, "How long the CA is valid for")
+	initCert := initCommand.String("out-cert", "ca.crt", "The file to write the CA certificate to, which is given to every member with -ca")
+	initKey := initCommand.String("out-key", "ca.key", "The file to write the CA key to. Keep this secret")
+
+	signCommand := flag.NewFlagSet("sign", flag.ExitOnError)
+	signCACert := signCommand.String("ca-cert", "ca.crt", "The CA certificate made with meshboi ca init")
+	signCAKey := signCommand.String("ca-key", "ca.key", "The CA key made with meshboi ca init")
+	signHostname := signCommand.String("hostname", "", "The hostname of the member")
+	signVpnIPs := signCommand.String("vpn-ip", "", "The VPN IP address(es) (with subnet) the member will use, exactly as passed to meshboi client")
+	signSubnets := signCommand.String("subnets", "", "A comma separated list of subnets the member is allowed to advertise routes to. Include 0.0.0.0/0 to allow it to be an exit node")
+	signValidity := signCommand.Duration("validity", 365*24*time.Hour, "How long the certificate is valid for")
+	signCert := signCommand.String("out-cert", "", "The file to write the member certificate to (defaults to <hostname>.crt)")
+	signKey := signCommand.String("out-key", "", "The file to write the member key to (defaults to <hostname>.key)")
+
+	revokeCommand := flag.NewFlagSet("revoke", flag.ExitOnError)
+	revokeCACert := revokeCommand.String("ca-cert", "ca.crt", "The CA certificate made with meshboi ca init")
+	revokeCAKey := revokeCommand.String("ca-key", "ca.key", "The CA key made with meshboi ca init")
+	revokeCert := revokeCommand.String("cert", "", "The member certificate to revoke")
+	revokeSerial := revokeCommand.String("serial", "", "The serial number of the certificate to revoke, if the certificate itself isn't available")
+	revokeCRL := revokeCommand.String("crl", "crl.pem", "The CRL to add the certificate to. It's created if it doesn't exist")
+	revokeValidity := revokeCommand.Duration("validity", 30*24*time.Hour, "How long until the CRL should be replaced with a newer one")
+
+	if len(args) < 1 {
+		fmt.Println(caUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "init":
+		initCommand.Parse(args[1:])
+
+		certPEM, keyPEM, err := meshboi.NewCA(*initName, *initValidity)
+
+		if err != nil {
+			log.Fatalln("Error creating CA: ", err)
+		}
+
+		writeCertAndKey(*initCert, certPEM, *initKey, keyPEM)
+	case "sign":
+		signCommand.Parse(args[1:])
+
+		if *signHostname == "" || *signVpnIPs == "" {
+			log.Error("hostname and vpn-ip arguments must be set.")
+			signCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		caCert, caKey := loadCA(*signCACert, *signCAKey)
+
+		prefixes, err := parseVpnIPPrefixes(*signVpnIPs)
+
+		if err != nil {
+			log.Fatalln("Error parsing vpn-ip: ", err)
+		}
+
+		subnets, err := parseRoutes(*signSubnets)
+
+		if err != nil {
+			log.Fatalln("Error parsing subnets: ", err)
+		}
+
+		identity := meshboi.CertIdentity{
+			Hostname: *signHostname,
+			VpnIPs:   vpnIPs(prefixes),
+			Subnets:  subnets,
+		}
+
+		certPEM, keyPEM, err := meshboi.SignMemberCert(caCert, caKey, identity, *signValidity)
+
+		if err != nil {
+			log.Fatalln("Error signing certificate: ", err)
+		}
+
+		if *signCert == "" {
+			*signCert = *signHostname + ".crt"
+		}
+
+		if *signKey == "" {
+			*signKey = *signHostname + ".key"
+		}
+
+		writeCertAndKey(*signCert, certPEM, *signKey, keyPEM)
+	case "revoke":
+		revokeCommand.Parse(args[1:])
+
+		var serial *big.Int
+
+		switch {
+		case *revokeCert != "":
+			var err error
+			serial, err = certSerial(*revokeCert)
+
+			if err != nil {
+				log.Fatalln("Error loading certificate: ", err)
+			}
+		case *revokeSerial != "":
+			var ok bool
+			serial, ok = new(big.Int).SetString(*revokeSerial, 10)
+
+			if !ok {
+				log.Fatalln("serial must be a decimal number")
+			}
+		default:
+			log.Error("cert or serial argument must be set.")
+			revokeCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		caCert, caKey := loadCA(*revokeCACert, *revokeCAKey)
+
+		previous, err := ioutil.ReadFile(*revokeCRL)
+
+		if os.IsNotExist(err) {
+			previous = nil
+		} else if err != nil {
+			log.Fatalln("Error reading CRL: ", err)
+		}
+
+		crl, err := meshboi.RevokeCerts(caCert, caKey, previous, []*big.Int{serial}, *revokeValidity)
+
+		if err != nil {
+			log.Fatalln("Error creating CRL: ", err)
+		}
+
+		if err := ioutil.WriteFile(*revokeCRL, crl, 0644); err != nil {
+			log.Fatalln("Error writing CRL: ", err)
+		}
+	default:
+		fmt.Println(caUsage)
+		os.Exit(1)
+	}
+}
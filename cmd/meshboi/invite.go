@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samvrlewis/meshboi"
+	log "github.com/sirupsen/logrus"
+)
+
+const inviteUsage = `usage: meshboi invite <cmd> args
+
+Command can be one of
+
+	create	Create a single use token that lets a new member join a network
+
+More information on each command and the arguments needed can be found with
+meshboi invite <cmd> -help.`
+
+// applyInvite fills in the client arguments that weren't set from the
+// invite
+func applyInvite(flags *flag.FlagSet, invite *meshboi.Invite) error {
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	values := map[string]string{
+		"network":             invite.NetworkName,
+		"rolodex-address":     invite.RolodexAddress,
+		"rolodex-port":        strconv.Itoa(invite.RolodexPort),
+		"rolodex-fingerprint": invite.RolodexFingerprint,
+		"vpn-ip":              invite.VpnIP,
+	}
+
+	for name, value := range values {
+		if set[name] || value == "" {
+			continue
+		}
+
+		if err := flags.Set(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inviteCertificates loads the certificate, key and CA in the invite
+func inviteCertificates(invite *meshboi.Invite) (*tls.Certificate, *x509.Certificate, error) {
+	cert, err := tls.X509KeyPair(invite.Certificate, invite.Key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(invite.CA)
+
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, errors.New("no CA certificate found in invite")
+	}
+
+	caCert, err := x509.ParseCertificate(block.Bytes)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &cert, caCert, nil
+}
+
+// loadMemberID reads the member ID from the file, creating a new one if the
+// file doesn't exist
+func loadMemberID(path string) (string, error) {
+	id, err := readSecretFile(path)
+
+	if err == nil {
+		return id, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	id = hex.EncodeToString(b)
+
+	return id, ioutil.WriteFile(path, []byte(id+"\n"), 0600)
+}
+
+func runInvite(args []string) {
+	createCommand := flag.NewFlagSet("create", flag.ExitOnError)
+	createNetwork := createCommand.String("network", "", "The network to invite the member to")
+	createJoinSecretFile := createCommand.String("join-secret-file", "", "A file containing the network's join secret, as given to the rolodex with -join-secrets")
+	createRolodexAddr := createCommand.String("rolodex-address", "", "The address the member should reach the rolodex at")
+	createRolodexPort := createCommand.Int("rolodex-port", defaultPort, "The port of the rolodex")
+	createRolodexFingerprint := createCommand.String("rolodex-fingerprint", "", "The fingerprint of the rolodex, if it was started with -cert-file")
+	createVpnIP := createCommand.String("vpn-ip", "", "The VPN IP address(es) (with subnet) to assign to the member, exactly as passed to meshboi client. Needed when issuing a certificate")
+	createPSK := createCommand.String("psk", "", "The pre shared key of the network. Can also be set with -psk-file or the "+pskEnvVar+" environment variable")
+	createPSKFile := createCommand.String("psk-file", "", "A file containing the pre shared key, to use instead of -psk")
+	createCACert := createCommand.String("ca-cert", "", "The CA certificate made with meshboi ca init. When set, a certificate is issued to the member instead of giving it the PSK")
+	createCAKey := createCommand.String("ca-key", "ca.key", "The CA key made with meshboi ca init")
+	createHostname := createCommand.String("hostname", "", "The hostname of the member, for the certificate issued to it")
+	createCertValidity := createCommand.Duration("cert-validity", 365*24*time.Hour, "How long the certificate issued to the member is valid for")
+	createValidity := createCommand.Duration("validity", 24*time.Hour, "How long the invite can be used for")
+
+	if len(args) < 1 {
+		fmt.Println(inviteUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "create":
+		createCommand.Parse(args[1:])
+
+		if *createNetwork == "" || *createJoinSecretFile == "" || *createRolodexAddr == "" {
+			log.Error("network, join-secret-file and rolodex-address arguments must be set.")
+			createCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		joinSecret, err := readSecretFile(*createJoinSecretFile)
+
+		if err != nil {
+			log.Fatalln("Error reading join-secret-file: ", err)
+		}
+
+		if *createVpnIP != "" {
+			if _, err := parseVpnIPPrefixes(*createVpnIP); err != nil {
+				log.Fatalln("Error parsing vpn-ip: ", err)
+			}
+		}
+
+		invite, err := meshboi.NewInvite(*createNetwork, []byte(joinSecret), *createValidity)
+
+		if err != nil {
+			log.Fatalln("Error creating invite: ", err)
+		}
+
+		invite.RolodexAddress = *createRolodexAddr
+		invite.RolodexPort = *createRolodexPort
+		invite.RolodexFingerprint = strings.ToLower(*createRolodexFingerprint)
+		invite.VpnIP = *createVpnIP
+
+		if *createCACert != "" {
+			if *createVpnIP == "" {
+				log.Error("vpn-ip argument must be set to issue a certificate.")
+				createCommand.PrintDefaults()
+				os.Exit(1)
+			}
+
+			caCert, caKey := loadCA(*createCACert, *createCAKey)
+
+			prefixes, _ := parseVpnIPPrefixes(*createVpnIP)
+			identity := meshboi.CertIdentity{
+				Hostname: *createHostname,
+				VpnIPs:   vpnIPs(prefixes),
+			}
+
+			invite.Certificate, invite.Key, err = meshboi.SignMemberCert(caCert, caKey, identity, *createCertValidity)
+
+			if err != nil {
+				log.Fatalln("Error signing certificate: ", err)
+			}
+
+			invite.CA = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+		} else {
+			invite.PSK, err = readPSK(*createPSK, *createPSKFile)
+
+			if err != nil {
+				log.Fatalln("Error reading psk-file: ", err)
+			}
+
+			if invite.PSK == "" {
+				log.Error("psk argument not set, or ca-cert to issue a certificate instead.")
+				createCommand.PrintDefaults()
+				os.Exit(1)
+			}
+		}
+
+		token, err := invite.Encode()
+
+		if err != nil {
+			log.Fatalln("Error encoding invite: ", err)
+		}
+
+		fmt.Println(token)
+	default:
+		fmt.Println(inviteUsage)
+		os.Exit(1)
+	}
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/pion/dtls/v2"
 	"github.com/samvrlewis/meshboi"
 	log "github.com/sirupsen/logrus"
 	"inet.af/netaddr"
@@ -19,12 +28,161 @@ const usage = `usage: meshboi <cmd> args
 
 Command can be one of
 
-	rolodex	Start meshboi in rollodex mode
+	rolodex		Start meshboi in rollodex mode
 	client		Join as client in an existing peer to peer mesh
+	membership	Manage the keys that prove which VPN IPs members can use
+	ca		Manage the CA that issues certificates to members
+	psk		Manage a PSK ring for changing the PSK while running
+	invite		Create invite tokens for new members
 
 More information on both commands and the arguments needed can be found with
 meshboi <cmd> -help. (eg: meshboi rolodex -help).`
 
+// IPv6 requires links to have an MTU of at least 1280 (RFC 8200)
+const minIPv6Mtu = 1280
+
+// The environment variable the PSK can be given in, so that it isn't visible
+// in the process list like the psk argument is
+const pskEnvVar = "MESHBOI_PSK"
+
+// rolodex is what's needed to run either kind of rolodex
+type rolodex interface {
+	Run()
+	EnableRelay()
+	ServeRevocationList(path string)
+	ServeACLs(path string)
+	SetMaxNetworks(n int)
+	SetWorkers(n int)
+	RequireJoinSecrets(secrets map[string][]byte) error
+	RecordInvites(path string) error
+}
+
+// parseVpnIPPrefixes parses a comma separated list containing at most one IPv4
+// and one IPv6 prefix
+func parseVpnIPPrefixes(s string) ([]netaddr.IPPrefix, error) {
+	var prefixes []netaddr.IPPrefix
+	var haveIPv4, haveIPv6 bool
+
+	for _, prefixString := range strings.Split(s, ",") {
+		prefix, err := netaddr.ParseIPPrefix(strings.TrimSpace(prefixString))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if (prefix.IP.Is4() && haveIPv4) || (prefix.IP.Is6() && haveIPv6) {
+			return nil, fmt.Errorf("more than one address of the same IP version in %v", s)
+		}
+
+		haveIPv4 = haveIPv4 || prefix.IP.Is4()
+		haveIPv6 = haveIPv6 || prefix.IP.Is6()
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// vpnIPs returns the IP addresses of the prefixes
+func vpnIPs(prefixes []netaddr.IPPrefix) []netaddr.IP {
+	ips := make([]netaddr.IP, 0, len(prefixes))
+
+	for _, prefix := range prefixes {
+		ips = append(ips, prefix.IP)
+	}
+
+	return ips
+}
+
+// parseRoutes parses a comma separated list of subnets
+func parseRoutes(s string) ([]netaddr.IPPrefix, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var prefixes []netaddr.IPPrefix
+
+	for _, prefixString := range strings.Split(s, ",") {
+		prefix, err := netaddr.ParseIPPrefix(strings.TrimSpace(prefixString))
+
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// ipForwardingEnabled reports whether the kernel will forward IPv4 packets,
+// which is needed for peers to reach the subnets advertised by this member
+func ipForwardingEnabled() bool {
+	value, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_forward")
+
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSpace(string(value)) == "1"
+}
+
+// readPSK returns the PSK from the psk argument, the psk file or the
+// environment, in that order. An empty PSK is returned if none are set.
+func readPSK(psk string, pskFile string) (string, error) {
+	if psk != "" {
+		log.Warn("The psk argument can be seen by other users of this host, consider using -psk-file or ", pskEnvVar, " instead")
+		return psk, nil
+	}
+
+	if pskFile != "" {
+		return readSecretFile(pskFile)
+	}
+
+	return os.Getenv(pskEnvVar), nil
+}
+
+// readSecretFile reads a secret from a file that only holds the secret
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return "", err
+	}
+
+	// Files usually end with a newline, which isn't part of the secret
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// resolveRolodex returns at most one IPv4 and one IPv6 address for the rolodex
+func resolveRolodex(host string) ([]netaddr.IP, error) {
+	stdIPs, err := net.LookupIP(host)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []netaddr.IP
+	var haveIPv4, haveIPv6 bool
+
+	for _, stdIP := range stdIPs {
+		ip, ok := netaddr.FromStdIP(stdIP)
+
+		if !ok {
+			return nil, fmt.Errorf("error converting %v to netaddr IP", stdIP)
+		}
+
+		if (ip.Is4() && haveIPv4) || (ip.Is6() && haveIPv6) {
+			continue
+		}
+
+		haveIPv4 = haveIPv4 || ip.Is4()
+		haveIPv6 = haveIPv6 || ip.Is6()
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
 func printUsage() {
 	fmt.Println(usage)
 	os.Exit(1)
@@ -33,17 +191,46 @@ func printUsage() {
 func main() {
 
 	rolodexCommand := flag.NewFlagSet("rolodex", flag.ExitOnError)
-	ip := rolodexCommand.String("listen-address", "0.0.0.0", "The IP address for the rolodex to listen on")
+	ip := rolodexCommand.String("listen-address", "::", "The IP address for the rolodex to listen on (the default of :: listens on all IPv4 and IPv6 addresses)")
 	port := rolodexCommand.Int("listen-port", defaultPort, "The port of for the rolodex to listen on")
+	relay := rolodexCommand.Bool("relay", false, "Relay traffic between members that can't connect to each other directly. The traffic stays encrypted between members")
+	rolodexCertFile := rolodexCommand.String("cert-file", "", "A file holding the certificate and key of the rolodex, which is created if it doesn't exist. When set, members talk to the rolodex over DTLS and must be given its fingerprint with -rolodex-fingerprint")
+	rolodexJoinSecrets := rolodexCommand.String("join-secrets", "", "A JSON file of network names to the secret members need to join them, eg: {\"mynetwork\": \"secret\"}. When set, only the networks in the file can be joined")
+	rolodexInvites := rolodexCommand.String("invites-file", "", "A file to record used invites in, so that they can't be used again after restarting. Needs -join-secrets")
+	rolodexCRL := rolodexCommand.String("crl", "", "A CRL from meshboi ca revoke to send to members. The file is reread so that it can be updated while running")
+	maxNetworks := rolodexCommand.Int("max-networks", meshboi.DefaultMaxNetworks, "The most networks the rolodex will hold at once. Heartbeats for new networks are ignored beyond this")
+	workers := rolodexCommand.Int("workers", runtime.NumCPU(), "How many goroutines read and handle messages from members")
+	rolodexACLs := rolodexCommand.String("acl", "", "A JSON file of network names to the ACL policy to send to their members. Only members using -rolodex-fingerprint use it. The file is reread so that it can be updated while running")
 
 	clientCommand := flag.NewFlagSet("client", flag.ExitOnError)
 	networkName := clientCommand.String("network", "", "The unique network name that identifies the mesh (should be the same on all members in the mesh)")
 	tunName := clientCommand.String("tun-name", "tun", "The name to assign to the tun adapter")
 	tunMtu := clientCommand.Int("tun-mtu", 1200, "The MTU of the tun")
-	vpnIPPrefixString := clientCommand.String("vpn-ip", "", "The IP address (with subnet) to assign to the tunnel eg: 192.168.50.1/24")
+	vpnIPPrefixString := clientCommand.String("vpn-ip", "", "The IP address (with subnet) to assign to the tunnel eg: 192.168.50.1/24. An IPv4 and an IPv6 address can both be assigned by separating them with a comma eg: 192.168.50.1/24,fd00:50::1/64")
 	rolodexAddr := clientCommand.String("rolodex-address", "rolodex.samlewis.me", "The IP address of the meshboi server")
 	rolodexPort := clientCommand.Int("rolodex-port", defaultPort, "The port of the server")
-	psk := clientCommand.String("psk", "", "The pre shared key to use (should be the same on all members in the mesh)")
+	joinSecretFile := clientCommand.String("join-secret-file", "", "A file containing the secret the rolodex needs to join the network, if it was started with -join-secrets")
+	rolodexFingerprint := clientCommand.String("rolodex-fingerprint", "", "The fingerprint the rolodex logs when started with -cert-file. When set, the rolodex is talked to over DTLS and must have the matching certificate")
+	inviteToken := clientCommand.String("invite", "", "An invite token from meshboi invite create, which fills in the network, rolodex and credentials")
+	memberIDFile := clientCommand.String("member-id-file", "", "A file to keep this member's ID in, which is created if it doesn't exist. Needed to keep using an invite after restarting")
+	psk := clientCommand.String("psk", "", "The pre shared key to use (should be the same on all members in the mesh). Not needed if using certificates. Can also be set with -psk-file or the "+pskEnvVar+" environment variable. The key used for DTLS is derived from it, which older members don't do, so see -psk-kdf while upgrading")
+	pskKDF := clientCommand.String("psk-kdf", "argon2id", "How the key used for DTLS is made from the PSK, either argon2id or none. Older members use the PSK as the key, so use none until every member is upgraded and then move to argon2id with a PSK ring from meshboi psk init -legacy")
+	pskFile := clientCommand.String("psk-file", "", "A file containing the pre shared key, to use instead of -psk")
+	pskRingFile := clientCommand.String("psk-ring", "", "A PSK ring from meshboi psk init, to use instead of -psk so that the PSK can be changed while running")
+	certFile := clientCommand.String("cert", "", "The certificate for this member from meshboi ca sign, to use instead of a PSK")
+	keyFile := clientCommand.String("key", "", "The key for the certificate given with -cert")
+	caFile := clientCommand.String("ca", "", "The CA certificate from meshboi ca init, used to check the certificates of other members")
+	crlFile := clientCommand.String("crl", "", "A CRL from meshboi ca revoke listing the certificates of members that can no longer connect. Newer CRLs are also taken from the rolodex")
+	cipherSuites := clientCommand.String("cipher-suites", "", "A comma separated list of the cipher suites peers can connect with, in order of preference. Peers that can't use any of them are refused. One or more of "+strings.Join(meshboi.CipherSuiteNames(), ", ")+". Defaults to ecdhe-ecdsa-aes128-gcm for certificates or psk-aes128-gcm for the PSK. Older members only use psk-aes128-ccm8, so while upgrading a PSK network use psk-aes128-gcm,psk-aes128-ccm8 until every member is upgraded. The PSK suites have no forward secrecy, as ECDHE-PSK isn't supported, so use certificates if it's needed")
+	aclFile := clientCommand.String("acl", "", "A JSON file with the ACL policy limiting the traffic to and from peers. Newer policies are taken from the rolodex if -rolodex-fingerprint is set")
+	peerTimeout := clientCommand.Duration("peer-timeout", 30*time.Second, "How long a peer can go without being heard from before it is disconnected. Must be at least twice the 10s keep alive interval.")
+	advertiseRoutes := clientCommand.String("advertise-routes", "", "A comma separated list of subnets that other members can reach through this member eg: 10.0.0.0/24,10.0.1.0/24")
+	acceptRoutes := clientCommand.Bool("accept-routes", false, "Route traffic for the subnets advertised by other members through the mesh")
+	exitNode := clientCommand.String("exit-node", "", "The VPN IP of a member to send all other IPv4 traffic through. The member must be run with -exit-node-allow")
+	relayForPeers := clientCommand.Bool("relay-for-peers", false, "Relay traffic between members that can't connect to each other directly but can both connect to this member")
+	networkKey := clientCommand.String("network-key", "", "The public network key from meshboi membership init. When set, members must prove the VPN IPs they use were signed by the network key")
+	membership := clientCommand.String("membership", "", "The credentials from meshboi membership issue that prove this member can use its VPN IPs. Needed if network-key is set")
+	exitNodeAllow := clientCommand.Bool("exit-node-allow", false, "Allow other members to send all of their traffic through this member, which is forwarded and NATed out of this host's uplink")
 
 	if len(os.Args) < 2 {
 		printUsage()
@@ -54,17 +241,101 @@ func main() {
 		rolodexCommand.Parse(os.Args[2:])
 	case "client":
 		clientCommand.Parse(os.Args[2:])
+	case "membership":
+		runMembership(os.Args[2:])
+		return
+	case "ca":
+		runCA(os.Args[2:])
+		return
+	case "psk":
+		runPSK(os.Args[2:])
+		return
+	case "invite":
+		runInvite(os.Args[2:])
+		return
 	default:
 		printUsage()
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-c
+		log.Info("Shutting down")
+		cancel()
+	}()
+
 	if clientCommand.Parsed() {
-		if *psk == "" {
+		var invite *meshboi.Invite
+
+		if *inviteToken != "" {
+			var err error
+			invite, err = meshboi.ParseInvite(*inviteToken)
+
+			if err != nil {
+				log.Fatalln("Error parsing invite: ", err)
+			}
+
+			if err := applyInvite(clientCommand, invite); err != nil {
+				log.Fatalln("Error using invite: ", err)
+			}
+
+			if *memberIDFile == "" {
+				log.Warn("Without member-id-file the invite can't be used again after restarting")
+			}
+		}
+
+		inviteCerts := invite != nil && invite.Certificate != nil
+		useCerts := inviteCerts || *certFile != "" || *keyFile != "" || *caFile != ""
+
+		if !inviteCerts && useCerts && (*certFile == "" || *keyFile == "" || *caFile == "") {
+			log.Error("cert, key and ca arguments must all be set to use certificates.")
+			clientCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		pskValue, err := readPSK(*psk, *pskFile)
+
+		if err != nil {
+			log.Fatalln("Error reading psk-file: ", err)
+		}
+
+		if pskValue == "" && invite != nil {
+			pskValue = invite.PSK
+		}
+
+		if *pskKDF != "argon2id" && *pskKDF != "none" {
+			log.Error("psk-kdf must be argon2id or none.")
+			clientCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		if *pskKDF == "none" && (*pskRingFile != "" || useCerts) {
+			log.Error("psk-kdf none can only be used with psk. Make a PSK ring with meshboi psk init -legacy instead.")
+			clientCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		if useCerts && *pskRingFile != "" {
+			log.Error("psk-ring can't be used along with certificates.")
+			clientCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		if pskValue == "" && *pskRingFile == "" && !useCerts {
 			log.Error("psk argument not set. Please set with a secure password")
 			clientCommand.PrintDefaults()
 			os.Exit(1)
 		}
 
+		if *pskKDF == "argon2id" && *pskRingFile == "" && !useCerts {
+			log.Info("The DTLS key is derived from the PSK, so members from before keys were derived can't connect. Use -psk-kdf none until every member is upgraded")
+		}
+
 		if *networkName == "" {
 			log.Error("network argument not set.")
 			clientCommand.PrintDefaults()
@@ -77,53 +348,283 @@ func main() {
 			os.Exit(1)
 		}
 
-		vpnIPPrefix, err := netaddr.ParseIPPrefix(*vpnIPPrefixString)
+		vpnIPPrefixes, err := parseVpnIPPrefixes(*vpnIPPrefixString)
+
+		if err != nil {
+			log.Fatalln("Error parsing vpn-ip: ", err)
+		}
+
+		tunIPs := make([]string, 0, len(vpnIPPrefixes))
+
+		for _, prefix := range vpnIPPrefixes {
+			if prefix.IP.Is6() && *tunMtu < minIPv6Mtu {
+				log.Fatalln("tun-mtu must be at least ", minIPv6Mtu, " to use an IPv6 vpn-ip")
+			}
+
+			tunIPs = append(tunIPs, prefix.String())
+		}
 
-		tun, err := meshboi.NewTunWithConfig(*tunName, vpnIPPrefix.String(), *tunMtu)
+		routes, err := parseRoutes(*advertiseRoutes)
 
 		if err != nil {
-			log.Fatalln("Error creating tun: ", err)
+			log.Fatalln("Error parsing advertise-routes: ", err)
+		}
+
+		if len(routes) > 0 && !ipForwardingEnabled() {
+			log.Warn("IP forwarding is disabled so advertised routes won't be reachable. Enable it with sysctl -w net.ipv4.ip_forward=1")
+		}
+
+		var networkPublicKey ed25519.PublicKey
+		var credentials *meshboi.MemberCredentials
+
+		if *networkKey != "" {
+			networkPublicKey, err = parseNetworkPublicKey(*networkKey)
+
+			if err != nil {
+				log.Fatalln("Error parsing network-key: ", err)
+			}
+
+			if *membership == "" {
+				log.Error("membership argument must be set when network-key is.")
+				clientCommand.PrintDefaults()
+				os.Exit(1)
+			}
+
+			credentials, err = meshboi.LoadMemberCredentials(*membership)
+
+			if err != nil {
+				log.Fatalln("Error loading membership: ", err)
+			}
 		}
 
-		rolodexStdIP, err := net.ResolveIPAddr("ip", *rolodexAddr)
+		var cert *tls.Certificate
+		var caCert *x509.Certificate
+
+		if inviteCerts {
+			cert, caCert, err = inviteCertificates(invite)
+
+			if err != nil {
+				log.Fatalln("Error loading certificates from invite: ", err)
+			}
+		} else if useCerts {
+			cert, caCert, err = loadCertificates(*certFile, *keyFile, *caFile)
+
+			if err != nil {
+				log.Fatalln("Error loading certificates: ", err)
+			}
+		}
+
+		var joinSecret []byte
+
+		if *joinSecretFile != "" {
+			secret, err := readSecretFile(*joinSecretFile)
+
+			if err != nil {
+				log.Fatalln("Error reading join-secret-file: ", err)
+			}
+
+			joinSecret = []byte(secret)
+		}
+
+		var inviteClaim *meshboi.InviteClaim
+
+		if invite != nil {
+			joinSecret = invite.Secret
+			inviteClaim = invite.Claim()
+		}
+
+		var memberID string
+
+		if *memberIDFile != "" {
+			memberID, err = loadMemberID(*memberIDFile)
+
+			if err != nil {
+				log.Fatalln("Error loading member-id-file: ", err)
+			}
+		}
+
+		var fingerprint []byte
+
+		if *rolodexFingerprint != "" {
+			fingerprint, err = meshboi.ParseCertFingerprint(*rolodexFingerprint)
+
+			if err != nil {
+				log.Fatalln("Error parsing rolodex-fingerprint: ", err)
+			}
+		}
+
+		var suites []dtls.CipherSuiteID
+
+		if *cipherSuites != "" {
+			suites, err = meshboi.ParseCipherSuites(*cipherSuites)
+
+			if err != nil {
+				log.Fatalln("Error parsing cipher-suites: ", err)
+			}
+		}
+
+		var aclPolicy *meshboi.ACLPolicy
+
+		if *aclFile != "" {
+			aclPolicy, err = meshboi.LoadACLPolicy(*aclFile)
+
+			if err != nil {
+				log.Fatalln("Error loading acl: ", err)
+			}
+		}
+
+		var pskRing *meshboi.PSKRing
+
+		if *pskRingFile != "" {
+			pskRing, err = loadPSKRing(*pskRingFile, *networkName)
+
+			if err != nil {
+				log.Fatalln("Error loading psk-ring: ", err)
+			}
+		}
+
+		if *peerTimeout < meshboi.MinPeerTimeout {
+			log.Fatalln("peer-timeout must be at least ", meshboi.MinPeerTimeout)
+		}
+
+		var exitNodeIP netaddr.IP
+
+		if *exitNode != "" {
+			exitNodeIP, err = netaddr.ParseIP(*exitNode)
+
+			if err != nil || !exitNodeIP.Is4() {
+				log.Fatalln("exit-node must be the IPv4 VPN IP of a member")
+			}
+		}
+
+		tun, err := meshboi.NewTunWithConfig(*tunName, tunIPs, *tunMtu)
 
 		if err != nil {
-			log.Fatalln("Error parsing rolodex-address ", err)
+			log.Fatalln("Error creating tun: ", err)
 		}
 
-		rolodexIP, ok := netaddr.FromStdIP(rolodexStdIP.IP)
+		rolodexIPs, err := resolveRolodex(*rolodexAddr)
 
-		if !ok {
-			log.Fatalln("Error converting to netaddr IP")
+		if err != nil {
+			log.Fatalln("Error parsing rolodex-address ", err)
 		}
 
-		mc, err := meshboi.NewMeshBoiClient(tun, vpnIPPrefix, rolodexIP, *rolodexPort, *networkName, []byte(*psk))
+		mc, err := meshboi.NewMeshBoiClient(meshboi.MeshboiClientConfig{
+			Tun:              tun,
+			VpnIPPrefixes:    vpnIPPrefixes,
+			RolodexIPs:       rolodexIPs,
+			RolodexPort:      *rolodexPort,
+			NetworkName:      *networkName,
+			PSK:              []byte(pskValue),
+			PSKRing:          pskRing,
+			LegacyPSK:        *pskKDF == "none",
+			PeerTimeout:      *peerTimeout,
+			AdvertisedRoutes: routes,
+			AcceptRoutes:     *acceptRoutes,
+			ExitNode:         exitNodeIP,
+			AllowExitNode:    *exitNodeAllow,
+			RelayForPeers:    *relayForPeers,
+			NetworkKey:       networkPublicKey,
+			Membership:       credentials,
+			Certificate:      cert,
+			CA:               caCert,
+			CRLFile:          *crlFile,
+			CipherSuites:     suites,
+			ACL:              aclPolicy,
+
+			RolodexFingerprint: fingerprint,
+			JoinSecret:         joinSecret,
+			Invite:             inviteClaim,
+			MemberID:           memberID,
+		})
 
 		if err != nil {
 			log.Fatalln("Error starting mesh client ", err)
 		}
 
-		mc.Run()
+		if *exitNodeAllow {
+			nat, err := meshboi.NewExitNodeNat(tun.Name, vpnIPPrefixes)
+
+			if err != nil {
+				log.Fatalln("Error setting up exit node NAT ", err)
+			}
+
+			defer nat.Close()
+		}
+
+		if pskRing != nil {
+			go watchPSKRing(mc, *pskRingFile, *networkName)
+		}
+
+		if err := mc.Run(ctx); err != context.Canceled {
+			log.Fatalln("Mesh client stopped unexpectedly ", err)
+		}
 	} else if rolodexCommand.Parsed() {
 		addr := &net.UDPAddr{IP: net.ParseIP(*ip), Port: *port}
-		conn, err := net.ListenUDP("udp", addr)
+		var rollo rolodex
 
-		if err != nil {
-			log.Fatalln("Error starting listener ", err)
+		if *rolodexCertFile != "" {
+			cert, err := meshboi.LoadOrCreateRolodexCert(*rolodexCertFile)
+
+			if err != nil {
+				log.Fatalln("Error loading rolodex certificate ", err)
+			}
+
+			log.Info("Rolodex fingerprint (pass to members with -rolodex-fingerprint): ", meshboi.CertFingerprint(cert))
+
+			rollo, err = meshboi.NewDTLSRolodex(addr, cert, 5*time.Second, 30*time.Second)
+
+			if err != nil {
+				log.Fatalln("Error creating rolodex ", err)
+			}
+		} else {
+			conn, err := net.ListenUDP("udp", addr)
+
+			if err != nil {
+				log.Fatalln("Error starting listener ", err)
+			}
+
+			rollo, err = meshboi.NewRolodex(conn, 5*time.Second, 30*time.Second)
+
+			if err != nil {
+				log.Fatalln("Error creating rolodex ", err)
+			}
 		}
 
-		rollo, err := meshboi.NewRolodex(conn, 5*time.Second, 30*time.Second)
+		if *relay {
+			rollo.EnableRelay()
+		}
 
-		if err != nil {
-			log.Fatalln("Error creating rolodex ", err)
+		rollo.SetMaxNetworks(*maxNetworks)
+		rollo.SetWorkers(*workers)
+
+		if *rolodexJoinSecrets != "" {
+			secrets, err := meshboi.LoadJoinSecrets(*rolodexJoinSecrets)
+
+			if err != nil {
+				log.Fatalln("Error loading join secrets ", err)
+			}
+
+			if err := rollo.RequireJoinSecrets(secrets); err != nil {
+				log.Fatalln("Error requiring join secrets ", err)
+			}
 		}
-		rollo.Run()
-	}
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
-	select {
-	case <-c:
-		log.Info("Shutting down")
+		if *rolodexInvites != "" {
+			if err := rollo.RecordInvites(*rolodexInvites); err != nil {
+				log.Fatalln("Error loading invites file ", err)
+			}
+		}
+
+		if *rolodexCRL != "" {
+			rollo.ServeRevocationList(*rolodexCRL)
+		}
+
+		if *rolodexACLs != "" {
+			rollo.ServeACLs(*rolodexACLs)
+		}
+
+		go rollo.Run()
+		<-ctx.Done()
 	}
 }
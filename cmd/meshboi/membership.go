@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/samvrlewis/meshboi"
+	log "github.com/sirupsen/logrus"
+)
+
+const membershipUsage = `usage: meshboi membership <cmd> args
+
+Command can be one of
+
+	init	Create a network key for signing memberships
+	issue	Issue a membership that lets a member use its VPN IPs
+
+More information on both commands and the arguments needed can be found with
+meshboi membership <cmd> -help.`
+
+// parseNetworkPublicKey parses the base64 encoded public network key that is
+// given to every member
+func parseNetworkPublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.New("network key is the wrong size")
+	}
+
+	return ed25519.PublicKey(b), nil
+}
+
+func loadNetworkPrivateKey(path string) (ed25519.PrivateKey, error) {
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) != ed25519.PrivateKeySize {
+		return nil, errors.New("network key file is the wrong size")
+	}
+
+	return ed25519.PrivateKey(b), nil
+}
+
+func runMembership(args []string) {
+	initCommand := flag.NewFlagSet("init", flag.ExitOnError)
+	initOut := initCommand.String("out", "network.key", "The file to write the private network key to. Keep this secret")
+
+	issueCommand := flag.NewFlagSet("issue", flag.ExitOnError)
+	issueKey := issueCommand.String("network-key-file", "network.key", "The private network key made with meshboi membership init")
+	issueVpnIPs := issueCommand.String("vpn-ip", "", "The VPN IP address(es) (with subnet) the member will use, exactly as passed to meshboi client")
+	issueOut := issueCommand.String("out", "membership.json", "The file to write the member's credentials to, which are passed to meshboi client with -membership")
+
+	if len(args) < 1 {
+		fmt.Println(membershipUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "init":
+		initCommand.Parse(args[1:])
+
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+
+		if err != nil {
+			log.Fatalln("Error generating network key: ", err)
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(privateKey)
+
+		if err := ioutil.WriteFile(*initOut, []byte(encoded+"\n"), 0600); err != nil {
+			log.Fatalln("Error writing network key: ", err)
+		}
+
+		fmt.Println("Network public key (pass to every member with -network-key):")
+		fmt.Println(base64.StdEncoding.EncodeToString(publicKey))
+	case "issue":
+		issueCommand.Parse(args[1:])
+
+		if *issueVpnIPs == "" {
+			log.Error("vpn-ip argument not set.")
+			issueCommand.PrintDefaults()
+			os.Exit(1)
+		}
+
+		networkKey, err := loadNetworkPrivateKey(*issueKey)
+
+		if err != nil {
+			log.Fatalln("Error loading network key: ", err)
+		}
+
+		prefixes, err := parseVpnIPPrefixes(*issueVpnIPs)
+
+		if err != nil {
+			log.Fatalln("Error parsing vpn-ip: ", err)
+		}
+
+		credentials, err := meshboi.IssueMembership(networkKey, vpnIPs(prefixes))
+
+		if err != nil {
+			log.Fatalln("Error issuing membership: ", err)
+		}
+
+		if err := credentials.Save(*issueOut); err != nil {
+			log.Fatalln("Error writing membership: ", err)
+		}
+	default:
+		fmt.Println(membershipUsage)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/samvrlewis/meshboi"
+	log "github.com/sirupsen/logrus"
+)
+
+const pskUsage = `usage: meshboi psk <cmd> args
+
+Command can be one of
+
+	init	Create a PSK ring, which lets the PSK be changed without restarting members
+	add	Add a new PSK to the ring to roll forward to later
+	roll	Roll the ring forward to the PSK that was added
+
+To change the PSK, add a new one and give the ring to every member, then roll
+the ring and give it to every member again. Running members reload the ring
+when sent SIGHUP, and reconnect to their peers with the new PSK after a roll.
+
+Rings made with init -legacy start with the PSK used as it is, as members from
+before PSKs were derived from passphrases use it. Adding and rolling to a new
+PSK once every member has the ring moves the network to derived keys.
+
+More information on each command and the arguments needed can be found with
+meshboi psk <cmd> -help.`
+
+// watchPSKRing reloads the PSK ring from the file whenever SIGHUP is received
+func watchPSKRing(mc *meshboi.MeshboiClient, path string, networkName string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		ring, err := loadPSKRing(path, networkName)
+
+		if err != nil {
+			log.Error("Error reloading PSK ring: ", err)
+			continue
+		}
+
+		if err := mc.UpdatePSKRing(ring); err != nil {
+			log.Error("Error updating PSK ring: ", err)
+			continue
+		}
+
+		log.Info("Reloaded PSK ring, now using PSK ", ring.Current())
+	}
+}
+
+func loadPSKRing(path string, networkName string) (*meshboi.PSKRing, error) {
+	ringFile, err := meshboi.LoadPSKRingFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ringFile.Ring(networkName)
+}
+
+func runPSK(args []string) {
+	initCommand := flag.NewFlagSet("init", flag.ExitOnError)
+	initOut := initCommand.String("out", "psk-ring.json", "The file to write the ring to, which is passed to meshboi client with -psk-ring. Keep this secret")
+	initPSKFile := initCommand.String("psk-file", "", "A file containing the PSK members use now, to start the ring with. A random PSK is used if not set")
+	initLegacy := initCommand.Bool("legacy", false, "Use the PSK from psk-file as the key without deriving it, as members run with -psk-kdf none and older members do. Add and roll to a new PSK once every member has the ring to move off it")
+
+	addCommand := flag.NewFlagSet("add", flag.ExitOnError)
+	addRing := addCommand.String("ring", "psk-ring.json", "The ring to add a PSK to")
+
+	rollCommand := flag.NewFlagSet("roll", flag.ExitOnError)
+	rollRing := rollCommand.String("ring", "psk-ring.json", "The ring to roll forward")
+
+	if len(args) < 1 {
+		fmt.Println(pskUsage)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "init":
+		initCommand.Parse(args[1:])
+
+		passphrase, err := readPSK("", *initPSKFile)
+
+		if err != nil {
+			log.Fatalln("Error reading psk-file: ", err)
+		}
+
+		if *initLegacy && passphrase == "" {
+			log.Fatalln("legacy needs the PSK members use now in psk-file")
+		}
+
+		ringFile, err := meshboi.NewPSKRingFile(passphrase)
+
+		if err != nil {
+			log.Fatalln("Error creating PSK ring: ", err)
+		}
+
+		ringFile.Legacy = *initLegacy
+
+		if err := ringFile.Save(*initOut); err != nil {
+			log.Fatalln("Error writing PSK ring: ", err)
+		}
+	case "add":
+		addCommand.Parse(args[1:])
+
+		ringFile, err := meshboi.LoadPSKRingFile(*addRing)
+
+		if err != nil {
+			log.Fatalln("Error loading PSK ring: ", err)
+		}
+
+		id, err := ringFile.AddNext()
+
+		if err != nil {
+			log.Fatalln("Error adding PSK: ", err)
+		}
+
+		if err := ringFile.Save(*addRing); err != nil {
+			log.Fatalln("Error writing PSK ring: ", err)
+		}
+
+		fmt.Println("Added PSK", id, "- give the ring to every member before rolling forward to it")
+	case "roll":
+		rollCommand.Parse(args[1:])
+
+		ringFile, err := meshboi.LoadPSKRingFile(*rollRing)
+
+		if err != nil {
+			log.Fatalln("Error loading PSK ring: ", err)
+		}
+
+		id, err := ringFile.Roll()
+
+		if err != nil {
+			log.Fatalln("Error rolling PSK ring: ", err)
+		}
+
+		if err := ringFile.Save(*rollRing); err != nil {
+			log.Fatalln("Error writing PSK ring: ", err)
+		}
+
+		fmt.Println("Rolled forward to PSK", id)
+	default:
+		fmt.Println(pskUsage)
+		os.Exit(1)
+	}
+}
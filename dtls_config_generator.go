@@ -1,22 +1,179 @@
 package meshboi
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/pion/dtls/v2"
 	"inet.af/netaddr"
 )
 
-func getDtlsConfig(vpnIp netaddr.IP, psk []byte) *dtls.Config {
+// getDtlsConfig makes a config for meshes where members share a PSK. The
+// cipher suites default to defaultPSKCipherSuites if not given, and peers
+// that can't use one of them can't connect.
+func getDtlsConfig(vpnIps []netaddr.IP, ring *PSKRing, suites []dtls.CipherSuiteID) *dtls.Config {
+	if suites == nil {
+		suites = defaultPSKCipherSuites
+	}
+
 	return &dtls.Config{
+		// The hint given is the other side's, which has the ID of the PSK it
+		// uses
 		PSK: func(hint []byte) ([]byte, error) {
-			return psk, nil
+			peerID, err := parsePSKID(hint)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return ring.key(peerID)
 		},
-		// We set the PSK identity hint as the IP address of this member in the
-		// VPN as an quick and hacky way of signalling (out of band) who this
+		// We set the PSK identity hint as the IP address(es) of this member in
+		// the VPN as an quick and hacky way of signalling (out of band) who this
 		// member is to other members we connect to. A more robust way of
 		// achieving this would be to define an OOB messaging scheme to do this
 		// with instead.
-		PSKIdentityHint:      []byte(vpnIp.String()),
-		CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8},
+		PSKIdentityHint:      pskIdentityHint(vpnIps, ring.Current()),
+		CipherSuites:         suites,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+}
+
+// identityHint encodes the VPN IPs of this member as a comma separated list
+func identityHint(vpnIps []netaddr.IP) []byte {
+	ips := make([]string, 0, len(vpnIps))
+
+	for _, ip := range vpnIps {
+		ips = append(ips, ip.String())
+	}
+
+	return []byte(strings.Join(ips, ","))
+}
+
+// pskIdentityHint adds the ID of the PSK this member uses to the identity
+// hint. It's left off for the ID 0 so that members without a PSK ring can
+// still parse the hint.
+func pskIdentityHint(vpnIps []netaddr.IP, pskID uint32) []byte {
+	hint := identityHint(vpnIps)
+
+	if pskID == 0 {
+		return hint
+	}
+
+	return []byte(fmt.Sprintf("%s#%d", hint, pskID))
+}
+
+// parsePSKID returns the ID of the PSK in the identity hint, which is 0 if
+// there isn't one
+func parsePSKID(hint []byte) (uint32, error) {
+	i := strings.IndexByte(string(hint), '#')
+
+	if i < 0 {
+		return 0, nil
+	}
+
+	id, err := strconv.ParseUint(string(hint[i+1:]), 10, 32)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid PSK ID in identity hint: %w", err)
+	}
+
+	return uint32(id), nil
+}
+
+func parseIdentityHint(hint []byte) ([]netaddr.IP, error) {
+	if i := strings.IndexByte(string(hint), '#'); i >= 0 {
+		hint = hint[:i]
+	}
+
+	if len(hint) == 0 {
+		return nil, errors.New("empty identity hint")
+	}
+
+	var ips []netaddr.IP
+
+	for _, ipString := range strings.Split(string(hint), ",") {
+		ip, err := netaddr.ParseIP(ipString)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ips = append(ips, ip)
+	}
+
+	return ips, nil
+}
+
+// getRolodexDtlsConfig makes a config for talking to the rolodex, which is
+// trusted if its certificate has the expected fingerprint
+func getRolodexDtlsConfig(fingerprint []byte) *dtls.Config {
+	return &dtls.Config{
+		CipherSuites: []dtls.CipherSuiteID{dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		// The rolodex's certificate is pinned rather than issued by a CA
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate from rolodex")
+			}
+
+			sum := sha256.Sum256(rawCerts[0])
+
+			if !bytes.Equal(sum[:], fingerprint) {
+				return errors.New("rolodex certificate doesn't match the fingerprint")
+			}
+
+			return nil
+		},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ConnectContextMaker: func() (context.Context, func()) {
+			return context.WithTimeout(context.Background(), rolodexHandshakeTimeout)
+		},
+	}
+}
+
+// getCertDtlsConfig makes a config for meshes where each member has its own
+// certificate issued by the mesh CA, rather than all sharing a PSK. The ECDHE
+// key exchange gives forward secrecy, and a compromised member can only ever
+// claim the VPN IPs in its own certificate. The cipher suites default to
+// defaultCertCipherSuites if not given.
+func getCertDtlsConfig(cert tls.Certificate, caPool *x509.CertPool, revocations *RevocationList, suites []dtls.CipherSuiteID) *dtls.Config {
+	if suites == nil {
+		suites = defaultCertCipherSuites
+	}
+
+	return &dtls.Config{
+		Certificates: []tls.Certificate{cert},
+		CipherSuites: suites,
+		// Members are dialed by their internet address, which isn't in their
+		// certificate, so the usual hostname checks don't apply. Instead both
+		// sides check that the other's certificate was issued by the CA.
+		InsecureSkipVerify: true,
+		ClientAuth:         dtls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate from peer")
+			}
+
+			identity, err := verifyMemberCert(rawCerts[0], caPool)
+
+			if err != nil {
+				return err
+			}
+
+			if revocations.IsRevoked(identity) {
+				return errors.New("certificate has been revoked")
+			}
+
+			return nil
+		},
 		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
 	}
 }
@@ -0,0 +1,60 @@
+package meshboi
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestIdentityHintRoundTrip(t *testing.T) {
+	ips := []netaddr.IP{netaddr.MustParseIP("192.168.50.1"), netaddr.MustParseIP("fd00:50::1")}
+
+	parsed, err := parseIdentityHint(identityHint(ips))
+
+	if err != nil {
+		t.Fatalf("Error parsing identity hint: %v", err)
+	}
+
+	if !reflect.DeepEqual(parsed, ips) {
+		t.Fatalf("Expected %v but got %v", ips, parsed)
+	}
+}
+
+func TestBadIdentityHint(t *testing.T) {
+	if _, err := parseIdentityHint([]byte("")); err == nil {
+		t.Fatalf("Expected error parsing empty hint")
+	}
+
+	if _, err := parseIdentityHint([]byte("192.168.50.1,notanip")); err == nil {
+		t.Fatalf("Expected error parsing bad hint")
+	}
+}
+
+func TestPSKIdentityHint(t *testing.T) {
+	ips := []netaddr.IP{netaddr.MustParseIP("192.168.50.1"), netaddr.MustParseIP("fd00:50::1")}
+
+	for _, id := range []uint32{0, 7} {
+		hint := pskIdentityHint(ips, id)
+		parsed, err := parseIdentityHint(hint)
+
+		if err != nil || !reflect.DeepEqual(parsed, ips) {
+			t.Fatalf("Expected %v but got %v %v", ips, parsed, err)
+		}
+
+		parsedID, err := parsePSKID(hint)
+
+		if err != nil || parsedID != id {
+			t.Fatalf("Expected PSK %v but got %v %v", id, parsedID, err)
+		}
+	}
+
+	// Members without a PSK ring don't send an ID
+	if string(pskIdentityHint(ips, 0)) != string(identityHint(ips)) {
+		t.Fatalf("PSK 0 changed the identity hint")
+	}
+
+	if _, err := parsePSKID([]byte("192.168.50.1#notanid")); err == nil {
+		t.Fatalf("Expected error parsing bad PSK ID")
+	}
+}
@@ -0,0 +1,200 @@
+package meshboi
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"inet.af/netaddr"
+)
+
+// defaultRoute is advertised by members that are willing to be an exit node
+var defaultRoute = netaddr.IPPrefix{IP: netaddr.IPv4(0, 0, 0, 0), Bits: 0}
+
+// kernelRoutes returns the routes to add to the kernel for a prefix. A default
+// route is split into two halves so that it takes precedence over the
+// existing default route without having to replace it.
+func kernelRoutes(prefix netaddr.IPPrefix) []netaddr.IPPrefix {
+	if prefix.Bits != 0 {
+		return []netaddr.IPPrefix{prefix}
+	}
+
+	if prefix.IP.Is4() {
+		return []netaddr.IPPrefix{
+			{IP: netaddr.IPv4(0, 0, 0, 0), Bits: 1},
+			{IP: netaddr.IPv4(128, 0, 0, 0), Bits: 1},
+		}
+	}
+
+	return []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("::/1"),
+		netaddr.MustParseIPPrefix("8000::/1"),
+	}
+}
+
+// BypassRoutes keeps traffic to the internet addresses of the rolodex and the
+// mesh members going through the original default gateway once the default
+// route points at the tun. Without these, the encrypted traffic to the exit
+// node would itself be routed back into the tun.
+type BypassRoutes struct {
+	gateway string
+	dev     string
+	added   map[netaddr.IP]bool
+	lock    sync.Mutex
+}
+
+// NewBypassRoutes looks up the current IPv4 default gateway, which must be
+// done before any default route is added to the tun
+func NewBypassRoutes() (*BypassRoutes, error) {
+	output, err := exec.Command("/sbin/ip", "-4", "route", "show", "default").Output()
+
+	if err != nil {
+		return nil, err
+	}
+
+	gateway, dev, err := parseDefaultRoute(string(output))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &BypassRoutes{
+		gateway: gateway,
+		dev:     dev,
+		added:   make(map[netaddr.IP]bool),
+	}, nil
+}
+
+// parseDefaultRoute parses the output of ip route show default, eg:
+// default via 192.168.1.1 dev eth0 proto dhcp metric 100
+func parseDefaultRoute(output string) (gateway string, dev string, err error) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 || fields[0] != "default" {
+			continue
+		}
+
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				gateway = fields[i+1]
+			case "dev":
+				dev = fields[i+1]
+			}
+		}
+
+		if dev != "" {
+			return gateway, dev, nil
+		}
+	}
+
+	return "", "", errors.New("no default route found")
+}
+
+// Add routes traffic for the IP through the original default gateway. Only
+// IPv4 addresses need bypassing as exit nodes only carry IPv4 traffic.
+func (b *BypassRoutes) Add(ip netaddr.IP) error {
+	if !ip.Is4() {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.added[ip] {
+		return nil
+	}
+
+	args := []string{"route", "replace", ip.String() + "/32"}
+
+	if b.gateway != "" {
+		args = append(args, "via", b.gateway)
+	}
+
+	args = append(args, "dev", b.dev)
+
+	if err := exec.Command("/sbin/ip", args...).Run(); err != nil {
+		return err
+	}
+
+	b.added[ip] = true
+
+	return nil
+}
+
+// Close removes all of the bypass routes that were added
+func (b *BypassRoutes) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ip := range b.added {
+		if err := exec.Command("/sbin/ip", "route", "del", ip.String()+"/32", "dev", b.dev).Run(); err != nil {
+			log.Warn("Error removing bypass route for ", ip, ": ", err)
+		}
+
+		delete(b.added, ip)
+	}
+}
+
+// ExitNodeNat forwards traffic from the mesh out of this host's uplink,
+// masquerading it behind this host's address
+type ExitNodeNat struct {
+	rules [][]string
+}
+
+// NewExitNodeNat enables IPv4 forwarding and adds a NAT rule for traffic from
+// each of the IPv4 VPN subnets that leaves through an interface other than
+// the tun
+func NewExitNodeNat(tunName string, vpnPrefixes []netaddr.IPPrefix) (*ExitNodeNat, error) {
+	if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return nil, fmt.Errorf("couldn't enable IP forwarding: %w", err)
+	}
+
+	nat := &ExitNodeNat{}
+
+	for _, prefix := range vpnPrefixes {
+		if !prefix.IP.Is4() {
+			continue
+		}
+
+		prefix, err := masked(prefix)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rule := []string{"POSTROUTING", "-s", prefix.String(), "!", "-o", tunName, "-j", "MASQUERADE"}
+
+		if err := iptablesNat("-A", rule); err != nil {
+			nat.Close()
+			return nil, err
+		}
+
+		nat.rules = append(nat.rules, rule)
+	}
+
+	return nat, nil
+}
+
+func iptablesNat(action string, rule []string) error {
+	args := append([]string{"-t", "nat", action}, rule...)
+
+	return exec.Command("/sbin/iptables", args...).Run()
+}
+
+// Close removes the NAT rules. IP forwarding is left enabled as other things
+// on the host may rely on it.
+func (n *ExitNodeNat) Close() {
+	for _, rule := range n.rules {
+		if err := iptablesNat("-D", rule); err != nil {
+			log.Warn("Error removing NAT rule: ", err)
+		}
+	}
+
+	n.rules = nil
+}
@@ -0,0 +1,48 @@
+package meshboi
+
+import (
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParseDefaultRoute(t *testing.T) {
+	output := "default via 192.168.1.1 dev eth0 proto dhcp metric 100\ndefault via 10.0.0.1 dev wlan0 proto dhcp metric 600\n"
+
+	gateway, dev, err := parseDefaultRoute(output)
+
+	if err != nil {
+		t.Fatalf("Error parsing default route %v", err)
+	}
+
+	if gateway != "192.168.1.1" || dev != "eth0" {
+		t.Fatalf("Unexpected default route %v %v", gateway, dev)
+	}
+
+	// Point to point links don't have a gateway
+	gateway, dev, err = parseDefaultRoute("default dev ppp0 scope link")
+
+	if err != nil || gateway != "" || dev != "ppp0" {
+		t.Fatalf("Unexpected default route %v %v %v", gateway, dev, err)
+	}
+
+	if _, _, err := parseDefaultRoute(""); err == nil {
+		t.Fatalf("Expected an error without a default route")
+	}
+}
+
+func TestKernelRoutes(t *testing.T) {
+	routes := kernelRoutes(defaultRoute)
+	expected := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("0.0.0.0/1"), netaddr.MustParseIPPrefix("128.0.0.0/1")}
+
+	if !reflect.DeepEqual(routes, expected) {
+		t.Fatalf("Default route wasn't split %v", routes)
+	}
+
+	subnet := netaddr.MustParseIPPrefix("10.1.0.0/16")
+
+	if routes := kernelRoutes(subnet); len(routes) != 1 || routes[0] != subnet {
+		t.Fatalf("Subnet route was changed %v", routes)
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/pion/dtls/v2 v2.0.8
 	github.com/samvrlewis/udp v0.1.1-0.20210505081938-3a6139185318
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
 	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	inet.af/netaddr v0.0.0-20210313195008-843b4240e319
@@ -0,0 +1,196 @@
+package meshboi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The start of every invite token, so that they're recognisable
+const invitePrefix = "meshboi-invite:"
+
+// Invite holds everything a new member needs to join a network. It's handed
+// out as a token made with Encode. Instead of the network's join secret, the
+// invite has a secret derived from it that the rolodex only accepts from the
+// first member to use it, and only if it's used before the invite expires.
+type Invite struct {
+	ID      string
+	Expires time.Time
+	Secret  []byte
+
+	NetworkName        string
+	RolodexAddress     string
+	RolodexPort        int
+	RolodexFingerprint string `json:",omitempty"`
+
+	// The VPN IP(s) to use, if the invite pre-assigns them
+	VpnIP string `json:",omitempty"`
+	// The credentials to connect to other members with, which is either the
+	// PSK or a certificate and key along with the CA, all PEM encoded
+	PSK         string `json:",omitempty"`
+	Certificate []byte `json:",omitempty"`
+	Key         []byte `json:",omitempty"`
+	CA          []byte `json:",omitempty"`
+}
+
+// InviteClaim is sent to the rolodex by members joining with an invite, so
+// that the rolodex can work out the invite's secret
+type InviteClaim struct {
+	ID      string
+	Expires int64
+}
+
+// inviteSecret derives the secret for an invite from the network's join
+// secret, so that the rolodex doesn't need to be told about invites before
+// they're used
+func inviteSecret(joinSecret []byte, id string, expires int64) []byte {
+	mac := hmac.New(sha256.New, joinSecret)
+	mac.Write([]byte("meshboi-invite"))
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(expires))
+	mac.Write(b)
+	mac.Write([]byte(id))
+
+	return mac.Sum(nil)
+}
+
+// NewInvite creates an invite to the network that has to be used within the
+// validity. The rest of the invite, such as where the rolodex is and the
+// credentials, is left to be filled in.
+func NewInvite(networkName string, joinSecret []byte, validity time.Duration) (*Invite, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	id := hex.EncodeToString(b)
+	// The expiry is given to the rolodex in seconds, so drop anything finer
+	expires := time.Now().Add(validity).Truncate(time.Second)
+
+	return &Invite{
+		ID:          id,
+		Expires:     expires,
+		Secret:      inviteSecret(joinSecret, id, expires.Unix()),
+		NetworkName: networkName,
+	}, nil
+}
+
+// Claim returns what's sent to the rolodex to use the invite
+func (i *Invite) Claim() *InviteClaim {
+	return &InviteClaim{ID: i.ID, Expires: i.Expires.Unix()}
+}
+
+// Encode turns the invite into a token that can be copied to the new member
+func (i *Invite) Encode() (string, error) {
+	b, err := json.Marshal(i)
+
+	if err != nil {
+		return "", err
+	}
+
+	return invitePrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ParseInvite reads an invite from a token made with Encode
+func ParseInvite(token string) (*Invite, error) {
+	token = strings.TrimSpace(token)
+
+	if !strings.HasPrefix(token, invitePrefix) {
+		return nil, errors.New("not a meshboi invite")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(token, invitePrefix))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var invite Invite
+
+	if err := json.Unmarshal(b, &invite); err != nil {
+		return nil, err
+	}
+
+	if invite.ID == "" || invite.NetworkName == "" || invite.RolodexAddress == "" {
+		return nil, errors.New("invite is missing details")
+	}
+
+	return &invite, nil
+}
+
+// inviteRegistry remembers which member used each invite, so that each
+// invite can only be used by one member
+type inviteRegistry struct {
+	// map of invite ID to the ID of the member that used it
+	redeemed map[string]string
+	// the file to keep the used invites in, if any
+	path string
+	lock sync.Mutex
+}
+
+func newInviteRegistry() *inviteRegistry {
+	return &inviteRegistry{redeemed: make(map[string]string)}
+}
+
+// load reads the used invites from the file, which is then kept up to date
+// as more invites are used. The file doesn't have to exist yet.
+func (r *inviteRegistry) load(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(b, &r.redeemed); err != nil {
+			return err
+		}
+	}
+
+	r.path = path
+
+	return nil
+}
+
+// redeem reports whether the member can use the invite, which is the case if
+// it already has or if nobody has used the unexpired invite yet
+func (r *inviteRegistry) redeem(claim *InviteClaim, memberID string) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if redeemer, ok := r.redeemed[claim.ID]; ok {
+		return redeemer == memberID, nil
+	}
+
+	if time.Now().After(time.Unix(claim.Expires, 0)) {
+		return false, nil
+	}
+
+	r.redeemed[claim.ID] = memberID
+
+	if r.path == "" {
+		return true, nil
+	}
+
+	b, err := json.Marshal(r.redeemed)
+
+	if err != nil {
+		return true, err
+	}
+
+	return true, ioutil.WriteFile(r.path, b, 0600)
+}
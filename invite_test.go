@@ -0,0 +1,91 @@
+package meshboi
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInviteEncoding(t *testing.T) {
+	invite, err := NewInvite("network", []byte("secret"), time.Hour)
+
+	if err != nil {
+		t.Fatal("Error creating invite: ", err)
+	}
+
+	invite.RolodexAddress = "rolodex.example.com"
+	invite.RolodexPort = 6264
+	invite.PSK = "psk"
+
+	token, err := invite.Encode()
+
+	if err != nil {
+		t.Fatal("Error encoding invite: ", err)
+	}
+
+	parsed, err := ParseInvite(token)
+
+	if err != nil {
+		t.Fatal("Error parsing invite: ", err)
+	}
+
+	if !parsed.Expires.Equal(invite.Expires) {
+		t.Fatalf("Expected invite to expire at %v but got %v", invite.Expires, parsed.Expires)
+	}
+
+	// The time zone and monotonic clock reading don't survive encoding
+	parsed.Expires = invite.Expires
+
+	if !reflect.DeepEqual(parsed, invite) {
+		t.Fatalf("Expected %+v but got %+v", invite, parsed)
+	}
+
+	if _, err := ParseInvite(token[1:]); err == nil {
+		t.Fatalf("Parsed a token without the prefix")
+	}
+}
+
+func TestInviteRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invites.json")
+	registry := newInviteRegistry()
+
+	if err := registry.load(path); err != nil {
+		t.Fatal("Error loading missing invites file: ", err)
+	}
+
+	claim := &InviteClaim{ID: "invite", Expires: time.Now().Add(time.Hour).Unix()}
+
+	if ok, err := registry.redeem(claim, "first"); !ok || err != nil {
+		t.Fatalf("Couldn't use new invite: %v", err)
+	}
+
+	if ok, _ := registry.redeem(claim, "first"); !ok {
+		t.Fatalf("Member couldn't keep using its invite")
+	}
+
+	if ok, _ := registry.redeem(claim, "second"); ok {
+		t.Fatalf("Another member used the same invite")
+	}
+
+	expired := &InviteClaim{ID: "expired", Expires: time.Now().Add(-time.Second).Unix()}
+
+	if ok, _ := registry.redeem(expired, "first"); ok {
+		t.Fatalf("Used an expired invite")
+	}
+
+	// Used invites are remembered after restarting
+	restarted := newInviteRegistry()
+
+	if err := restarted.load(path); err != nil {
+		t.Fatal("Error loading invites file: ", err)
+	}
+
+	if ok, _ := restarted.redeem(claim, "second"); ok {
+		t.Fatalf("Another member used the same invite after restarting")
+	}
+
+	if ok, _ := restarted.redeem(claim, "first"); !ok {
+		t.Fatalf("Member couldn't keep using its invite after restarting")
+	}
+}
@@ -0,0 +1,150 @@
+package meshboi
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// How long a join challenge can be answered for. Challenges from the previous
+// period are also accepted so that one made just before the period ends still
+// works.
+const joinChallengePeriod = time.Minute
+
+// joinChallenger makes challenges that members must answer with their
+// network's join secret before the rolodex tells them about other members.
+// Challenges are tied to the member's address so that an answer seen on the
+// wire can't be replayed from elsewhere, and are derived from a key rather
+// than stored so that unauthorised members can't use up the rolodex's memory.
+type joinChallenger struct {
+	key []byte
+}
+
+func newJoinChallenger() (*joinChallenger, error) {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &joinChallenger{key: key}, nil
+}
+
+func (j *joinChallenger) challengeAt(addr netaddr.IPPort, t time.Time) []byte {
+	period := make([]byte, 8)
+	binary.BigEndian.PutUint64(period, uint64(t.UnixNano()/int64(joinChallengePeriod)))
+
+	mac := hmac.New(sha256.New, j.key)
+	mac.Write(period)
+	mac.Write([]byte(addr.String()))
+
+	return mac.Sum(nil)
+}
+
+// challenge returns the challenge for a member at the address
+func (j *joinChallenger) challenge(addr netaddr.IPPort) []byte {
+	return j.challengeAt(addr, time.Now())
+}
+
+// valid reports whether the challenge was recently made for the address
+func (j *joinChallenger) valid(challenge []byte, addr netaddr.IPPort) bool {
+	now := time.Now()
+
+	return hmac.Equal(challenge, j.challengeAt(addr, now)) ||
+		hmac.Equal(challenge, j.challengeAt(addr, now.Add(-joinChallengePeriod)))
+}
+
+// joinProof answers a join challenge, proving that the member knows the join
+// secret for the network
+func joinProof(secret []byte, challenge []byte, networkName string, memberID string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("meshboi-join"))
+	mac.Write(challenge)
+	// The lengths keep the network name and member ID from running together
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(networkName)))
+	mac.Write(length)
+	mac.Write([]byte(networkName))
+	mac.Write([]byte(memberID))
+
+	return mac.Sum(nil)
+}
+
+// Members are known to the rolodex by the public half of a key derived from
+// their member ID, and sign the rolodex's challenge with the key to prove they
+// hold the ID. This stops anyone who sees a member's heartbeats from moving
+// the member to their own address in the network map.
+
+// memberIDKey derives the key that the member ID proves itself with
+func memberIDKey(memberID string) ed25519.PrivateKey {
+	seed := sha256.Sum256([]byte("meshboi-member-id" + memberID))
+
+	return ed25519.NewKeyFromSeed(seed[:])
+}
+
+// publicMemberID is the ID that the rolodex knows the member with the key by
+func publicMemberID(key ed25519.PrivateKey) string {
+	return hex.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// isPublicMemberID reports whether the ID can be proven, which IDs from older
+// members can't
+func isPublicMemberID(memberID string) bool {
+	return len(memberID) == hex.EncodedLen(ed25519.PublicKeySize)
+}
+
+func memberIDSigned(challenge []byte, networkName string) []byte {
+	signed := append([]byte("meshboi-member-id"), challenge...)
+
+	return append(signed, networkName...)
+}
+
+// memberIDProof answers a challenge from the rolodex, proving that the member
+// holds its ID
+func memberIDProof(key ed25519.PrivateKey, challenge []byte, networkName string) []byte {
+	return ed25519.Sign(key, memberIDSigned(challenge, networkName))
+}
+
+// validMemberIDProof reports whether the proof was made with the key that the
+// public member ID is from
+func validMemberIDProof(memberID string, challenge []byte, networkName string, proof []byte) bool {
+	publicKey, err := hex.DecodeString(memberID)
+
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+
+	return ed25519.Verify(publicKey, memberIDSigned(challenge, networkName), proof)
+}
+
+// LoadJoinSecrets reads the join secret of each network from a JSON object
+// of network names to secrets
+func LoadJoinSecrets(path string) (map[string][]byte, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var secretStrings map[string]string
+
+	if err := json.Unmarshal(b, &secretStrings); err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string][]byte, len(secretStrings))
+
+	for network, secret := range secretStrings {
+		secrets[network] = []byte(secret)
+	}
+
+	return secrets, nil
+}
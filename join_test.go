@@ -0,0 +1,74 @@
+package meshboi
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestJoinChallenge(t *testing.T) {
+	challenger, err := newJoinChallenger()
+
+	if err != nil {
+		t.Fatal("Error creating challenger: ", err)
+	}
+
+	addr := netaddr.MustParseIPPort("192.168.4.1:2000")
+	otherAddr := netaddr.MustParseIPPort("192.168.4.2:2000")
+	challenge := challenger.challenge(addr)
+
+	if !challenger.valid(challenge, addr) {
+		t.Fatalf("Challenge isn't valid for its own address")
+	}
+
+	if challenger.valid(challenge, otherAddr) {
+		t.Fatalf("Challenge is valid for another address")
+	}
+
+	if !challenger.valid(challenger.challengeAt(addr, time.Now().Add(-joinChallengePeriod)), addr) {
+		t.Fatalf("Challenge from the previous period isn't valid")
+	}
+
+	if challenger.valid(challenger.challengeAt(addr, time.Now().Add(-2*joinChallengePeriod)), addr) {
+		t.Fatalf("Old challenge is still valid")
+	}
+}
+
+func TestJoinProof(t *testing.T) {
+	challenge := []byte("challenge")
+	proof := joinProof([]byte("secret"), challenge, "network", "member")
+
+	if bytes.Equal(proof, joinProof([]byte("wrong"), challenge, "network", "member")) {
+		t.Fatalf("Proof doesn't depend on the secret")
+	}
+
+	if bytes.Equal(proof, joinProof([]byte("secret"), challenge, "networ", "kmember")) {
+		t.Fatalf("Network name and member ID run together")
+	}
+}
+
+func TestMemberIDProof(t *testing.T) {
+	key := memberIDKey("secret")
+	memberID := publicMemberID(key)
+	challenge := []byte("challenge")
+
+	if !isPublicMemberID(memberID) || isPublicMemberID("secret") {
+		t.Fatalf("Public member IDs weren't told apart from others")
+	}
+
+	proof := memberIDProof(key, challenge, "network")
+
+	if !validMemberIDProof(memberID, challenge, "network", proof) {
+		t.Fatalf("Proof wasn't valid")
+	}
+
+	if validMemberIDProof(memberID, challenge, "other", proof) {
+		t.Fatalf("Proof was valid for another network")
+	}
+
+	if validMemberIDProof(memberID, challenge, "network", memberIDProof(memberIDKey("other"), challenge, "network")) {
+		t.Fatalf("Proof from another key was valid")
+	}
+}
@@ -0,0 +1,458 @@
+package meshboi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+// Rather than the whole network map every time, members that understand map
+// updates are sent only the changes since the version of the map they last
+// told the rolodex they have. Members that are too far behind for the rolodex
+// to still know what changed are sent the whole map again, split over as many
+// datagrams as it takes.
+
+// How many changes the rolodex remembers for each network
+const maxMapChanges = 256
+
+// The largest map update frame, so that frames fit in a single datagram
+// without being fragmented by IP
+const maxMapFrameSize = 1200
+
+// How many members are put in each fragment of a snapshot, which keeps the
+// fragments under maxMapFrameSize even when every member has long IPv6
+// addresses
+const snapshotFragmentMembers = 8
+
+// MapDelta is the change to the network map between two versions. Members are
+// identified by a hash of their member ID, as the ID itself has to be kept
+// secret by each member.
+type MapDelta struct {
+	Epoch   uint64
+	From    uint64
+	Version uint64
+	Changed map[string]MemberAddrs `json:",omitempty"`
+	Left    []string               `json:",omitempty"`
+}
+
+// MapSnapshot is one fragment of the whole network map at a version. Each
+// fragment holds some of the members, and the map is complete once every
+// fragment has been received.
+type MapSnapshot struct {
+	Epoch     uint64
+	Version   uint64
+	Fragment  int
+	Fragments int
+	Members   map[string]MemberAddrs
+}
+
+// mapAck is the version of the map a member has told the rolodex it has
+type mapAck struct {
+	epoch   uint64
+	version uint64
+}
+
+type mapChange struct {
+	version uint64
+	key     string
+	// zero if the member left
+	addrs MemberAddrs
+}
+
+// memberKey is how members are identified to each other in map updates
+func memberKey(memberID string) string {
+	sum := sha256.Sum256([]byte("meshboi-member" + memberID))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// newMapEpoch picks the epoch for a new network, which is never zero so that
+// members without a map can't be mistaken for being up to date
+func newMapEpoch() uint64 {
+	b := make([]byte, 8)
+
+	for {
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+
+		if epoch := binary.BigEndian.Uint64(b); epoch != 0 {
+			return epoch
+		}
+	}
+}
+
+// recordChange bumps the version of the map for a change to a member's
+// addresses. membersLock must be held for writing.
+func (mesh *meshNetwork) recordChange(key string, addrs MemberAddrs) {
+	mesh.mapVersion++
+	mesh.mapChanges = append(mesh.mapChanges, mapChange{version: mesh.mapVersion, key: key, addrs: addrs})
+
+	if len(mesh.mapChanges) > maxMapChanges {
+		mesh.mapChanges = mesh.mapChanges[len(mesh.mapChanges)-maxMapChanges:]
+	}
+}
+
+// mapDelta returns the changes since the version, or nil if they aren't all
+// known. membersLock must be held.
+func (mesh *meshNetwork) mapDelta(from uint64) *MapDelta {
+	if from > mesh.mapVersion {
+		return nil
+	}
+
+	var changes []mapChange
+
+	if from < mesh.mapVersion {
+		if len(mesh.mapChanges) == 0 || mesh.mapChanges[0].version > from+1 {
+			return nil
+		}
+
+		// The changes have consecutive versions
+		changes = mesh.mapChanges[from+1-mesh.mapChanges[0].version:]
+	}
+
+	latest := make(map[string]MemberAddrs)
+
+	for _, change := range changes {
+		latest[change.key] = change.addrs
+	}
+
+	delta := MapDelta{Epoch: mesh.mapEpoch, From: from, Version: mesh.mapVersion}
+
+	for key, addrs := range latest {
+		if addrs == (MemberAddrs{}) {
+			delta.Left = append(delta.Left, key)
+			continue
+		}
+
+		if delta.Changed == nil {
+			delta.Changed = make(map[string]MemberAddrs)
+		}
+
+		delta.Changed[key] = addrs
+	}
+
+	sort.Strings(delta.Left)
+
+	return &delta
+}
+
+// mapSnapshot splits the whole map into fragments. membersLock must be held.
+func (mesh *meshNetwork) mapSnapshot() []MapSnapshot {
+	keys := make([]string, 0, len(mesh.members))
+	addrs := make(map[string]MemberAddrs, len(mesh.members))
+
+	for _, member := range mesh.members {
+		keys = append(keys, member.key)
+		addrs[member.key] = member.addrs()
+	}
+
+	sort.Strings(keys)
+
+	fragments := (len(keys) + snapshotFragmentMembers - 1) / snapshotFragmentMembers
+
+	if fragments == 0 {
+		fragments = 1
+	}
+
+	snapshots := make([]MapSnapshot, 0, fragments)
+
+	for i := 0; i < fragments; i++ {
+		snapshot := MapSnapshot{
+			Epoch:     mesh.mapEpoch,
+			Version:   mesh.mapVersion,
+			Fragment:  i,
+			Fragments: fragments,
+			Members:   make(map[string]MemberAddrs),
+		}
+
+		for _, key := range keys[i*snapshotFragmentMembers:] {
+			if len(snapshot.Members) == snapshotFragmentMembers {
+				break
+			}
+
+			snapshot.Members[key] = addrs[key]
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots
+}
+
+// mapFrames works out the map updates to send to each member, sharing them
+// between members that have the same version of the map
+type mapFrames struct {
+	mesh *meshNetwork
+	// whether the updates are sent in the binary wire format rather than as
+	// JSON frames
+	binaryWire bool
+	deltas     map[uint64][][]byte
+	snapshot   [][]byte
+}
+
+func newMapFrames(mesh *meshNetwork, binaryWire bool) *mapFrames {
+	return &mapFrames{mesh: mesh, binaryWire: binaryWire, deltas: make(map[uint64][][]byte)}
+}
+
+func (f *mapFrames) encodeDelta(delta MapDelta) []byte {
+	if f.binaryWire {
+		return encodeMapDelta(delta)
+	}
+
+	b, err := json.Marshal(delta)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return append([]byte{mapDeltaFrame}, b...)
+}
+
+func (f *mapFrames) encodeSnapshot(snapshot MapSnapshot) []byte {
+	if f.binaryWire {
+		return encodeMapSnapshot(snapshot)
+	}
+
+	b, err := json.Marshal(snapshot)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return append([]byte{mapSnapshotFrame}, b...)
+}
+
+// forMember returns the frames to send to a member that has the version of
+// the map, or nil if the member doesn't understand map updates
+func (f *mapFrames) forMember(ack *mapAck) [][]byte {
+	if ack == nil {
+		return nil
+	}
+
+	if ack.epoch == f.mesh.mapEpoch {
+		if frames, ok := f.deltas[ack.version]; ok {
+			return frames
+		}
+
+		// Deltas that don't fit in a datagram aren't worth the trouble of
+		// fragmenting, as the snapshot isn't much bigger
+		if delta := f.mesh.mapDelta(ack.version); delta != nil {
+			if frame := f.encodeDelta(*delta); len(frame) <= maxMapFrameSize {
+				f.deltas[ack.version] = [][]byte{frame}
+				return f.deltas[ack.version]
+			}
+		}
+	}
+
+	if f.snapshot == nil {
+		for _, snapshot := range f.mesh.mapSnapshot() {
+			f.snapshot = append(f.snapshot, f.encodeSnapshot(snapshot))
+		}
+	}
+
+	return f.snapshot
+}
+
+// mapState is a member's copy of the network map, which is kept up to date
+// with the updates from the rolodex
+type mapState struct {
+	// our own key, so that we can find ourselves in the map
+	self    string
+	epoch   uint64
+	version uint64
+	members map[string]MemberAddrs
+	// the snapshot that's still being received, if any
+	pending          *MapSnapshot
+	pendingFragments map[int]bool
+	lock             sync.Mutex
+}
+
+func newMapState(memberID string) *mapState {
+	return &mapState{self: memberKey(memberID), members: make(map[string]MemberAddrs)}
+}
+
+// ack returns the version of the map we have, to tell the rolodex about
+func (s *mapState) ack() (uint64, uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.epoch, s.version
+}
+
+// apply updates the map with a delta or snapshot fragment, in either the
+// binary wire format or a JSON frame
+func (s *mapState) apply(msg []byte) (NetworkMap, bool, error) {
+	var delta MapDelta
+	var snapshot MapSnapshot
+	var isDelta bool
+	var err error
+
+	if isWireMessage(msg) {
+		var msgType byte
+		var fields []byte
+
+		if msgType, fields, err = parseWireMessage(msg); err != nil {
+			return NetworkMap{}, false, err
+		}
+
+		switch msgType {
+		case wireMapDelta:
+			isDelta = true
+			delta, err = decodeMapDelta(fields)
+		case wireMapSnapshot:
+			snapshot, err = decodeMapSnapshot(fields)
+		default:
+			return NetworkMap{}, false, fmt.Errorf("unexpected binary message type %v", msgType)
+		}
+	} else if isMapUpdateFrame(msg) {
+		isDelta = msg[0] == mapDeltaFrame
+
+		if isDelta {
+			err = json.Unmarshal(msg[1:], &delta)
+		} else {
+			err = json.Unmarshal(msg[1:], &snapshot)
+		}
+	} else {
+		return NetworkMap{}, false, errors.New("not a map update")
+	}
+
+	if err != nil {
+		return NetworkMap{}, false, err
+	}
+
+	if isDelta {
+		return s.applyDelta(delta)
+	}
+
+	return s.applySnapshot(snapshot)
+}
+
+// applyDelta updates the map with a delta, returning false if the delta isn't
+// for the version we have. Deltas the rolodex sent before learning we're up
+// to date are ignored, as it'll send the right one once it does.
+func (s *mapState) applyDelta(delta MapDelta) (NetworkMap, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if delta.Epoch != s.epoch {
+		return NetworkMap{}, false, nil
+	}
+
+	if delta.Version == s.version {
+		// Nothing has changed, but the map is passed on anyway so that
+		// members we haven't managed to connect to are tried again
+		return s.networkMap()
+	}
+
+	if delta.From != s.version {
+		return NetworkMap{}, false, nil
+	}
+
+	for key, addrs := range delta.Changed {
+		s.members[key] = addrs
+	}
+
+	for _, key := range delta.Left {
+		delete(s.members, key)
+	}
+
+	s.version = delta.Version
+
+	return s.networkMap()
+}
+
+// applySnapshot adds a fragment of a snapshot, returning the map once every
+// fragment of the snapshot has been received
+func (s *mapState) applySnapshot(snapshot MapSnapshot) (NetworkMap, bool, error) {
+	if snapshot.Fragment < 0 || snapshot.Fragment >= snapshot.Fragments {
+		return NetworkMap{}, false, errors.New("snapshot fragment out of range")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if snapshot.Epoch == s.epoch && snapshot.Version == s.version {
+		// The rolodex hasn't heard that we have this snapshot yet
+		return NetworkMap{}, false, nil
+	}
+
+	pending := s.pending
+
+	if pending == nil || pending.Epoch != snapshot.Epoch || pending.Version != snapshot.Version || pending.Fragments != snapshot.Fragments {
+		pending = &MapSnapshot{
+			Epoch:     snapshot.Epoch,
+			Version:   snapshot.Version,
+			Fragments: snapshot.Fragments,
+			Members:   make(map[string]MemberAddrs),
+		}
+		s.pending = pending
+		s.pendingFragments = make(map[int]bool)
+	}
+
+	if s.pendingFragments[snapshot.Fragment] {
+		return NetworkMap{}, false, nil
+	}
+
+	for key, addrs := range snapshot.Members {
+		pending.Members[key] = addrs
+	}
+
+	s.pendingFragments[snapshot.Fragment] = true
+
+	if len(s.pendingFragments) < pending.Fragments {
+		return NetworkMap{}, false, nil
+	}
+
+	s.epoch = pending.Epoch
+	s.version = pending.Version
+	s.members = pending.Members
+	s.pending = nil
+	s.pendingFragments = nil
+
+	return s.networkMap()
+}
+
+// networkMap returns the map in the form the rolodex sends to older members,
+// or false if we aren't in it yet. lock must be held.
+func (s *mapState) networkMap() (NetworkMap, bool, error) {
+	self, ok := s.members[s.self]
+
+	if !ok {
+		return NetworkMap{}, false, nil
+	}
+
+	keys := make([]string, 0, len(s.members))
+
+	for key := range s.members {
+		if key != s.self {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+
+	// We're always first in the map
+	members := make([]MemberAddrs, 0, len(s.members))
+	members = append(members, self)
+
+	for _, key := range keys {
+		members = append(members, s.members[key])
+	}
+
+	addresses := make([]netaddr.IPPort, 0, len(members))
+
+	for _, member := range members {
+		addresses = append(addresses, member.Primary())
+	}
+
+	return NetworkMap{Addresses: addresses, Members: members, YourIndex: 0}, true, nil
+}
@@ -0,0 +1,194 @@
+package meshboi
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func memberAddr(i int) netaddr.IPPort {
+	return netaddr.IPPort{IP: netaddr.IPv4(10, 0, byte(i>>8), byte(i)), Port: 2000}
+}
+
+// applyFrames applies map update frames in reverse order, returning the map
+// from the last one that completed an update
+func applyFrames(t *testing.T, state *mapState, frames [][]byte) (NetworkMap, bool) {
+	var nmap NetworkMap
+	var updated bool
+
+	for i := len(frames) - 1; i >= 0; i-- {
+		m, ok, err := state.apply(frames[i])
+
+		if err != nil {
+			t.Fatal("Error applying map update: ", err)
+		}
+
+		if ok {
+			nmap, updated = m, true
+		}
+	}
+
+	return nmap, updated
+}
+
+func currentAck(state *mapState) *mapAck {
+	epoch, version := state.ack()
+
+	return &mapAck{epoch: epoch, version: version}
+}
+
+func TestMapUpdates(t *testing.T) {
+	rollo, _ := newRolodex(discardTransport{}, time.Second, time.Minute)
+	mesh := newMeshNetwork(rollo, "test")
+
+	for i := 0; i < 20; i++ {
+		mesh.register(fmt.Sprint("member", i), memberAddr(i), nil, false)
+	}
+
+	state := newMapState("member0")
+
+	// Without a map, the whole map is sent in fragments
+	frames := newMapFrames(mesh, false).forMember(currentAck(state))
+
+	if len(frames) != 3 || frames[0][0] != mapSnapshotFrame {
+		t.Fatalf("Expected a snapshot in 3 fragments but got %v frames", len(frames))
+	}
+
+	for _, frame := range frames {
+		if len(frame) > maxMapFrameSize {
+			t.Fatalf("Snapshot fragment is %v bytes", len(frame))
+		}
+	}
+
+	nmap, ok := applyFrames(t, state, frames)
+
+	if !ok || len(nmap.Members) != 20 {
+		t.Fatalf("Snapshot wasn't applied: %v", nmap)
+	}
+
+	if nmap.Members[nmap.YourIndex].IPv4 != memberAddr(0) {
+		t.Fatalf("Wrong address for ourselves %v", nmap.Members[nmap.YourIndex])
+	}
+
+	// Once up to date, only the changes are sent
+	mesh.register("member20", memberAddr(20), nil, false)
+	mesh.register("member1", memberAddr(100), nil, false)
+	mesh.members["member5"].ipv4.lastSeen = time.Time{}
+	mesh.timeOutInactiveMembers()
+
+	frames = newMapFrames(mesh, false).forMember(currentAck(state))
+
+	if len(frames) != 1 || frames[0][0] != mapDeltaFrame {
+		t.Fatalf("Expected a single delta")
+	}
+
+	nmap, ok = applyFrames(t, state, frames)
+
+	if !ok || len(nmap.Members) != 20 {
+		t.Fatalf("Delta wasn't applied: %v", nmap)
+	}
+
+	found := make(map[netaddr.IPPort]bool)
+
+	for _, member := range nmap.Members {
+		found[member.IPv4] = true
+	}
+
+	if !found[memberAddr(20)] || !found[memberAddr(100)] || found[memberAddr(1)] || found[memberAddr(5)] {
+		t.Fatalf("Delta gave the wrong members %v", nmap.Members)
+	}
+
+	// A delta from before we were up to date doesn't change anything
+	if _, ok, _ := state.applyDelta(MapDelta{Epoch: mesh.mapEpoch, From: 1, Version: 5}); ok {
+		t.Fatalf("Applied a delta for the wrong version")
+	}
+
+	if _, version := state.ack(); version != mesh.mapVersion {
+		t.Fatalf("Expected version %v but have %v", mesh.mapVersion, version)
+	}
+}
+
+// Tests that members the rolodex can't send a delta to are sent the whole map
+func TestMapUpdatesFallBackToSnapshot(t *testing.T) {
+	rollo, _ := newRolodex(discardTransport{}, time.Second, time.Minute)
+	mesh := newMeshNetwork(rollo, "test")
+	mesh.register("member", memberAddr(0), nil, false)
+
+	state := newMapState("member")
+	applyFrames(t, state, newMapFrames(mesh, false).forMember(currentAck(state)))
+	ack := currentAck(state)
+
+	// Another network with the same name has different versions
+	other := newMeshNetwork(rollo, "test")
+	other.register("member", memberAddr(0), nil, false)
+
+	if frames := newMapFrames(other, false).forMember(ack); frames[0][0] != mapSnapshotFrame {
+		t.Fatalf("Sent a delta for another network's version")
+	}
+
+	// More changes than the rolodex remembers
+	for i := 0; i <= maxMapChanges; i++ {
+		mesh.register("mover", memberAddr(i+1), nil, false)
+	}
+
+	frames := newMapFrames(mesh, false).forMember(ack)
+
+	if frames[0][0] != mapSnapshotFrame {
+		t.Fatalf("Sent a delta without knowing all the changes")
+	}
+
+	nmap, ok := applyFrames(t, state, frames)
+
+	if !ok || len(nmap.Members) != 2 || nmap.Members[1].IPv4 != memberAddr(maxMapChanges+1) {
+		t.Fatalf("Snapshot wasn't applied: %v", nmap)
+	}
+
+	// Too many changes to fit in a single delta
+	ack = currentAck(state)
+
+	for i := 0; i < 50; i++ {
+		mesh.register(fmt.Sprint("new", i), memberAddr(1000+i), nil, false)
+	}
+
+	if frames := newMapFrames(mesh, false).forMember(ack); frames[0][0] != mapSnapshotFrame {
+		t.Fatalf("Sent a delta that's too big")
+	}
+}
+
+func TestRolodexMapUpdates(t *testing.T) {
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 33339})
+	rollo, _ := NewRolodex(conn, 100*time.Millisecond, 5*time.Second)
+	go rollo.Run()
+
+	maps := make(chan NetworkMap, 100)
+	clients := make([]RolodexClient, 2)
+
+	for i := range clients {
+		clientConn, _ := net.Dial("udp", "127.0.0.1:33339")
+		clients[i] = NewRolodexClient("updates", fmt.Sprint("member", i), clientConn, 100*time.Millisecond, func(nmap NetworkMap) {
+			select {
+			case maps <- nmap:
+			default:
+			}
+		})
+
+		go clients[i].Run()
+		defer clients[i].Stop()
+	}
+
+	deadline := time.After(2 * time.Second)
+
+	for {
+		select {
+		case nmap := <-maps:
+			if len(nmap.Members) == 2 {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Members didn't learn about each other")
+		}
+	}
+}
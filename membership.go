@@ -0,0 +1,245 @@
+package meshboi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"inet.af/netaddr"
+)
+
+const (
+	// The label used to export keying material from the DTLS session, which
+	// membership proofs sign to show they were made for this session
+	membershipExporterLabel = "EXPORTER-meshboi-membership"
+	// How long to wait for the other side to prove its membership
+	membershipTimeout = 5 * time.Second
+)
+
+// MembershipAssertion states that the holder of the private key for PublicKey
+// is allowed to use the VPN IPs
+type MembershipAssertion struct {
+	VpnIPs    []netaddr.IP
+	PublicKey ed25519.PublicKey
+}
+
+// SignedMembership is a MembershipAssertion signed by the network key. The
+// assertion is kept in its encoded form so that the signature can be checked
+// over the exact bytes that were signed.
+type SignedMembership struct {
+	Assertion []byte
+	Signature []byte
+}
+
+// MemberCredentials are what a member needs to prove to other members that it
+// owns its VPN IPs
+type MemberCredentials struct {
+	Membership SignedMembership
+	PrivateKey ed25519.PrivateKey
+}
+
+// membershipProof is sent to the other side after the DTLS handshake
+type membershipProof struct {
+	Membership SignedMembership
+	// A signature by the member's key over the keying material exported from
+	// the DTLS session, so the proof can't be replayed in another session
+	Signature []byte
+}
+
+// IssueMembership creates a new member key and signs an assertion that lets it
+// use the VPN IPs
+func IssueMembership(networkKey ed25519.PrivateKey, vpnIPs []netaddr.IP) (*MemberCredentials, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	assertion, err := json.Marshal(MembershipAssertion{VpnIPs: vpnIPs, PublicKey: publicKey})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemberCredentials{
+		Membership: SignedMembership{
+			Assertion: assertion,
+			Signature: ed25519.Sign(networkKey, assertion),
+		},
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// Verify checks that the assertion was signed by the network key, returning
+// the assertion if so
+func (s SignedMembership) Verify(networkKey ed25519.PublicKey) (*MembershipAssertion, error) {
+	if !ed25519.Verify(networkKey, s.Assertion, s.Signature) {
+		return nil, errors.New("membership not signed by the network key")
+	}
+
+	var assertion MembershipAssertion
+
+	if err := json.Unmarshal(s.Assertion, &assertion); err != nil {
+		return nil, err
+	}
+
+	if len(assertion.PublicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("membership has an invalid public key")
+	}
+
+	return &assertion, nil
+}
+
+// AllowsExactly reports whether the assertion is for exactly the given IPs
+func (a *MembershipAssertion) AllowsExactly(ips []netaddr.IP) bool {
+	return sameIPs(a.VpnIPs, ips)
+}
+
+// sameIPs reports whether both lists have the same IPs, in any order
+func sameIPs(a []netaddr.IP, b []netaddr.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	inA := make(map[netaddr.IP]bool, len(a))
+
+	for _, ip := range a {
+		inA[ip] = true
+	}
+
+	for _, ip := range b {
+		if !inA[ip] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func LoadMemberCredentials(path string) (*MemberCredentials, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials MemberCredentials
+
+	if err := json.Unmarshal(b, &credentials); err != nil {
+		return nil, err
+	}
+
+	if len(credentials.PrivateKey) != ed25519.PrivateKeySize {
+		return nil, errors.New("credentials have an invalid private key")
+	}
+
+	return &credentials, nil
+}
+
+func (c *MemberCredentials) Save(path string) error {
+	b, err := json.Marshal(c)
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// membershipVerifier proves our membership to the other side of a DTLS
+// connection and checks that the other side is allowed the VPN IPs it claims
+// in its identity hint
+type membershipVerifier struct {
+	networkKey  ed25519.PublicKey
+	credentials *MemberCredentials
+}
+
+// sessionBinding is what's signed to prove membership for a particular
+// session. The role stops a proof from being reflected back to its sender.
+func sessionBinding(conn *dtls.Conn, isServer bool) ([]byte, error) {
+	state := conn.ConnectionState()
+	keyingMaterial, err := state.ExportKeyingMaterial(membershipExporterLabel, nil, 32)
+
+	if err != nil {
+		return nil, err
+	}
+
+	role := "client"
+
+	if isServer {
+		role = "server"
+	}
+
+	return append([]byte(role), keyingMaterial...), nil
+}
+
+func (v *membershipVerifier) prove(conn *dtls.Conn, isServer bool) error {
+	binding, err := sessionBinding(conn, isServer)
+
+	if err != nil {
+		return err
+	}
+
+	proof, err := json.Marshal(membershipProof{
+		Membership: v.credentials.Membership,
+		Signature:  ed25519.Sign(v.credentials.PrivateKey, binding),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append([]byte{membershipMessage}, proof...))
+
+	return err
+}
+
+func (v *membershipVerifier) verify(conn *dtls.Conn, isServer bool, claimedIPs []netaddr.IP) error {
+	conn.SetReadDeadline(time.Now().Add(membershipTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, bufSize)
+	n, err := conn.Read(buf)
+
+	if err != nil {
+		return fmt.Errorf("didn't receive membership proof: %w", err)
+	}
+
+	if n == 0 || buf[0] != membershipMessage {
+		return errors.New("expected a membership proof")
+	}
+
+	var proof membershipProof
+
+	if err := json.Unmarshal(buf[1:n], &proof); err != nil {
+		return err
+	}
+
+	assertion, err := proof.Membership.Verify(v.networkKey)
+
+	if err != nil {
+		return err
+	}
+
+	if !assertion.AllowsExactly(claimedIPs) {
+		return fmt.Errorf("claimed VPN IPs %v but membership is for %v", claimedIPs, assertion.VpnIPs)
+	}
+
+	// The proof was made by the other side, so in the other role
+	binding, err := sessionBinding(conn, !isServer)
+
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(assertion.PublicKey, binding, proof.Signature) {
+		return errors.New("membership proof not signed by the member key")
+	}
+
+	return nil
+}
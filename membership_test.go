@@ -0,0 +1,125 @@
+package meshboi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestIssueAndVerifyMembership(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherPublicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	ips := []netaddr.IP{netaddr.MustParseIP("192.168.50.1"), netaddr.MustParseIP("fd00:50::1")}
+
+	credentials, err := IssueMembership(privateKey, ips)
+
+	if err != nil {
+		t.Fatal("Error issuing membership: ", err)
+	}
+
+	assertion, err := credentials.Membership.Verify(publicKey)
+
+	if err != nil {
+		t.Fatal("Error verifying membership: ", err)
+	}
+
+	if !assertion.AllowsExactly([]netaddr.IP{ips[1], ips[0]}) {
+		t.Fatalf("Membership doesn't allow its own IPs")
+	}
+
+	if assertion.AllowsExactly(ips[:1]) {
+		t.Fatalf("Membership allows a subset of its IPs")
+	}
+
+	if _, err := credentials.Membership.Verify(otherPublicKey); err == nil {
+		t.Fatalf("Membership verified with the wrong network key")
+	}
+
+	tampered := credentials.Membership
+	tampered.Assertion = []byte(string(tampered.Assertion) + " ")
+
+	if _, err := tampered.Verify(publicKey); err == nil {
+		t.Fatalf("Tampered membership verified")
+	}
+}
+
+// connectMembers connects two members claiming the given VPN IPs, returning
+// the errors from both sides of the connection
+func connectMembers(t *testing.T, networkKey ed25519.PublicKey, serverIP netaddr.IP, serverCredentials *MemberCredentials, clientIP netaddr.IP, clientCredentials *MemberCredentials) (error, error) {
+	localhost := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	ring := NewPSKRing(0, []byte("testpassword"))
+
+	server, err := NewMultiplexedDTLSConn(localhost, getDtlsConfig([]netaddr.IP{serverIP}, ring, nil))
+
+	if err != nil {
+		t.Fatal("Error creating server: ", err)
+	}
+
+	defer server.Close()
+	server.RequireMembership(networkKey, serverCredentials)
+
+	client, err := NewMultiplexedDTLSConn(localhost, getDtlsConfig([]netaddr.IP{clientIP}, ring, nil))
+
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	defer client.Close()
+	client.RequireMembership(networkKey, clientCredentials)
+
+	serverErr := make(chan error)
+
+	go func() {
+		conn, err := server.AcceptMesh()
+
+		if err == nil {
+			defer conn.Close()
+		}
+
+		serverErr <- err
+	}()
+
+	conn, clientErr := client.DialMesh(server.listener.Addr())
+
+	if clientErr == nil {
+		defer conn.Close()
+	}
+
+	return <-serverErr, clientErr
+}
+
+func TestMembershipHandshake(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	serverIP := netaddr.MustParseIP("192.168.50.1")
+	clientIP := netaddr.MustParseIP("192.168.50.2")
+
+	serverCredentials, _ := IssueMembership(privateKey, []netaddr.IP{serverIP})
+	clientCredentials, _ := IssueMembership(privateKey, []netaddr.IP{clientIP})
+
+	serverErr, clientErr := connectMembers(t, publicKey, serverIP, serverCredentials, clientIP, clientCredentials)
+
+	if serverErr != nil || clientErr != nil {
+		t.Fatalf("Members couldn't connect %v %v", serverErr, clientErr)
+	}
+}
+
+// Tests that a member can't claim another member's VPN IP, even though it has
+// the PSK and a valid membership of its own
+func TestMembershipRejectsImpersonation(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	serverIP := netaddr.MustParseIP("192.168.50.1")
+	clientIP := netaddr.MustParseIP("192.168.50.2")
+	victimIP := netaddr.MustParseIP("192.168.50.3")
+
+	serverCredentials, _ := IssueMembership(privateKey, []netaddr.IP{serverIP})
+	clientCredentials, _ := IssueMembership(privateKey, []netaddr.IP{clientIP})
+
+	serverErr, _ := connectMembers(t, publicKey, serverIP, serverCredentials, victimIP, clientCredentials)
+
+	if serverErr == nil {
+		t.Fatalf("Server accepted a member claiming another member's IP")
+	}
+}
@@ -1,24 +1,210 @@
 package meshboi
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/pion/dtls/v2"
 	log "github.com/sirupsen/logrus"
 	"inet.af/netaddr"
 )
 
 type MeshboiClient struct {
 	peerStore     *PeerConnStore
-	rolloClient   RolodexClient
+	rolloClients  []RolodexClient
 	tunRouter     TunRouter
 	peerConnector PeerConnector
+	peerReaper    PeerReaper
+	multiplexConn *MultiplexedDTLSConn
+	bypass        *BypassRoutes
+	relays        []*Relay
+	vpnIps        []netaddr.IP
+	usesPSK       bool
+	cipherSuites  []dtls.CipherSuiteID
+	acl           *ACL
 }
 
-func NewMeshBoiClient(tun TunConn, vpnIpPrefix netaddr.IPPrefix, rolodexIP netaddr.IP, rolodexPort int, networkName string, meshPSK []byte) (*MeshboiClient, error) {
-	listenAddr := &net.UDPAddr{IP: net.ParseIP("0.0.0.0")}
-	dtlsConfig := getDtlsConfig(vpnIpPrefix.IP, meshPSK)
+// MeshboiClientConfig holds the options for a MeshboiClient
+type MeshboiClientConfig struct {
+	Tun           TunConn
+	VpnIPPrefixes []netaddr.IPPrefix
+	RolodexIPs    []netaddr.IP
+	RolodexPort   int
+	NetworkName   string
+	PSK           []byte
+	PeerTimeout   time.Duration
+
+	// PSKRing, if set, is used instead of the PSK so that the PSK can be
+	// changed with UpdatePSKRing while running
+	PSKRing *PSKRing
+	// LegacyPSK uses the PSK as the key rather than deriving the key from
+	// it, so that members from before keys were derived can still connect
+	LegacyPSK bool
+
+	// AdvertisedRoutes are the subnets that other members can reach through
+	// this member
+	AdvertisedRoutes []netaddr.IPPrefix
+	// AcceptRoutes controls whether routes advertised by other members are
+	// used
+	AcceptRoutes bool
+	// ExitNode is the VPN IP of the member to send all other IPv4 traffic
+	// through, if set
+	ExitNode netaddr.IP
+	// AllowExitNode advertises this member as an exit node that other members
+	// can send all of their traffic through
+	AllowExitNode bool
+	// RelayForPeers volunteers this member to relay traffic between members
+	// that can't connect to each other directly
+	RelayForPeers bool
+
+	// NetworkKey, if set, requires every member to prove that the network key
+	// signed off on the VPN IPs it uses. Membership holds the proof for this
+	// member.
+	NetworkKey ed25519.PublicKey
+	Membership *MemberCredentials
+
+	// Certificate, if set, is used to identify this member instead of the
+	// PSK. It must be issued by the CA, which is used to check the
+	// certificates of other members.
+	Certificate *tls.Certificate
+	CA          *x509.Certificate
+	// CRLFile, if set, is a CRL from the CA listing revoked certificates.
+	// Newer CRLs are also taken from the rolodex.
+	CRLFile string
+
+	// RolodexFingerprint, if set, is the SHA-256 hash of the rolodex's
+	// certificate. The rolodex is then talked to over DTLS, and only if it
+	// has that certificate.
+	RolodexFingerprint []byte
+	// CipherSuites, if set, are the only cipher suites that peers can connect
+	// with, in order of preference. They must suit whether certificates or a
+	// PSK are used. The default is the strongest suite for either.
+	CipherSuites []dtls.CipherSuiteID
+
+	// ACL, if set, limits the traffic to and from peers. Newer policies are
+	// also taken from the rolodex, but only if it's talked to over DTLS.
+	ACL *ACLPolicy
+
+	// JoinSecret is given to the rolodex to prove we can join the network,
+	// for rolodexes that need it
+	JoinSecret []byte
+	// Invite, if set, is the invite used to join the network, which the join
+	// secret came from
+	Invite *InviteClaim
+	// MemberID identifies this member to the rolodex, and is randomly
+	// generated if not set. It's kept secret, with the rolodex only seeing an
+	// ID derived from it. It has to stay the same to keep using an invite.
+	MemberID string
+}
+
+func NewMeshBoiClient(config MeshboiClientConfig) (*MeshboiClient, error) {
+	// Listening on the unspecified address gives a dual stack socket that can
+	// talk to peers (and the rolodex) over both IPv4 and IPv6
+	listenAddr := &net.UDPAddr{IP: net.IPv6unspecified}
+	vpnIps := make([]netaddr.IP, 0, len(config.VpnIPPrefixes))
+
+	for _, prefix := range config.VpnIPPrefixes {
+		vpnIps = append(vpnIps, prefix.IP)
+	}
+
+	var dtlsConfig *dtls.Config
+	var revocations *RevocationList
+	var identity *CertIdentity
+	prover := newRelayProver(vpnIps)
+
+	if err := checkCipherSuites(config.CipherSuites, config.Certificate != nil); err != nil {
+		return nil, err
+	}
+
+	if config.Certificate != nil {
+		if config.CA == nil {
+			return nil, errors.New("a CA is needed to check the certificates of other members")
+		}
+
+		if config.NetworkKey != nil {
+			return nil, errors.New("memberships can't be used along with certificates, which already prove the VPN IPs of members")
+		}
+
+		caPool := x509.NewCertPool()
+		caPool.AddCert(config.CA)
+
+		var err error
+		identity, err = verifyMemberCert(config.Certificate.Certificate[0], caPool)
+
+		if err != nil {
+			return nil, fmt.Errorf("certificate isn't valid for the CA: %w", err)
+		}
+
+		if !sameIPs(identity.VpnIPs, vpnIps) {
+			return nil, fmt.Errorf("certificate is for %v but VPN IPs are %v", identity.VpnIPs, vpnIps)
+		}
+
+		revocations = NewRevocationList(config.CA)
+
+		if config.CRLFile != "" {
+			if err := revocations.Load(config.CRLFile); err != nil {
+				return nil, fmt.Errorf("error loading revocation list: %w", err)
+			}
+		}
+
+		if revocations.IsRevoked(identity) {
+			return nil, errors.New("our own certificate has been revoked")
+		}
+
+		prover.certificate = config.Certificate
+		prover.caPool = caPool
+		prover.revocations = revocations
+
+		dtlsConfig = getCertDtlsConfig(*config.Certificate, caPool, revocations, config.CipherSuites)
+	} else if config.CRLFile != "" {
+		return nil, errors.New("a revocation list can only be used with certificates")
+	} else if config.PSKRing != nil {
+		dtlsConfig = getDtlsConfig(vpnIps, config.PSKRing, config.CipherSuites)
+	} else if config.LegacyPSK {
+		log.Warn("Using the PSK without deriving a key from it, move to a PSK ring once every member is upgraded")
+		ring := NewPSKRing(0, config.PSK)
+		ring.legacy = true
+		dtlsConfig = getDtlsConfig(vpnIps, ring, config.CipherSuites)
+	} else {
+		// The PSK is a passphrase, so stretch it into a key that's unique to
+		// the network
+		dtlsConfig = getDtlsConfig(vpnIps, NewPSKRing(0, DerivePSK(config.PSK, config.NetworkName)), config.CipherSuites)
+	}
+
+	// Older members can only connect with a PSK that isn't derived
+	olderMembers := config.Certificate == nil && (config.LegacyPSK || (config.PSKRing != nil && config.PSKRing.legacy))
+
+	if olderMembers && config.NetworkKey != nil {
+		return nil, errors.New("a network key can't be used while older members use the PSK, as they can't prove their membership")
+	}
+
+	if config.NetworkKey != nil {
+		if config.Membership == nil {
+			return nil, errors.New("membership credentials are needed when the network key is set")
+		}
+
+		assertion, err := config.Membership.Membership.Verify(config.NetworkKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !assertion.AllowsExactly(vpnIps) {
+			return nil, fmt.Errorf("membership is for %v but VPN IPs are %v", assertion.VpnIPs, vpnIps)
+		}
+
+		prover.networkKey = config.NetworkKey
+		prover.credentials = config.Membership
+	}
 
 	multiplexConn, err := NewMultiplexedDTLSConn(listenAddr, dtlsConfig)
 
@@ -27,30 +213,210 @@ func NewMeshBoiClient(tun TunConn, vpnIpPrefix netaddr.IPPrefix, rolodexIP netad
 		return nil, err
 	}
 
-	rolodexAddr := &net.UDPAddr{IP: rolodexIP.IPAddr().IP, Port: rolodexPort}
-	rolodexConn, err := multiplexConn.Dial(rolodexAddr)
+	if config.NetworkKey != nil {
+		multiplexConn.RequireMembership(config.NetworkKey, config.Membership)
+	} else if config.Certificate == nil {
+		log.Warn("No network key set, so any member with the PSK can claim any VPN IP")
+	}
 
-	if err != nil {
-		log.Error("Error connecting to rolodex server")
-		return nil, err
+	memberID := config.MemberID
+
+	if memberID == "" {
+		memberID, err = newMemberID()
+
+		if err != nil {
+			multiplexConn.Close()
+			return nil, err
+		}
 	}
 
 	mc := MeshboiClient{}
 
+	mc.multiplexConn = multiplexConn
+	mc.vpnIps = vpnIps
+	mc.usesPSK = config.Certificate == nil
+	mc.cipherSuites = config.CipherSuites
 	mc.peerStore = NewPeerConnStore()
-	mc.peerConnector = NewPeerConnector(multiplexConn, mc.peerStore, tun)
-	mc.rolloClient = NewRolodexClient(networkName, rolodexConn, time.Duration(5*time.Second), mc.peerConnector.OnNetworkMapUpdate)
-	mc.tunRouter = NewTunRouter(tun, mc.peerStore)
+	routes := NewRouteTable()
+	mc.peerConnector = NewPeerConnector(multiplexConn, mc.peerStore, routes, config.Tun)
+
+	advertisedRoutes := config.AdvertisedRoutes
+
+	if config.AllowExitNode {
+		advertisedRoutes = append(advertisedRoutes, defaultRoute)
+	}
+
+	if err := mc.peerConnector.AdvertiseRoutes(advertisedRoutes); err != nil {
+		multiplexConn.Close()
+		return nil, err
+	}
+
+	if config.AcceptRoutes {
+		mc.peerConnector.AcceptRoutes()
+	}
+
+	if config.RelayForPeers {
+		mc.peerConnector.RelayForPeers()
+	}
+
+	mc.peerConnector.UseRelayProver(prover)
+
+	if olderMembers {
+		mc.peerConnector.AllowOlderMembers(vpnIps)
+	}
+
+	if revocations != nil {
+		mc.peerConnector.UseRevocationList(revocations)
+	}
+
+	mc.acl = NewACL(identity)
+
+	if config.ACL != nil {
+		if _, err := mc.acl.Update(config.ACL); err != nil {
+			multiplexConn.Close()
+			return nil, fmt.Errorf("error using ACL: %w", err)
+		}
+	}
+
+	mc.peerConnector.UseACL(mc.acl)
+
+	if !config.ExitNode.IsZero() {
+		// The bypass routes have to be in place before the exit node's default
+		// route is, so that we can still reach the rolodex and our peers
+		mc.bypass, err = NewBypassRoutes()
+
+		if err != nil {
+			log.Error("Error finding default gateway for exit node ", err)
+			multiplexConn.Close()
+			return nil, err
+		}
+
+		for _, rolodexIP := range config.RolodexIPs {
+			if err := mc.bypass.Add(rolodexIP); err != nil {
+				log.Error("Error adding bypass route for rolodex ", err)
+				mc.bypass.Close()
+				multiplexConn.Close()
+				return nil, err
+			}
+		}
+
+		mc.peerConnector.UseExitNode(config.ExitNode, mc.bypass)
+	}
+
+	// Talk to the rolodex over each IP version it's reachable on so that it
+	// learns all of our public addresses
+	for _, rolodexIP := range config.RolodexIPs {
+		rolodexAddr := &net.UDPAddr{IP: rolodexIP.IPAddr().IP, Port: config.RolodexPort}
+		var rolodexConn net.Conn
+		var redial func() error
+
+		if config.RolodexFingerprint != nil {
+			conn, err := newRedialConn(func() (net.Conn, error) {
+				return dialRolodex(multiplexConn, rolodexAddr, config.RolodexFingerprint)
+			})
+
+			if err != nil {
+				// The rolodex may only be reachable over one of its IP
+				// versions, so carry on as long as one works
+				log.Warn("Couldn't start a session with the rolodex at ", rolodexAddr, ": ", err)
+				continue
+			}
+
+			rolodexConn = conn
+			redial = conn.Redial
+		} else {
+			rolodexConn, err = multiplexConn.Dial(rolodexAddr)
+		}
+
+		if err != nil {
+			log.Error("Error connecting to rolodex server")
+
+			for _, rolloClient := range mc.rolloClients {
+				rolloClient.conn.Close()
+			}
+
+			if mc.bypass != nil {
+				mc.bypass.Close()
+			}
+
+			multiplexConn.Close()
+			return nil, err
+		}
+
+		rolloClient := NewRolodexClient(config.NetworkName, memberID, rolodexConn, time.Duration(5*time.Second), mc.peerConnector.OnNetworkMapUpdate)
+		rolloClient.redial = redial
+		rolloClient.joinSecret = config.JoinSecret
+		rolloClient.invite = config.Invite
+
+		// Members that can't be reached directly are relayed through the
+		// rolodex, if it allows it
+		if relay, err := NewRelay(rolodexConn); err == nil {
+			rolloClient.onRelayFrame = relay.HandleFrame
+			mc.peerConnector.AddRelay(relay)
+			mc.relays = append(mc.relays, relay)
+		} else {
+			log.Warn("Couldn't relay through rolodex at ", rolodexAddr, ": ", err)
+		}
+
+		if revocations != nil {
+			rolloClient.onRevocationList = func(crl []byte) {
+				if _, err := revocations.Update(crl); err != nil {
+					log.Warn("Ignoring revocation list from rolodex: ", err)
+				}
+			}
+		}
+
+		if config.RolodexFingerprint != nil {
+			rolloClient.onACL = func(b []byte) {
+				policy, err := ParseACLPolicy(b)
+
+				if err == nil {
+					_, err = mc.acl.Update(policy)
+				}
+
+				if err != nil {
+					log.Warn("Ignoring ACL policy from rolodex: ", err)
+				}
+			}
+		}
+
+		mc.rolloClients = append(mc.rolloClients, rolloClient)
+	}
+
+	if len(mc.rolloClients) == 0 {
+		if mc.bypass != nil {
+			mc.bypass.Close()
+		}
+
+		multiplexConn.Close()
+		return nil, errors.New("couldn't start a session with the rolodex")
+	}
+
+	mc.tunRouter = NewTunRouter(config.Tun, mc.peerStore, routes)
+	mc.tunRouter.acl = mc.acl
+	mc.peerReaper = NewPeerReaper(mc.peerStore, config.PeerTimeout)
 
 	return &mc, nil
 }
 
-func (mc *MeshboiClient) Run() {
+// Run runs the client until the context is cancelled, after which all peer
+// connections, the tun and the underlying UDP socket are closed. The error
+// returned is either the context's error or the error that caused a
+// component of the client to stop unexpectedly.
+func (mc *MeshboiClient) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	var wg sync.WaitGroup
-	wg.Add(3)
+	wg.Add(3 + len(mc.rolloClients))
+
+	tunErr := make(chan error, 1)
 
 	go func() {
-		mc.tunRouter.Run()
+		if err := mc.tunRouter.Run(); err != nil {
+			tunErr <- err
+			cancel()
+		}
 		wg.Done()
 	}()
 
@@ -59,17 +425,92 @@ func (mc *MeshboiClient) Run() {
 		wg.Done()
 	}()
 
+	for i := range mc.rolloClients {
+		go func(rolloClient *RolodexClient) {
+			rolloClient.Run()
+			wg.Done()
+		}(&mc.rolloClients[i])
+	}
+
 	go func() {
-		mc.rolloClient.Run()
+		mc.peerReaper.Run()
 		wg.Done()
 	}()
 
+	<-ctx.Done()
+	log.Info("Shutting down mesh client")
+
+	mc.stop()
 	wg.Wait()
+
+	select {
+	case err := <-tunErr:
+		return err
+	default:
+		return ctx.Err()
+	}
 }
 
-func (mc *MeshboiClient) Stop() {
-	mc.rolloClient.Stop()
+func (mc *MeshboiClient) stop() {
+	// Stop learning about new peers before closing the existing ones
+	for i := range mc.rolloClients {
+		mc.rolloClients[i].Stop()
+	}
+
+	mc.peerReaper.Stop()
 	mc.peerConnector.Stop()
-	mc.tunRouter.Stop()
 
+	for _, relay := range mc.relays {
+		relay.Close()
+	}
+
+	// Only remove the bypass routes once the exit node's routes have gone
+	if mc.bypass != nil {
+		mc.bypass.Close()
+	}
+
+	if err := mc.multiplexConn.Close(); err != nil {
+		log.Warn("Error closing multiplexed conn: ", err)
+	}
+
+	if err := mc.tunRouter.Stop(); err != nil {
+		log.Warn("Error closing tun: ", err)
+	}
+}
+
+// ACLDropped returns how many packets the ACL has dropped from and to peers
+func (mc *MeshboiClient) ACLDropped() (ingress uint64, egress uint64) {
+	return mc.acl.Dropped()
+}
+
+// RelayDropped returns how many packets relayed for peers were dropped
+// because the peer they were for couldn't keep up
+func (mc *MeshboiClient) RelayDropped() uint64 {
+	return mc.peerConnector.RelayDropped()
+}
+
+// UpdatePSKRing uses the ring for new connections. If the ring has rolled
+// forward, the connections to peers made with older PSKs are made again with
+// the current one.
+func (mc *MeshboiClient) UpdatePSKRing(ring *PSKRing) error {
+	if !mc.usesPSK {
+		return errors.New("members are identified by certificates rather than a PSK")
+	}
+
+	mc.multiplexConn.SetConfig(getDtlsConfig(mc.vpnIps, ring, mc.cipherSuites))
+	mc.peerConnector.ReconnectOlderPSKs(ring.Current())
+
+	return nil
+}
+
+// newMemberID generates a random ID that lets the rolodex tie together the
+// heartbeats we send to it over IPv4 and IPv6
+func newMemberID() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
 }
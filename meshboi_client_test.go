@@ -1,6 +1,7 @@
 package meshboi
 
 import (
+	"context"
 	"net"
 	"reflect"
 	"testing"
@@ -33,23 +34,39 @@ func TestTwoClients(t *testing.T) {
 	tunIncoming1, tunOutgoing1 := net.Pipe()
 	tunIncoming2, tunOutgoing2 := net.Pipe()
 
-	client1, err := NewMeshBoiClient(tunOutgoing1, netaddr.MustParseIPPrefix("192.168.52.1/24"), netaddr.MustParseIP("127.0.0.1"), 12345, "testNetwork", []byte("testpassword"))
+	client1, err := NewMeshBoiClient(MeshboiClientConfig{
+		Tun:           tunOutgoing1,
+		VpnIPPrefixes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.52.1/24")},
+		RolodexIPs:    []netaddr.IP{netaddr.MustParseIP("127.0.0.1")},
+		RolodexPort:   12345,
+		NetworkName:   "testNetwork",
+		PSK:           []byte("testpassword"),
+		PeerTimeout:   time.Minute,
+	})
 
 	if err != nil {
 		t.Error("Error making mesh client ", err)
 	}
 
-	client2, err := NewMeshBoiClient(tunOutgoing2, netaddr.MustParseIPPrefix("192.168.52.2/24"), netaddr.MustParseIP("127.0.0.1"), 12345, "testNetwork", []byte("testpassword"))
+	client2, err := NewMeshBoiClient(MeshboiClientConfig{
+		Tun:           tunOutgoing2,
+		VpnIPPrefixes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.52.2/24")},
+		RolodexIPs:    []netaddr.IP{netaddr.MustParseIP("127.0.0.1")},
+		RolodexPort:   12345,
+		NetworkName:   "testNetwork",
+		PSK:           []byte("testpassword"),
+		PeerTimeout:   time.Minute,
+	})
 
 	if err != nil {
 		t.Error("Error making mesh client ", err)
 	}
 
-	go client1.Run()
-	defer client1.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	go client2.Run()
-	defer client2.Stop()
+	go client1.Run(ctx)
+	go client2.Run(ctx)
 
 	b := []byte("hello how are you?")
 	h := &ipv4.Header{
@@ -58,6 +75,7 @@ func TestTwoClients(t *testing.T) {
 		TotalLen: ipv4.HeaderLen + len(b),
 		ID:       55555,
 		Protocol: 1,
+		Src:      net.ParseIP("192.168.52.1"),
 		Dst:      net.ParseIP("192.168.52.2"),
 	}
 
@@ -91,3 +109,49 @@ func TestTwoClients(t *testing.T) {
 		t.Errorf("Didn't read expected data %v %v", rxedMsg[:n], sentMsg)
 	}
 }
+
+// Tests that cancelling the context shuts the client down
+func TestClientShutdown(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12346})
+
+	if err != nil {
+		t.Fatal("Couldn't make UDP listener: ", err)
+	}
+
+	defer conn.Close()
+
+	_, tunOutgoing := net.Pipe()
+
+	client, err := NewMeshBoiClient(MeshboiClientConfig{
+		Tun:           tunOutgoing,
+		VpnIPPrefixes: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("192.168.52.1/24")},
+		RolodexIPs:    []netaddr.IP{netaddr.MustParseIP("127.0.0.1")},
+		RolodexPort:   12346,
+		NetworkName:   "testNetwork",
+		PSK:           []byte("testpassword"),
+		PeerTimeout:   time.Minute,
+	})
+
+	if err != nil {
+		t.Fatal("Error making mesh client ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+
+	go func() {
+		result <- client.Run(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("Expected context.Canceled but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Client didn't shut down")
+	}
+}
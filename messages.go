@@ -1,12 +1,407 @@
 package meshboi
 
-import "inet.af/netaddr"
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"inet.af/netaddr"
+)
 
 type HeartbeatMessage struct {
 	NetworkName string
+	// Randomly generated by each member so that heartbeats sent from the same
+	// member over both IPv4 and IPv6 can be tied together. Older members don't
+	// send this, in which case each address is treated as a separate member.
+	MemberID string `json:",omitempty"`
+	// The last join challenge from the rolodex and the answer to it, for
+	// networks that need a join secret
+	Challenge []byte `json:",omitempty"`
+	Proof     []byte `json:",omitempty"`
+	// The answer to the last challenge from the rolodex that proves the member
+	// holds its ID. The rolodex only goes by the ID once it's been proven.
+	IDProof []byte `json:",omitempty"`
+	// The invite the member is joining with, in which case the proof is made
+	// with the invite's secret rather than the join secret
+	Invite *InviteClaim `json:",omitempty"`
+	// Set by members that want map updates rather than the whole map, along
+	// with the version of the map they have
+	MapUpdates bool   `json:",omitempty"`
+	MapEpoch   uint64 `json:",omitempty"`
+	MapVersion uint64 `json:",omitempty"`
+	// The newest version of the binary wire format the member understands,
+	// sent in JSON heartbeats so the rolodex knows it can reply in binary
+	WireVersion byte `json:",omitempty"`
+}
+
+// The public addresses that a member of the mesh can be reached at. Either
+// address may be zero if the member hasn't been seen over that IP version.
+type MemberAddrs struct {
+	IPv4 netaddr.IPPort
+	IPv6 netaddr.IPPort
+}
+
+// Returns the non-zero addresses of the member, IPv6 first
+func (m MemberAddrs) All() []netaddr.IPPort {
+	var addrs []netaddr.IPPort
+
+	if !m.IPv6.IP.IsZero() {
+		addrs = append(addrs, m.IPv6)
+	}
+
+	if !m.IPv4.IP.IsZero() {
+		addrs = append(addrs, m.IPv4)
+	}
+
+	return addrs
+}
+
+// Returns the single address to give to older members that only understand
+// one address per member. IPv4 is preferred as older members can only use it.
+func (m MemberAddrs) Primary() netaddr.IPPort {
+	if !m.IPv4.IP.IsZero() {
+		return m.IPv4
+	}
+
+	return m.IPv6
+}
+
+// Returns the address of the member with the same IP version as addr
+func (m MemberAddrs) SameFamily(addr netaddr.IPPort) netaddr.IPPort {
+	if addr.IP.Is4() {
+		return m.IPv4
+	}
+
+	return m.IPv6
 }
 
 type NetworkMap struct {
+	// A single address for each member, kept for older members that don't
+	// understand Members
 	Addresses []netaddr.IPPort
+	// Both the IPv4 and IPv6 addresses of each member, in the same order as
+	// Addresses
+	Members   []MemberAddrs `json:",omitempty"`
 	YourIndex int
 }
+
+// Returns the addresses of every member, falling back to Addresses if the map
+// came from an older rolodex that doesn't send Members
+func (n NetworkMap) MemberAddrs() []MemberAddrs {
+	if len(n.Members) > 0 {
+		return n.Members
+	}
+
+	members := make([]MemberAddrs, 0, len(n.Addresses))
+
+	for _, addr := range n.Addresses {
+		var member MemberAddrs
+
+		if addr.IP.Is4() {
+			member.IPv4 = addr
+		} else {
+			member.IPv6 = addr
+		}
+
+		members = append(members, member)
+	}
+
+	return members
+}
+
+// encode marshals the map in either the binary wire format or JSON
+func (n NetworkMap) encode(binaryWire bool) []byte {
+	if binaryWire {
+		return encodeNetworkMap(n)
+	}
+
+	b, err := json.Marshal(n)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// Messages sent directly between peers over their MeshConn. Data messages are
+// the raw IP packets read from the tun, while control messages are identified
+// by a first byte that can never start an IP packet (the upper nibble of an IP
+// packet is always its version, 4 or 6).
+const (
+	// Sent periodically to keep NAT bindings open and let the other side know
+	// we're still alive, even when there is no traffic on the tun
+	keepAliveMessage byte = 0x01
+	// Advertises the subnets that can be reached through the sender, encoded
+	// as a JSON list of prefixes following the message type
+	routesMessage byte = 0x02
+	// Lists the VPN IPs of the members that the sender will relay packets to,
+	// encoded as a JSON list of IPs following the message type
+	relayedMembersMessage byte = 0x03
+	// Proves the sender is allowed to use the VPN IPs in its identity hint.
+	// Only sent straight after the DTLS handshake.
+	membershipMessage byte = 0x04
+	// A relayProbe encoded as JSON, which relays pass on to the member it's to
+	relayProbeMessage byte = 0x05
+	// A relayProof encoded as JSON, which relays pass back to the member that
+	// sent the probe
+	relayProofMessage byte = 0x06
+)
+
+func newRoutesMessage(prefixes []netaddr.IPPrefix) ([]byte, error) {
+	b, err := json.Marshal(prefixes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{routesMessage}, b...), nil
+}
+
+func parseRoutesMessage(msg []byte) ([]netaddr.IPPrefix, error) {
+	var prefixes []netaddr.IPPrefix
+
+	if err := json.Unmarshal(msg[1:], &prefixes); err != nil {
+		return nil, err
+	}
+
+	return prefixes, nil
+}
+
+func newRelayedMembersMessage(ips []netaddr.IP) ([]byte, error) {
+	b, err := json.Marshal(ips)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{relayedMembersMessage}, b...), nil
+}
+
+func parseRelayedMembersMessage(msg []byte) ([]netaddr.IP, error) {
+	var ips []netaddr.IP
+
+	if err := json.Unmarshal(msg[1:], &ips); err != nil {
+		return nil, err
+	}
+
+	return ips, nil
+}
+
+func newRelayProbeMessage(probe relayProbe) ([]byte, error) {
+	b, err := json.Marshal(probe)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{relayProbeMessage}, b...), nil
+}
+
+func parseRelayProbeMessage(msg []byte) (relayProbe, error) {
+	var probe relayProbe
+
+	if err := json.Unmarshal(msg[1:], &probe); err != nil {
+		return relayProbe{}, err
+	}
+
+	return probe, nil
+}
+
+func newRelayProofMessage(proof relayProof) ([]byte, error) {
+	b, err := json.Marshal(proof)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{relayProofMessage}, b...), nil
+}
+
+func parseRelayProofMessage(msg []byte) (relayProof, error) {
+	var proof relayProof
+
+	if err := json.Unmarshal(msg[1:], &proof); err != nil {
+		return relayProof{}, err
+	}
+
+	return proof, nil
+}
+
+func isControlMessage(msg []byte) bool {
+	return len(msg) > 0 && msg[0]>>4 == 0
+}
+
+// Older members write everything they're sent to their tun, and crash on
+// anything that isn't an IP packet. Peers that may be older members are sent
+// hellos until they show that they understand control messages. A hello is
+// an IP packet with a protocol reserved for experiments, which the kernels of
+// older members drop.
+const helloProtocol = 253
+
+var helloPayload = []byte("meshboi-hello")
+
+// newHelloPacket makes a hello from one of our VPN IPs to one of the peer's
+// of the same IP version, or returns nil if we have none in common
+func newHelloPacket(ours []netaddr.IP, theirs []netaddr.IP) []byte {
+	for _, dst := range theirs {
+		for _, src := range ours {
+			switch {
+			case src.Is4() && dst.Is4():
+				b := make([]byte, ipv4.HeaderLen+len(helloPayload))
+				b[0] = ipv4.Version<<4 | ipv4.HeaderLen/4
+				binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+				b[8] = 64
+				b[9] = helloProtocol
+				src4, dst4 := src.As4(), dst.As4()
+				copy(b[12:16], src4[:])
+				copy(b[16:20], dst4[:])
+				binary.BigEndian.PutUint16(b[10:12], ipv4Checksum(b[:ipv4.HeaderLen]))
+				copy(b[ipv4.HeaderLen:], helloPayload)
+
+				return b
+			case src.Is6() && dst.Is6():
+				b := make([]byte, ipv6.HeaderLen+len(helloPayload))
+				b[0] = ipv6.Version << 4
+				binary.BigEndian.PutUint16(b[4:6], uint16(len(helloPayload)))
+				b[6] = helloProtocol
+				b[7] = 64
+				src16, dst16 := src.As16(), dst.As16()
+				copy(b[8:24], src16[:])
+				copy(b[24:40], dst16[:])
+				copy(b[ipv6.HeaderLen:], helloPayload)
+
+				return b
+			}
+		}
+	}
+
+	return nil
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return ^uint16(sum)
+}
+
+func isHelloPacket(packet []byte) bool {
+	if len(packet) == 0 {
+		return false
+	}
+
+	switch packet[0] >> 4 {
+	case ipv4.Version:
+		headerLen := int(packet[0]&0x0f) * 4
+
+		return len(packet) >= ipv4.HeaderLen && headerLen >= ipv4.HeaderLen && len(packet) >= headerLen &&
+			packet[9] == helloProtocol && bytes.Equal(packet[headerLen:], helloPayload)
+	case ipv6.Version:
+		return len(packet) >= ipv6.HeaderLen && packet[6] == helloProtocol && bytes.Equal(packet[ipv6.HeaderLen:], helloPayload)
+	default:
+		return false
+	}
+}
+
+// Relay frames are sent to and from the rolodex to carry datagrams between
+// members that can't reach each other directly. The frame type can't be
+// mistaken for the start of a JSON message.
+const relayFrame byte = 'R'
+
+// newRelayFrame wraps the payload in a relay frame. When sent to the rolodex
+// the address is the member to forward it to, and when received from the
+// rolodex it's the member it came from.
+func newRelayFrame(addr netaddr.IPPort, payload []byte) []byte {
+	addrString := addr.String()
+	frame := make([]byte, 0, 2+len(addrString)+len(payload))
+	frame = append(frame, relayFrame, byte(len(addrString)))
+	frame = append(frame, addrString...)
+
+	return append(frame, payload...)
+}
+
+func parseRelayFrame(frame []byte) (netaddr.IPPort, []byte, error) {
+	if len(frame) < 2 || frame[0] != relayFrame {
+		return netaddr.IPPort{}, nil, errors.New("not a relay frame")
+	}
+
+	addrLen := int(frame[1])
+
+	if len(frame) < 2+addrLen {
+		return netaddr.IPPort{}, nil, errors.New("relay frame too short")
+	}
+
+	addr, err := netaddr.ParseIPPort(string(frame[2 : 2+addrLen]))
+
+	if err != nil {
+		return netaddr.IPPort{}, nil, err
+	}
+
+	return addr, frame[2+addrLen:], nil
+}
+
+func isRelayFrame(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == relayFrame
+}
+
+// Revocation frames are sent by the rolodex to pass on the CRL it has been
+// given, which follows the frame type in DER form. The CRL is signed by the
+// CA, so members don't need to trust the rolodex to use it.
+const revocationFrame byte = 'C'
+
+func newRevocationFrame(crl []byte) []byte {
+	return append([]byte{revocationFrame}, crl...)
+}
+
+func isRevocationFrame(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == revocationFrame
+}
+
+// ACL frames are sent by the rolodex to pass on the ACL policy for the
+// network, which follows the frame type as JSON. Members only use them from
+// a rolodex they talk to over DTLS, as the policy isn't signed.
+const aclFrame byte = 'A'
+
+func newACLFrame(policy []byte) []byte {
+	return append([]byte{aclFrame}, policy...)
+}
+
+func isACLFrame(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == aclFrame
+}
+
+// Join challenge frames are sent by the rolodex in reply to heartbeats that
+// haven't proven they know the network's join secret. The challenge follows
+// the frame type.
+const joinChallengeFrame byte = 'J'
+
+func newJoinChallengeFrame(challenge []byte) []byte {
+	return append([]byte{joinChallengeFrame}, challenge...)
+}
+
+func isJoinChallengeFrame(msg []byte) bool {
+	return len(msg) > 0 && msg[0] == joinChallengeFrame
+}
+
+// Map update frames are sent by the rolodex to members that ask for them in
+// their heartbeats, instead of the JSON network map. A delta or a fragment of
+// a snapshot follows the frame type as JSON.
+const (
+	mapDeltaFrame    byte = 'D'
+	mapSnapshotFrame byte = 'S'
+)
+
+func isMapUpdateFrame(msg []byte) bool {
+	return len(msg) > 0 && (msg[0] == mapDeltaFrame || msg[0] == mapSnapshotFrame)
+}
@@ -1,7 +1,9 @@
 package meshboi
 
 import (
+	"crypto/ed25519"
 	"net"
+	"sync"
 
 	"github.com/pion/dtls/v2"
 	"github.com/pion/dtls/v2/pkg/protocol"
@@ -21,43 +23,68 @@ type VpnMeshListenerDialer interface {
 	// Returns the connection and the VPN IP address on the other side
 	DialMesh(raddr net.Addr) (MeshConn, error)
 	Dial(raddr net.Addr) (net.Conn, error)
+	// Starts a mesh connection over a conn that didn't come from the listener,
+	// such as one relayed through the rolodex
+	StartMesh(conn net.Conn, isServer bool) (MeshConn, error)
 }
 
 type MeshConn interface {
 	net.Conn
-	RemoteMeshAddr() netaddr.IP
+	// Returns the VPN IP addresses of the other side
+	RemoteMeshAddrs() []netaddr.IP
+	// Returns the identity from the other side's certificate, or nil if the
+	// mesh uses a PSK
+	RemoteIdentity() *CertIdentity
+	// Returns the ID of the PSK the connection was made with
+	PSKID() uint32
 }
 
 type meshConn struct {
 	net.Conn
-	remoteMeshAddr netaddr.IP
+	remoteMeshAddrs []netaddr.IP
+	remoteIdentity  *CertIdentity
+	pskID           uint32
 }
 
-func (m *meshConn) RemoteMeshAddr() netaddr.IP {
-	return m.remoteMeshAddr
+func (m *meshConn) RemoteMeshAddrs() []netaddr.IP {
+	return m.remoteMeshAddrs
+}
+
+func (m *meshConn) RemoteIdentity() *CertIdentity {
+	return m.remoteIdentity
+}
+
+func (m *meshConn) PSKID() uint32 {
+	return m.pskID
 }
 
 // MultiplexedDTLSConn represents a conn that can be used to listen for new incoming DTLS connections
 // and also dial new UDP connections (both DTLS and non-DTLS) from the same udp address
 type MultiplexedDTLSConn struct {
-	listener *udp.Listener
-	config   *dtls.Config
+	listener   *udp.Listener
+	config     *dtls.Config
+	configLock sync.RWMutex
+	// optional, checks the VPN IPs claimed by the other side of connections
+	membership *membershipVerifier
+}
+
+// isDtlsHandshake reports whether the packet is the start of a DTLS handshake
+func isDtlsHandshake(packet []byte) bool {
+	pkts, err := recordlayer.UnpackDatagram(packet)
+	if err != nil || len(pkts) < 1 {
+		return false
+	}
+	h := &recordlayer.Header{}
+	if err := h.Unmarshal(pkts[0]); err != nil {
+		return false
+	}
+	return h.ContentType == protocol.ContentTypeHandshake
 }
 
 func NewMultiplexedDTLSConn(laddr *net.UDPAddr, config *dtls.Config) (*MultiplexedDTLSConn, error) {
 	// Set a listen config so that we only accept incoming connections that are DTLS connections
 	lc := udp.ListenConfig{
-		AcceptFilter: func(packet []byte) bool {
-			pkts, err := recordlayer.UnpackDatagram(packet)
-			if err != nil || len(pkts) < 1 {
-				return false
-			}
-			h := &recordlayer.Header{}
-			if err := h.Unmarshal(pkts[0]); err != nil {
-				return false
-			}
-			return h.ContentType == protocol.ContentTypeHandshake
-		},
+		AcceptFilter: isDtlsHandshake,
 	}
 
 	listener, err := lc.Listen("udp", laddr)
@@ -72,14 +99,27 @@ func NewMultiplexedDTLSConn(laddr *net.UDPAddr, config *dtls.Config) (*Multiplex
 	}, nil
 }
 
+// SetConfig changes the config used for new connections. Existing
+// connections are left as they are.
+func (mc *MultiplexedDTLSConn) SetConfig(config *dtls.Config) {
+	mc.configLock.Lock()
+	defer mc.configLock.Unlock()
+
+	mc.config = config
+}
+
 func (mc *MultiplexedDTLSConn) startDtlsConn(conn net.Conn, isServer bool) (MeshConn, error) {
 	var dtlsConn *dtls.Conn
 	var err error
 
+	mc.configLock.RLock()
+	config := mc.config
+	mc.configLock.RUnlock()
+
 	if isServer {
-		dtlsConn, err = dtls.Server(conn, mc.config)
+		dtlsConn, err = dtls.Server(conn, config)
 	} else {
-		dtlsConn, err = dtls.Client(conn, mc.config)
+		dtlsConn, err = dtls.Client(conn, config)
 	}
 
 	if err != nil {
@@ -88,19 +128,66 @@ func (mc *MultiplexedDTLSConn) startDtlsConn(conn net.Conn, isServer bool) (Mesh
 		return nil, err
 	}
 
-	peerIpString := string(dtlsConn.ConnectionState().IdentityHint)
-	peerVpnIP, err := netaddr.ParseIP(peerIpString)
+	var peerVpnIPs []netaddr.IP
+	var peerIdentity *CertIdentity
+	var pskID uint32
+
+	if state := dtlsConn.ConnectionState(); len(state.PeerCertificates) > 0 {
+		// The certificate was checked against the CA during the handshake, so
+		// the VPN IPs in it can be trusted
+		peerIdentity, err = identityFromRawCert(state.PeerCertificates[0])
+
+		if err == nil {
+			peerVpnIPs = peerIdentity.VpnIPs
+		}
+	} else {
+		peerVpnIPs, err = parseIdentityHint(state.IdentityHint)
+
+		if err == nil {
+			pskID, err = handshakePSKID(config.PSKIdentityHint, state.IdentityHint)
+		}
+	}
 
 	if err != nil {
-		log.Warn("Couldn't parse peers vpn IP")
+		log.Warn("Couldn't parse peers vpn IPs: ", err)
+		dtlsConn.Close()
 		return nil, err
 	}
 
+	if mc.membership != nil {
+		if err := mc.membership.prove(dtlsConn, isServer); err != nil {
+			log.Warn("Error proving membership: ", err)
+			dtlsConn.Close()
+			return nil, err
+		}
+
+		if err := mc.membership.verify(dtlsConn, isServer, peerVpnIPs); err != nil {
+			log.WithFields(log.Fields{
+				"remoteAddr": conn.RemoteAddr(),
+				"claimedIPs": peerVpnIPs,
+			}).Warn("Rejecting peer that couldn't prove its membership: ", err)
+			dtlsConn.Close()
+			return nil, err
+		}
+	}
+
 	return &meshConn{Conn: dtlsConn,
-		remoteMeshAddr: peerVpnIP,
+		remoteMeshAddrs: peerVpnIPs,
+		remoteIdentity:  peerIdentity,
+		pskID:           pskID,
 	}, nil
 }
 
+// RequireMembership makes every connection prove, with credentials signed by
+// the network key, that the other side is allowed to use the VPN IPs it claims.
+// Connections that can't are rejected.
+func (mc *MultiplexedDTLSConn) RequireMembership(networkKey ed25519.PublicKey, credentials *MemberCredentials) {
+	mc.membership = &membershipVerifier{
+		networkKey:  networkKey,
+		credentials: credentials,
+	}
+}
+
 func (mc *MultiplexedDTLSConn) AcceptMesh() (MeshConn, error) {
 	conn, err := mc.listener.Accept()
 
@@ -122,6 +209,16 @@ func (mc *MultiplexedDTLSConn) DialMesh(raddr net.Addr) (MeshConn, error) {
 	return mc.startDtlsConn(conn, false)
 }
 
+func (mc *MultiplexedDTLSConn) StartMesh(conn net.Conn, isServer bool) (MeshConn, error) {
+	return mc.startDtlsConn(conn, isServer)
+}
+
 func (mc *MultiplexedDTLSConn) Dial(raddr net.Addr) (net.Conn, error) {
 	return mc.listener.Dial(raddr)
 }
+
+// Close stops listening for new connections. The underlying socket is closed
+// once all of the connections that were accepted or dialed are also closed.
+func (mc *MultiplexedDTLSConn) Close() error {
+	return mc.listener.Close()
+}
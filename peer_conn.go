@@ -2,6 +2,8 @@ package meshboi
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -10,36 +12,217 @@ import (
 
 const bufSize = 65535
 
+// How often to send a keepalive to each peer
+const keepAliveInterval = 10 * time.Second
+
+// How many packets can be queued for sending to a peer before QueueData blocks
+const outgoingQueueLen = 32
+
+// Called when the connection to a peer fails. By the time it's called the
+// peer has already been closed.
+type PeerFailedCallback func(peer *PeerConn, err error)
+
 // Represents a connection to a peer
 type PeerConn struct {
-	// The IP address within the VPN
-	insideIP netaddr.IP
+	// The IP addresses within the VPN (at most one IPv4 and one IPv6)
+	insideIPs []netaddr.IP
 
 	// The IP address over the internet
 	outsideAddr netaddr.IPPort
 
 	// Time of last contact
-	lastContacted time.Time
+	lastContacted     time.Time
+	lastContactedLock sync.RWMutex
 
 	// the connection to the peer
 	conn     net.Conn
 	outgoing chan []byte
 	tun      TunConn
+
+	// closed when the peer is shut down, to stop the read and send loops
+	quit      chan struct{}
+	closeOnce sync.Once
+
+	// optional, called if the connection to the peer fails
+	onFailure PeerFailedCallback
+	// optional, called when the peer is closed for any reason
+	onClose func(peer *PeerConn)
+	// optional, called when the peer advertises the subnets reachable through it
+	onRoutes func(peer *PeerConn, prefixes []netaddr.IPPrefix)
+	// optional, called when the peer lists the members it will relay to
+	onRelayedMembers func(peer *PeerConn, ips []netaddr.IP)
+	// optional, called when the peer sends a probe to us or to a member we
+	// relay to
+	onRelayProbe func(peer *PeerConn, probe relayProbe)
+	// optional, called when the peer sends the answer to a probe from us or
+	// from a member we relay to
+	onRelayProof func(peer *PeerConn, proof relayProof)
+	// optional, given packets from the peer before they're written to the tun.
+	// Returns true if the packet was forwarded on to another peer instead.
+	forward func(from *PeerConn, packet []byte) bool
+
+	// optional, returns the control messages that are sent to the peer when
+	// first connected to it and then along with every keepalive
+	announcements func() [][]byte
+
+	// whether the connection goes through the rolodex rather than direct
+	relayed bool
+	// the identity from the peer's certificate, if the mesh uses certificates
+	identity *CertIdentity
+	// the ID of the PSK the connection was made with
+	pskID uint32
+	// optional, drops packets from the peer that the ACL doesn't allow
+	acl *ACL
+	// optional, the routes through peers, so that packets from the subnets
+	// and members reachable through the peer are accepted from it
+	routes *RouteTable
+
+	// 1 while the peer may be an older member that doesn't understand
+	// control messages, in which case hellos are sent instead until it shows
+	// that it does
+	mayBeOlder uint32
+	hello      []byte
+	// signalled when the peer shows it understands control messages
+	understood chan struct{}
 }
 
-func NewPeerConn(insideIP netaddr.IP, outsideAddr netaddr.IPPort, conn net.Conn, tun TunConn) PeerConn {
+func NewPeerConn(insideIPs []netaddr.IP, outsideAddr netaddr.IPPort, conn net.Conn, tun TunConn) PeerConn {
 	return PeerConn{
-		insideIP:      insideIP, // maybe these dont need to be inside the peer. could just be in the peer store
+		insideIPs:     insideIPs, // maybe these dont need to be inside the peer. could just be in the peer store
 		outsideAddr:   outsideAddr,
 		conn:          conn,
 		tun:           tun,
 		lastContacted: time.Now(),
-		outgoing:      make(chan []byte),
+		outgoing:      make(chan []byte, outgoingQueueLen),
+		quit:          make(chan struct{}),
+		understood:    make(chan struct{}, 1),
 	}
 }
 
 func (p *PeerConn) QueueData(data []byte) {
-	p.outgoing <- data
+	select {
+	case p.outgoing <- data:
+	case <-p.quit:
+		log.Warn("Dropping data queued for closed peer ", p.outsideAddr)
+	}
+}
+
+// queueControl queues a control message, unless the peer may be an older
+// member that doesn't understand them
+func (p *PeerConn) queueControl(msg []byte) {
+	if p.isMaybeOlder() {
+		return
+	}
+
+	p.QueueData(msg)
+}
+
+func (p *PeerConn) isMaybeOlder() bool {
+	return atomic.LoadUint32(&p.mayBeOlder) == 1
+}
+
+// understandsControl records that the peer has shown it understands control
+// messages
+func (p *PeerConn) understandsControl() {
+	if !atomic.CompareAndSwapUint32(&p.mayBeOlder, 1, 0) {
+		return
+	}
+
+	select {
+	case p.understood <- struct{}{}:
+	default:
+	}
+}
+
+// TryQueueData queues the data for sending unless the queue is full, in
+// which case the data is dropped. Returns whether it was queued.
+func (p *PeerConn) TryQueueData(data []byte) bool {
+	select {
+	case p.outgoing <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// LastContacted returns the last time that data was received from the peer
+func (p *PeerConn) LastContacted() time.Time {
+	p.lastContactedLock.RLock()
+	defer p.lastContactedLock.RUnlock()
+
+	return p.lastContacted
+}
+
+func (p *PeerConn) touch() {
+	p.lastContactedLock.Lock()
+	defer p.lastContactedLock.Unlock()
+
+	p.lastContacted = time.Now()
+}
+
+// Close shuts down the connection to the peer and stops its read and send
+// loops. Any data still queued for the peer is sent before the connection is
+// closed. It is safe to call more than once.
+func (p *PeerConn) Close() error {
+	var err error
+
+	p.closeOnce.Do(func() {
+		close(p.quit)
+
+		if p.conn != nil {
+			p.drain()
+			err = p.conn.Close()
+		}
+
+		if p.onClose != nil {
+			p.onClose(p)
+		}
+	})
+
+	return err
+}
+
+// drain sends anything left in the outgoing queue
+func (p *PeerConn) drain() {
+	for {
+		select {
+		case data := <-p.outgoing:
+			if _, err := p.conn.Write(data); err != nil {
+				log.Warn("Error sending queued data to closing peer: ", err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *PeerConn) isClosed() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// fail tears down the connection to the peer and reports the failure. Errors
+// that occur because the peer has already been closed aren't reported.
+func (p *PeerConn) fail(err error) {
+	if p.isClosed() {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"insideIPs":   p.insideIPs,
+		"outsideAddr": p.outsideAddr,
+	}).Warn("Connection to peer failed: ", err)
+
+	p.Close()
+
+	if p.onFailure != nil {
+		p.onFailure(p, err)
+	}
 }
 
 func (p *PeerConn) readLoop() {
@@ -47,14 +230,41 @@ func (p *PeerConn) readLoop() {
 	for {
 		n, err := p.conn.Read(b)
 		if err != nil {
-			panic(err)
+			p.fail(err)
+			return
+		}
+
+		p.touch()
+
+		if isControlMessage(b[:n]) {
+			p.understandsControl()
+			p.handleControlMessage(b[:n])
+			continue
+		}
+
+		if isHelloPacket(b[:n]) {
+			p.understandsControl()
+			continue
+		}
+
+		if !p.ownsSource(b[:n]) {
+			log.Debug("Dropping packet from ", p.insideIPs, " with a source that isn't reachable through it")
+			continue
+		}
+
+		if p.forward != nil && p.forward(p, b[:n]) {
+			continue
+		}
+
+		if !p.acl.allowIngress(b[:n], p) {
+			continue
 		}
 
-		p.lastContacted = time.Now()
 		written, err := p.tun.Write(b[:n])
 
 		if err != nil {
-			panic(err)
+			p.fail(err)
+			return
 		}
 
 		if written != n {
@@ -63,14 +273,155 @@ func (p *PeerConn) readLoop() {
 	}
 }
 
+// ownsSource reports whether the packet came from the peer itself or from
+// somewhere we route to through it, so that a peer can't pass its packets
+// off as another member's
+func (p *PeerConn) ownsSource(packet []byte) bool {
+	info, err := parsePacketInfo(packet)
+
+	if err != nil {
+		return false
+	}
+
+	for _, ip := range p.insideIPs {
+		if ip == info.src {
+			return true
+		}
+	}
+
+	if p.routes == nil {
+		return false
+	}
+
+	peer, ok := p.routes.Lookup(info.src)
+
+	return ok && peer == p
+}
+
+func (p *PeerConn) handleControlMessage(msg []byte) {
+	switch msg[0] {
+	case keepAliveMessage:
+		// Nothing to do, receiving it has already updated lastContacted
+	case routesMessage:
+		prefixes, err := parseRoutesMessage(msg)
+
+		if err != nil {
+			log.Warn("Error parsing routes from peer: ", err)
+			return
+		}
+
+		if p.onRoutes != nil {
+			p.onRoutes(p, prefixes)
+		}
+	case relayedMembersMessage:
+		ips, err := parseRelayedMembersMessage(msg)
+
+		if err != nil {
+			log.Warn("Error parsing relayed members from peer: ", err)
+			return
+		}
+
+		if p.onRelayedMembers != nil {
+			p.onRelayedMembers(p, ips)
+		}
+	case relayProbeMessage:
+		probe, err := parseRelayProbeMessage(msg)
+
+		if err != nil {
+			log.Warn("Error parsing relay probe from peer: ", err)
+			return
+		}
+
+		if p.onRelayProbe != nil {
+			p.onRelayProbe(p, probe)
+		}
+	case relayProofMessage:
+		proof, err := parseRelayProofMessage(msg)
+
+		if err != nil {
+			log.Warn("Error parsing relay proof from peer: ", err)
+			return
+		}
+
+		if p.onRelayProof != nil {
+			p.onRelayProof(p, proof)
+		}
+	case membershipMessage:
+		// Sent by peers that require membership proofs when we don't
+		log.Debug("Ignoring membership proof from peer")
+	default:
+		log.Warn("Unknown control message from peer: ", msg[0])
+	}
+}
+
+func (p *PeerConn) sendAnnouncements() {
+	if p.announcements == nil {
+		return
+	}
+
+	for _, announcement := range p.announcements() {
+		p.queueControl(announcement)
+	}
+}
+
+// keepAlive sends a keepalive and the announcements to the peer, or a hello
+// if it may be an older member
+func (p *PeerConn) keepAlive() {
+	if p.isMaybeOlder() {
+		if p.hello != nil {
+			p.QueueData(p.hello)
+		}
+
+		return
+	}
+
+	p.QueueData([]byte{keepAliveMessage})
+	p.sendAnnouncements()
+}
+
+// keepAliveLoop sends a keepalive to the peer every interval until the peer
+// is closed
+func (p *PeerConn) keepAliveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	if p.isMaybeOlder() {
+		p.keepAlive()
+	} else {
+		p.sendAnnouncements()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			p.keepAlive()
+		case <-p.understood:
+			// Let the peer know we understand control messages too, and tell
+			// it what we held back
+			p.keepAlive()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
 // Chat starts the stdin readloop to dispatch messages to the hub
 func (p *PeerConn) sendLoop() {
 	for {
-		data := <-p.outgoing
+		var data []byte
+
+		select {
+		case data = <-p.outgoing:
+		case <-p.quit:
+			return
+		}
+
 		n, err := p.conn.Write(data)
 
 		if err != nil {
-			log.Error("Error sending over UDP conn: ", err)
+			if !p.isClosed() {
+				log.Error("Error sending over UDP conn: ", err)
+			}
 			continue
 		}
 
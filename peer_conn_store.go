@@ -24,7 +24,15 @@ func (p *PeerConnStore) Add(peer *PeerConn) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	p.peersByInsideIP[peer.insideIP] = peer
+	// If this replaces a previous peer at the same address then make sure the
+	// old peer can no longer be found by its inside IP either
+	if old, ok := p.peersByOutsideIPPort[peer.outsideAddr]; ok {
+		p.removeInsideIPs(old)
+	}
+
+	for _, insideIP := range peer.insideIPs {
+		p.peersByInsideIP[insideIP] = peer
+	}
 	p.peersByOutsideIPPort[peer.outsideAddr] = peer
 }
 
@@ -47,19 +55,58 @@ func (p *PeerConnStore) GetByOutsideIpPort(outsideIPPort netaddr.IPPort) (*PeerC
 }
 
 func (p *PeerConnStore) RemoveByOutsideIPPort(outsideIPPort netaddr.IPPort) bool {
-	peer, ok := p.GetByOutsideIpPort(outsideIPPort)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	peer, ok := p.peersByOutsideIPPort[outsideIPPort]
 
 	if !ok {
 		return false
 	}
 
+	p.remove(peer)
+
+	return true
+}
+
+// Remove removes the given peer from the store. Entries that have since been
+// replaced by another peer are left untouched.
+func (p *PeerConnStore) Remove(peer *PeerConn) bool {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	insideIp := peer.insideIP
+	if p.peersByOutsideIPPort[peer.outsideAddr] != peer {
+		return false
+	}
 
-	delete(p.peersByInsideIP, insideIp)
-	delete(p.peersByOutsideIPPort, outsideIPPort)
+	p.remove(peer)
 
 	return true
 }
+
+func (p *PeerConnStore) remove(peer *PeerConn) {
+	p.removeInsideIPs(peer)
+	delete(p.peersByOutsideIPPort, peer.outsideAddr)
+}
+
+func (p *PeerConnStore) removeInsideIPs(peer *PeerConn) {
+	for _, insideIP := range peer.insideIPs {
+		if p.peersByInsideIP[insideIP] == peer {
+			delete(p.peersByInsideIP, insideIP)
+		}
+	}
+}
+
+// GetAll returns every peer currently in the store
+func (p *PeerConnStore) GetAll() []*PeerConn {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	peers := make([]*PeerConn, 0, len(p.peersByOutsideIPPort))
+
+	for _, peer := range p.peersByOutsideIPPort {
+		peers = append(peers, peer)
+	}
+
+	return peers
+}
@@ -20,7 +20,7 @@ func NewFakePeerConn(inside string, outside string) *PeerConn {
 	insideIP := netaddr.MustParseIP(inside)
 	outsideIP := netaddr.MustParseIPPort(outside)
 	_, client := net.Pipe()
-	p := NewPeerConn(insideIP, outsideIP, client, &FakeTun{})
+	p := NewPeerConn([]netaddr.IP{insideIP}, outsideIP, client, &FakeTun{})
 	return &p
 }
 
@@ -115,3 +115,52 @@ func TestDeleteNonExistentIP(t *testing.T) {
 		t.Errorf("Deleting a non existing IP Port shouldn't work")
 	}
 }
+
+func TestRemoveReplacedPeer(t *testing.T) {
+	store := NewPeerConnStore()
+
+	old := NewFakePeerConn(tests[0].insideIP, tests[0].outsideIP)
+	store.Add(old)
+
+	replacement := NewFakePeerConn(tests[1].insideIP, tests[0].outsideIP)
+	store.Add(replacement)
+
+	if _, ok := store.GetByInsideIp(old.insideIPs[0]); ok {
+		t.Errorf("Replaced peer still found by inside IP")
+	}
+
+	if store.Remove(old) {
+		t.Errorf("Removing a replaced peer shouldn't work")
+	}
+
+	retrieved, ok := store.GetByOutsideIpPort(old.outsideAddr)
+
+	if !ok || retrieved != replacement {
+		t.Errorf("Replacement peer was removed")
+	}
+}
+
+func TestGetByEitherInsideIP(t *testing.T) {
+	store := NewPeerConnStore()
+
+	insideIPs := []netaddr.IP{netaddr.MustParseIP("192.168.4.1"), netaddr.MustParseIP("fd00::1")}
+	_, client := net.Pipe()
+	pc := NewPeerConn(insideIPs, netaddr.MustParseIPPort("[2001:db8::1]:5000"), client, &FakeTun{})
+	store.Add(&pc)
+
+	for _, ip := range insideIPs {
+		retrieved, ok := store.GetByInsideIp(ip)
+
+		if !ok || retrieved != &pc {
+			t.Errorf("Couldn't find peer conn by inside IP %v", ip)
+		}
+	}
+
+	store.Remove(&pc)
+
+	for _, ip := range insideIPs {
+		if _, ok := store.GetByInsideIp(ip); ok {
+			t.Errorf("Found removed peer by inside IP %v", ip)
+		}
+	}
+}
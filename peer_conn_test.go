@@ -4,7 +4,9 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 
+	"golang.org/x/net/ipv4"
 	"inet.af/netaddr"
 )
 
@@ -12,7 +14,7 @@ import (
 func TestSendData(t *testing.T) {
 	client, server := net.Pipe()
 	tun := FakeTun{}
-	conn := NewPeerConn(netaddr.MustParseIP("192.168.5.1"), netaddr.MustParseIPPort("192.168.33.1:5000"), client, &tun)
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, &tun)
 	msg := []byte("hello this is some data")
 
 	go conn.sendLoop()
@@ -31,10 +33,10 @@ func TestSendData(t *testing.T) {
 func TestReceiveData(t *testing.T) {
 	client, server := net.Pipe()
 	tunClient, tunServer := net.Pipe()
-	conn := NewPeerConn(netaddr.MustParseIP("192.168.5.1"), netaddr.MustParseIPPort("192.168.33.1:5000"), client, tunClient)
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, tunClient)
 	go conn.readLoop()
 
-	msg := []byte("hello this is some data")
+	msg := ipv4Packet("192.168.5.1", "192.168.5.2", protocolUDP, 5000, 6000)
 	server.Write(msg)
 	b := make([]byte, 1000)
 	n, _ := tunServer.Read(b)
@@ -43,3 +45,195 @@ func TestReceiveData(t *testing.T) {
 		t.Fatalf("Didn't read expected data %v %v", b[:n], msg)
 	}
 }
+
+// Tests that packets from the peer are only written to the tun if they come
+// from the peer or somewhere routed through it
+func TestReceiveSpoofedDataDropped(t *testing.T) {
+	client, server := net.Pipe()
+	tunClient, tunServer := net.Pipe()
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, tunClient)
+	conn.routes = NewRouteTable()
+	conn.routes.SetPeerRoutes(&conn, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.1.0.0/16")})
+	go conn.readLoop()
+
+	server.Write(ipv4Packet("192.168.5.9", "192.168.5.2", protocolUDP, 5000, 6000))
+	server.Write([]byte("not a packet"))
+	routed := ipv4Packet("10.1.0.5", "192.168.5.2", protocolUDP, 5000, 6000)
+	server.Write(routed)
+
+	b := make([]byte, 1000)
+	n, _ := tunServer.Read(b)
+
+	if !reflect.DeepEqual(b[:n], routed) {
+		t.Fatalf("Expected only the routed packet to be written to the tun")
+	}
+}
+
+// Tests that keepalives are sent to the peer periodically
+func TestSendKeepAlive(t *testing.T) {
+	client, server := net.Pipe()
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, &FakeTun{})
+	defer conn.Close()
+
+	go conn.sendLoop()
+	go conn.keepAliveLoop(time.Millisecond)
+
+	b := make([]byte, 1000)
+	n, _ := server.Read(b)
+
+	if !reflect.DeepEqual(b[:n], []byte{keepAliveMessage}) {
+		t.Fatalf("Didn't read a keepalive %v", b[:n])
+	}
+}
+
+// Tests that peers that may be older members are sent hellos rather than
+// control messages until they show they understand them
+func TestOlderPeerHello(t *testing.T) {
+	client, server := net.Pipe()
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, &FakeTun{})
+	defer conn.Close()
+
+	conn.mayBeOlder = 1
+	conn.hello = newHelloPacket([]netaddr.IP{netaddr.MustParseIP("192.168.5.2")}, conn.insideIPs)
+	conn.queueControl([]byte{keepAliveMessage})
+
+	if len(conn.outgoing) != 0 {
+		t.Fatalf("Control message queued for a peer that may be an older member")
+	}
+
+	go conn.readLoop()
+	go conn.sendLoop()
+	go conn.keepAliveLoop(time.Hour)
+
+	b := make([]byte, 1000)
+	n, _ := server.Read(b)
+
+	if !isHelloPacket(b[:n]) || ipv4Checksum(b[:ipv4.HeaderLen]) != 0 {
+		t.Fatalf("Expected a hello but got %v", b[:n])
+	}
+
+	if info, _ := parsePacketInfo(b[:n]); info.src != netaddr.MustParseIP("192.168.5.2") || info.dst != conn.insideIPs[0] {
+		t.Fatalf("Hello sent from %v to %v", info.src, info.dst)
+	}
+
+	go server.Write(newHelloPacket(conn.insideIPs, []netaddr.IP{netaddr.MustParseIP("192.168.5.2")}))
+
+	n, _ = server.Read(b)
+
+	if !reflect.DeepEqual(b[:n], []byte{keepAliveMessage}) {
+		t.Fatalf("Expected a keepalive once the peer sent a hello but got %v", b[:n])
+	}
+}
+
+// Tests that keepalives from the peer update the last contacted time but
+// aren't written to the tun
+func TestReceiveKeepAlive(t *testing.T) {
+	client, server := net.Pipe()
+	tunClient, tunServer := net.Pipe()
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, tunClient)
+	conn.lastContacted = time.Now().Add(-time.Hour)
+	go conn.readLoop()
+
+	server.Write([]byte{keepAliveMessage})
+
+	msg := ipv4Packet("192.168.5.1", "192.168.5.2", protocolUDP, 5000, 6000)
+	server.Write(msg)
+
+	b := make([]byte, 1000)
+	n, _ := tunServer.Read(b)
+
+	if !reflect.DeepEqual(b[:n], msg) {
+		t.Fatalf("Didn't read expected data %v %v", b[:n], msg)
+	}
+
+	if time.Since(conn.LastContacted()) > time.Minute {
+		t.Fatalf("Last contacted time wasn't updated")
+	}
+}
+
+// Tests that an error reading from the peer closes it and reports the failure
+func TestReadErrorReportsFailure(t *testing.T) {
+	client, server := net.Pipe()
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, &FakeTun{})
+
+	failed := make(chan *PeerConn, 1)
+	conn.onFailure = func(peer *PeerConn, err error) {
+		failed <- peer
+	}
+
+	go conn.readLoop()
+	server.Close()
+
+	select {
+	case peer := <-failed:
+		if peer != &conn {
+			t.Fatalf("Wrong peer reported as failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Failure wasn't reported")
+	}
+
+	if !conn.isClosed() {
+		t.Fatalf("Failed peer wasn't closed")
+	}
+}
+
+// Tests that routes advertised by the peer are passed on but aren't written to
+// the tun
+func TestReceiveRoutes(t *testing.T) {
+	client, server := net.Pipe()
+	tunClient, tunServer := net.Pipe()
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, tunClient)
+
+	routes := make(chan []netaddr.IPPrefix, 1)
+	conn.onRoutes = func(peer *PeerConn, prefixes []netaddr.IPPrefix) {
+		routes <- prefixes
+	}
+
+	go conn.readLoop()
+
+	advertised := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.1.0.0/16")}
+	routesMsg, _ := newRoutesMessage(advertised)
+	server.Write(routesMsg)
+
+	msg := ipv4Packet("192.168.5.1", "192.168.5.2", protocolUDP, 5000, 6000)
+	server.Write(msg)
+
+	b := make([]byte, 1000)
+	n, _ := tunServer.Read(b)
+
+	if !reflect.DeepEqual(b[:n], msg) {
+		t.Fatalf("Didn't read expected data %v %v", b[:n], msg)
+	}
+
+	select {
+	case prefixes := <-routes:
+		if !reflect.DeepEqual(prefixes, advertised) {
+			t.Fatalf("Unexpected routes %v", prefixes)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Routes weren't passed on")
+	}
+}
+
+// Tests that data from the peer that the ACL doesn't allow isn't written to
+// the tun
+func TestReceiveDataDroppedByACL(t *testing.T) {
+	client, server := net.Pipe()
+	tunClient, tunServer := net.Pipe()
+	conn := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.5.1")}, netaddr.MustParseIPPort("192.168.33.1:5000"), client, tunClient)
+	conn.acl = NewACL(nil)
+	conn.acl.Update(&ACLPolicy{Rules: []ACLRule{{From: []string{"192.168.5.1"}, To: []string{"*"}, Protocol: "tcp", Ports: "22"}}})
+	go conn.readLoop()
+
+	server.Write(ipv4Packet("192.168.5.1", "192.168.5.2", protocolTCP, 50000, 80))
+	allowed := ipv4Packet("192.168.5.1", "192.168.5.2", protocolTCP, 50000, 22)
+	server.Write(allowed)
+
+	b := make([]byte, 1000)
+	n, _ := tunServer.Read(b)
+
+	if !reflect.DeepEqual(b[:n], allowed) {
+		t.Fatalf("Expected only the allowed packet to be written to the tun")
+	}
+}
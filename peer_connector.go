@@ -1,7 +1,11 @@
 package meshboi
 
 import (
+	"bytes"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"inet.af/netaddr"
@@ -9,24 +13,67 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// The bounds on how long to wait before retrying a peer that has failed
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 2 * time.Minute
+)
+
 type PeerConnector struct {
 	store          *PeerConnStore
 	listenerDialer VpnMeshListenerDialer
-	myOutsideAddr  netaddr.IPPort
+	myOutsideAddrs MemberAddrs
 	tun            TunConn
+	backoff        *backoff
+	quit           chan struct{}
+
+	// Subnets advertised by peers
+	routes *RouteTable
+	// Whether to route subnets advertised by peers through the tun
+	acceptRoutes bool
+	// Control messages sent to every peer we connect to
+	announcements [][]byte
+	// The VPN IP of the peer to send default route traffic through, if any
+	exitNode netaddr.IP
+	// Keeps traffic to members off the exit node's default route
+	bypass *BypassRoutes
+	// Used to reach members that can't be connected to directly
+	relays []*Relay
+	// Whether to relay packets between peers that can't connect to each other
+	relayForPeers bool
+	// How many relayed packets were dropped because the peer they were for
+	// had a full queue
+	relayDropped uint64
+	// Answers and checks the probes that prove members can be reached through
+	// a relay. Without it, members aren't reached through relays.
+	prover *relayProver
+	// The members each relay has offered to relay to
+	relayedMembers map[*PeerConn]map[netaddr.IP]*relayedMember
+	relayedLock    sync.Mutex
+	// Certificates that peers are no longer allowed to connect with
+	revocations *RevocationList
+	// Limits the traffic to and from peers, if set
+	acl *ACL
+	// Set when peers connected with the PSK with ID 0 may be older members,
+	// to the VPN IPs that hellos are sent to them from
+	olderMemberIPs []netaddr.IP
+
+	// Network maps can arrive from a rolodex client for each IP version
+	updateLock sync.Mutex
 }
 
 // Simple comparison to see if this member should be the server or if the remote member should be
 func (pc *PeerConnector) AmServer(other netaddr.IPPort) bool {
-	ipCompare := pc.myOutsideAddr.IP.Compare(other.IP)
+	myOutsideAddr := pc.myOutsideAddrs.SameFamily(other)
+	ipCompare := myOutsideAddr.IP.Compare(other.IP)
 
 	switch ipCompare {
 	case -1:
 		return false
 	case 0:
-		if pc.myOutsideAddr.Port > other.Port {
+		if myOutsideAddr.Port > other.Port {
 			return true
-		} else if pc.myOutsideAddr.Port < other.Port {
+		} else if myOutsideAddr.Port < other.Port {
 			return false
 		} else {
 			panic("Remote IPPort == Local IPPort")
@@ -38,17 +85,41 @@ func (pc *PeerConnector) AmServer(other netaddr.IPPort) bool {
 	}
 }
 
-func NewPeerConnector(listenerDialer VpnMeshListenerDialer, store *PeerConnStore, tun TunConn) PeerConnector {
+func NewPeerConnector(listenerDialer VpnMeshListenerDialer, store *PeerConnStore, routes *RouteTable, tun TunConn) PeerConnector {
 	return PeerConnector{
 		listenerDialer: listenerDialer,
 		store:          store,
+		routes:         routes,
 		tun:            tun,
+		backoff:        newBackoff(minReconnectBackoff, maxReconnectBackoff),
+		quit:           make(chan struct{}),
+		relayedMembers: make(map[*PeerConn]map[netaddr.IP]*relayedMember),
+	}
+}
+
+func (pc *PeerConnector) isStopped() bool {
+	select {
+	case <-pc.quit:
+		return true
+	default:
+		return false
 	}
 }
 
 func (pc *PeerConnector) OnNetworkMapUpdate(network NetworkMap) {
-	pc.myOutsideAddr = network.Addresses[network.YourIndex]
-	pc.newAddresses(network.Addresses)
+	pc.updateLock.Lock()
+	defer pc.updateLock.Unlock()
+
+	members := network.MemberAddrs()
+
+	if network.YourIndex < 0 || network.YourIndex >= len(members) {
+		log.Warn("Ignoring network map with invalid index ", network.YourIndex)
+		return
+	}
+
+	pc.myOutsideAddrs = members[network.YourIndex]
+	pc.bypassMembers(members, network.YourIndex)
+	pc.newMembers(members, network.YourIndex)
 }
 
 func (pc *PeerConnector) readAllFromAddr(address net.Addr, timeout time.Duration) error {
@@ -101,7 +172,41 @@ func (pc *PeerConnector) connectToNewPeer(address netaddr.IPPort) error {
 	return pc.OnNewPeerConnection(conn)
 }
 
+// connectViaRelay connects to a member through the rolodex, for when it can't
+// be reached directly
+func (pc *PeerConnector) connectViaRelay(addrs []netaddr.IPPort) error {
+	for _, address := range addrs {
+		for _, relay := range pc.relays {
+			if !relay.CanReach(address) {
+				continue
+			}
+
+			log.Info("Going to try to connect to ", address, " through the rolodex")
+
+			conn, err := relay.Dial(address)
+
+			if err != nil {
+				return err
+			}
+
+			meshConn, err := pc.listenerDialer.StartMesh(conn, false)
+
+			if err != nil {
+				return err
+			}
+
+			return pc.addPeer(meshConn, true)
+		}
+	}
+
+	return errors.New("no relay available")
+}
+
 func (pc *PeerConnector) OnNewPeerConnection(conn MeshConn) error {
+	return pc.addPeer(conn, false)
+}
+
+func (pc *PeerConnector) addPeer(conn MeshConn, relayed bool) error {
 	outsideAddr, err := netaddr.ParseIPPort(conn.RemoteAddr().String())
 
 	if err != nil {
@@ -109,27 +214,527 @@ func (pc *PeerConnector) OnNewPeerConnection(conn MeshConn) error {
 		return err
 	}
 
-	log.Info("Succesfully accepted connection from ", conn.RemoteAddr())
+	if pc.revocations.IsRevoked(conn.RemoteIdentity()) {
+		conn.Close()
+		return errors.New("peer certificate has been revoked")
+	}
 
-	peer := NewPeerConn(conn.RemoteMeshAddr(), outsideAddr, conn, pc.tun)
+	existing, hasExisting := pc.store.GetByOutsideIpPort(outsideAddr)
+
+	if relayed && hasExisting && existing.conn != nil && !existing.relayed {
+		// A direct connection is always preferred over a relayed one
+		conn.Close()
+		return errors.New("already directly connected to peer")
+	}
+
+	log.WithFields(log.Fields{
+		"outsideAddr": conn.RemoteAddr(),
+		"relayed":     relayed,
+	}).Info("Succesfully accepted connection")
+
+	peer := NewPeerConn(conn.RemoteMeshAddrs(), outsideAddr, conn, pc.tun)
+	peer.onFailure = pc.onPeerFailed
+	peer.onClose = pc.onPeerClosed
+	peer.onRoutes = pc.onPeerRoutes
+	peer.onRelayedMembers = pc.onPeerRelayedMembers
+	peer.onRelayProbe = pc.onPeerRelayProbe
+	peer.onRelayProof = pc.onPeerRelayProof
+	peer.announcements = pc.currentAnnouncements
+
+	if pc.relayForPeers {
+		peer.forward = pc.forwardPacket
+	}
+	peer.relayed = relayed
+	peer.identity = conn.RemoteIdentity()
+	peer.pskID = conn.PSKID()
+	peer.acl = pc.acl
+	peer.routes = pc.routes
+
+	if pc.olderMemberIPs != nil && peer.pskID == 0 && peer.identity == nil {
+		peer.mayBeOlder = 1
+		peer.hello = newHelloPacket(pc.olderMemberIPs, peer.insideIPs)
+	}
 
 	pc.store.Add(&peer)
 
+	if hasExisting && existing.relayed && !relayed {
+		log.Info("Upgraded relayed connection to ", outsideAddr, " to a direct connection")
+		existing.Close()
+	}
+
+	// Keep backing off direct connection attempts to relayed peers so that
+	// we don't spend all our time trying to upgrade them
+	if !relayed {
+		pc.backoff.succeeded(outsideAddr)
+	}
+
+	if pc.isStopped() {
+		// We raced with Stop, so make sure this peer doesn't outlive it
+		pc.store.Remove(&peer)
+		peer.Close()
+		return nil
+	}
+
 	go peer.readLoop()
 	go peer.sendLoop()
+	go peer.keepAliveLoop(keepAliveInterval)
 
 	return nil
 }
 
+// AdvertiseRoutes sets the subnets that are advertised to peers as being
+// reachable through this member
+func (pc *PeerConnector) AdvertiseRoutes(prefixes []netaddr.IPPrefix) error {
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	msg, err := newRoutesMessage(prefixes)
+
+	if err != nil {
+		return err
+	}
+
+	pc.announcements = append(pc.announcements, msg)
+
+	return nil
+}
+
+// AllowOlderMembers holds back control messages from peers connected with the
+// PSK with ID 0 until they show they understand them, as they may be older
+// members that crash on anything that isn't an IP packet. Hellos are sent to
+// them from our VPN IPs instead.
+func (pc *PeerConnector) AllowOlderMembers(vpnIPs []netaddr.IP) {
+	pc.olderMemberIPs = vpnIPs
+}
+
+// AcceptRoutes enables routing the subnets that peers advertise through the
+// tun. Without it, only the VPN IPs of peers are reachable.
+func (pc *PeerConnector) AcceptRoutes() {
+	pc.acceptRoutes = true
+}
+
+// UseExitNode sends all IPv4 traffic that isn't destined for the mesh through
+// the peer with the given VPN IP, once it advertises itself as an exit node.
+// The bypass routes keep the traffic to other members going direct.
+func (pc *PeerConnector) UseExitNode(vpnIP netaddr.IP, bypass *BypassRoutes) {
+	pc.exitNode = vpnIP
+	pc.bypass = bypass
+}
+
+func (pc *PeerConnector) isExitNode(peer *PeerConn) bool {
+	for _, ip := range peer.insideIPs {
+		if ip == pc.exitNode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bypassMembers makes sure that traffic to the other members won't be routed
+// through the exit node, which has to be done before connecting to them
+func (pc *PeerConnector) bypassMembers(members []MemberAddrs, myIndex int) {
+	if pc.bypass == nil {
+		return
+	}
+
+	for i, member := range members {
+		if i == myIndex {
+			continue
+		}
+
+		for _, addr := range member.All() {
+			if err := pc.bypass.Add(addr.IP); err != nil {
+				log.Warn("Error adding bypass route for ", addr.IP, ": ", err)
+			}
+		}
+	}
+}
+
+func (pc *PeerConnector) onPeerRoutes(peer *PeerConn, prefixes []netaddr.IPPrefix) {
+	var accepted []netaddr.IPPrefix
+
+	for _, prefix := range prefixes {
+		if peer.identity != nil && !peer.identity.AllowsRoute(prefix) {
+			log.Warn("Ignoring route to ", prefix, " that ", peer.identity.Hostname, " isn't allowed to advertise")
+			continue
+		}
+
+		if prefix.Bits == 0 {
+			if !pc.isExitNode(peer) {
+				log.Debug("Ignoring default route advertised by ", peer.insideIPs)
+				continue
+			}
+		} else if !pc.acceptRoutes {
+			continue
+		}
+
+		accepted = append(accepted, prefix)
+	}
+
+	pc.updateTunRoutes(pc.routes.SetPeerRoutes(peer, accepted))
+
+	if peer.isClosed() {
+		// The peer was closed while we were adding its routes, so make sure
+		// they don't outlive it
+		pc.onPeerClosed(peer)
+	}
+}
+
+// UseRevocationList refuses peers whose certificates are in the revocation
+// list, closing the connections to any peers that are revoked once connected
+func (pc *PeerConnector) UseRevocationList(revocations *RevocationList) {
+	pc.revocations = revocations
+	revocations.onUpdate = pc.closeRevokedPeers
+}
+
+// UseRelayProver lets members be reached through relays, once they've
+// answered a probe through the relay that the prover can check
+func (pc *PeerConnector) UseRelayProver(prover *relayProver) {
+	pc.prover = prover
+}
+
+// UseACL drops packets from peers that the ACL doesn't allow
+func (pc *PeerConnector) UseACL(acl *ACL) {
+	pc.acl = acl
+}
+
+func (pc *PeerConnector) closeRevokedPeers() {
+	for _, peer := range pc.store.GetAll() {
+		if !pc.revocations.IsRevoked(peer.identity) {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"insideIPs":   peer.insideIPs,
+			"outsideAddr": peer.outsideAddr,
+			"hostname":    peer.identity.Hostname,
+		}).Warn("Disconnecting peer as its certificate has been revoked")
+
+		pc.store.Remove(peer)
+		peer.Close()
+	}
+}
+
+// ReconnectOlderPSKs disconnects the peers whose connections were made with a
+// PSK older than the given one, so that they're reconnected with it. The DTLS
+// library can't renegotiate an existing connection.
+func (pc *PeerConnector) ReconnectOlderPSKs(pskID uint32) {
+	for _, peer := range pc.store.GetAll() {
+		if peer.pskID >= pskID {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"insideIPs":   peer.insideIPs,
+			"outsideAddr": peer.outsideAddr,
+			"pskID":       peer.pskID,
+		}).Info("Reconnecting to peer with the new PSK")
+
+		pc.store.Remove(peer)
+		peer.Close()
+	}
+}
+
+// RelayForPeers volunteers this member to relay packets between peers that
+// can't connect to each other directly but can both connect to this member
+func (pc *PeerConnector) RelayForPeers() {
+	pc.relayForPeers = true
+}
+
+// currentAnnouncements returns the control messages to send to each peer,
+// including the members we can currently relay to if we're a relay
+func (pc *PeerConnector) currentAnnouncements() [][]byte {
+	if !pc.relayForPeers {
+		return pc.announcements
+	}
+
+	var ips []netaddr.IP
+
+	for _, peer := range pc.store.GetAll() {
+		// Only offer to relay to peers we have a direct connection to
+		if peer.conn != nil && !peer.relayed {
+			ips = append(ips, peer.insideIPs...)
+		}
+	}
+
+	msg, err := newRelayedMembersMessage(ips)
+
+	if err != nil {
+		log.Warn("Error creating relayed members message: ", err)
+		return pc.announcements
+	}
+
+	announcements := make([][]byte, 0, len(pc.announcements)+1)
+	announcements = append(announcements, pc.announcements...)
+
+	return append(announcements, msg)
+}
+
+// relayedMember is a member that a relay has offered to relay to
+type relayedMember struct {
+	// the nonce of the last probe sent to the member through the relay
+	nonce []byte
+	// whether the member has answered a probe through the relay
+	proven bool
+}
+
+// onPeerRelayedMembers routes to the members the peer offers to relay to once
+// they've answered a probe through it, and probes the ones that haven't
+func (pc *PeerConnector) onPeerRelayedMembers(peer *PeerConn, ips []netaddr.IP) {
+	if pc.prover == nil {
+		return
+	}
+
+	pc.relayedLock.Lock()
+	previous := pc.relayedMembers[peer]
+	offered := make(map[netaddr.IP]*relayedMember, len(ips))
+	var proven []netaddr.IP
+	var probes []relayProbe
+
+	for _, ip := range ips {
+		if pc.prover.isOurs(ip) || containsIP(peer.insideIPs, ip) {
+			continue
+		}
+
+		if member, ok := previous[ip]; ok && member.proven {
+			offered[ip] = member
+			proven = append(proven, ip)
+			continue
+		}
+
+		// Probed again each time the relay offers, as probes can be lost
+		probe, err := pc.prover.newProbe(ip)
+
+		if err != nil {
+			log.Warn("Error creating relay probe: ", err)
+			continue
+		}
+
+		offered[ip] = &relayedMember{nonce: probe.Nonce}
+		probes = append(probes, probe)
+	}
+
+	pc.relayedMembers[peer] = offered
+	pc.routes.SetRelayedMembers(peer, proven)
+	pc.relayedLock.Unlock()
+
+	for _, probe := range probes {
+		msg, err := newRelayProbeMessage(probe)
+
+		if err != nil {
+			log.Warn("Error creating relay probe message: ", err)
+			continue
+		}
+
+		peer.queueControl(msg)
+	}
+
+	if peer.isClosed() {
+		// The peer was closed while we were adding its routes, so make sure
+		// they don't outlive it
+		pc.onPeerClosed(peer)
+	}
+}
+
+// onPeerRelayProbe answers a probe sent to us through a relay, or passes a
+// probe on to a member if we're the relay
+func (pc *PeerConnector) onPeerRelayProbe(peer *PeerConn, probe relayProbe) {
+	if pc.prover != nil && pc.prover.isOurs(probe.To) {
+		proof, err := pc.prover.answer(probe)
+
+		if err != nil {
+			log.Warn("Error answering relay probe: ", err)
+			return
+		}
+
+		msg, err := newRelayProofMessage(proof)
+
+		if err != nil {
+			log.Warn("Error creating relay proof message: ", err)
+			return
+		}
+
+		peer.queueControl(msg)
+		return
+	}
+
+	msg, err := newRelayProbeMessage(probe)
+
+	if err != nil {
+		return
+	}
+
+	pc.forwardControlMessage(peer, probe.From, probe.To, msg)
+}
+
+// onPeerRelayProof routes to a member through the relay once it has answered
+// our probe, or passes the answer back if we're the relay
+func (pc *PeerConnector) onPeerRelayProof(peer *PeerConn, proof relayProof) {
+	if pc.prover == nil || !pc.prover.isOurs(proof.To) {
+		msg, err := newRelayProofMessage(proof)
+
+		if err != nil {
+			return
+		}
+
+		pc.forwardControlMessage(peer, proof.From, proof.To, msg)
+		return
+	}
+
+	pc.relayedLock.Lock()
+	member, ok := pc.relayedMembers[peer][proof.From]
+
+	if !ok || member.proven || !bytes.Equal(member.nonce, proof.Nonce) {
+		pc.relayedLock.Unlock()
+		return
+	}
+
+	if err := pc.prover.verify(proof); err != nil {
+		pc.relayedLock.Unlock()
+		log.Warn("Not reaching ", proof.From, " through ", peer.insideIPs, ": ", err)
+		return
+	}
+
+	member.proven = true
+	var proven []netaddr.IP
+
+	for ip, member := range pc.relayedMembers[peer] {
+		if member.proven {
+			proven = append(proven, ip)
+		}
+	}
+
+	pc.routes.SetRelayedMembers(peer, proven)
+	pc.relayedLock.Unlock()
+
+	if peer.isClosed() {
+		pc.onPeerClosed(peer)
+	}
+}
+
+// forwardControlMessage passes a control message between two peers that are
+// using this member as a relay
+func (pc *PeerConnector) forwardControlMessage(from *PeerConn, src netaddr.IP, dst netaddr.IP, msg []byte) {
+	if !pc.relayForPeers || !containsIP(from.insideIPs, src) {
+		return
+	}
+
+	to, ok := pc.store.GetByInsideIp(dst)
+
+	if !ok || to == from || to.isMaybeOlder() {
+		return
+	}
+
+	pc.relay(to, msg)
+}
+
+// forwardPacket sends a packet from one peer on to another peer that it's
+// addressed to, for peers that are using this member as a relay
+func (pc *PeerConnector) forwardPacket(from *PeerConn, packet []byte) bool {
+	dst, err := destinationIP(packet)
+
+	if err != nil {
+		return false
+	}
+
+	to, ok := pc.store.GetByInsideIp(dst)
+
+	if !ok || to == from {
+		return false
+	}
+
+	if !pc.acl.allowForward(packet, from, to) {
+		// Dropped rather than written to our tun
+		return true
+	}
+
+	msg := make([]byte, len(packet))
+	copy(msg, packet)
+
+	pc.relay(to, msg)
+
+	return true
+}
+
+// relay queues a message from one peer for another. This happens on the
+// sending peer's read loop, so rather than waiting on a slow peer and holding
+// up everything else from the sender, the message is dropped if the queue is
+// full.
+func (pc *PeerConnector) relay(to *PeerConn, msg []byte) {
+	if !to.TryQueueData(msg) {
+		atomic.AddUint64(&pc.relayDropped, 1)
+	}
+}
+
+// RelayDropped returns how many packets relayed for peers were dropped
+// because the peer they were for couldn't keep up
+func (pc *PeerConnector) RelayDropped() uint64 {
+	return atomic.LoadUint64(&pc.relayDropped)
+}
+
+func (pc *PeerConnector) onPeerClosed(peer *PeerConn) {
+	pc.relayedLock.Lock()
+	delete(pc.relayedMembers, peer)
+	pc.relayedLock.Unlock()
+
+	pc.acl.forgetPeer(peer)
+	pc.updateTunRoutes(nil, pc.routes.RemovePeer(peer))
+}
+
+// updateTunRoutes tells the kernel to send traffic for the added subnets into
+// the tun, and stop sending traffic for the removed subnets
+func (pc *PeerConnector) updateTunRoutes(added []netaddr.IPPrefix, removed []netaddr.IPPrefix) {
+	tun, ok := pc.tun.(RoutableTun)
+
+	if !ok {
+		return
+	}
+
+	for _, prefix := range added {
+		log.Info("Adding route to ", prefix)
+
+		for _, route := range kernelRoutes(prefix) {
+			if err := tun.AddRoute(route.String()); err != nil {
+				log.Warn("Error adding route to ", route, ": ", err)
+			}
+		}
+	}
+
+	for _, prefix := range removed {
+		log.Info("Removing route to ", prefix)
+
+		for _, route := range kernelRoutes(prefix) {
+			if err := tun.DelRoute(route.String()); err != nil {
+				log.Warn("Error removing route to ", route, ": ", err)
+			}
+		}
+	}
+}
+
+// onPeerFailed removes a failed peer so that it can be reconnected to, after a
+// backoff, when it next appears in a NetworkMap
+func (pc *PeerConnector) onPeerFailed(peer *PeerConn, err error) {
+	pc.store.Remove(peer)
+	delay := pc.backoff.failed(peer.outsideAddr)
+
+	log.WithFields(log.Fields{
+		"outsideAddr": peer.outsideAddr,
+		"retryIn":     delay,
+	}).Info("Removed failed peer")
+}
+
 func (pc *PeerConnector) openFirewallToPeer(addr net.Addr) error {
 	conn, err := pc.listenerDialer.Dial(addr)
-	defer conn.Close()
 
 	if err != nil {
 		log.Warn("Error connecting to peer unencrypted ", err)
 		return err
 	}
 
+	defer conn.Close()
+
 	// It doesn't really matter what is sent here - the important part is
 	// something is sent. We're effectively telling any and all (stateful)
 	// firewalls on our path to the peer to allow any future traffic that has
@@ -144,51 +749,167 @@ func (pc *PeerConnector) openFirewallToPeer(addr net.Addr) error {
 	return nil
 }
 
-func (pc *PeerConnector) newAddresses(addreses []netaddr.IPPort) {
-	for _, address := range addreses {
-		_, ok := pc.store.GetByOutsideIpPort(address)
+// commonAddrs returns the addresses of the member over the IP versions that we
+// also have a public address for, IPv6 first
+func (pc *PeerConnector) commonAddrs(member MemberAddrs) []netaddr.IPPort {
+	var addrs []netaddr.IPPort
 
-		if ok {
-			// we already know of this peer
-			continue
+	for _, address := range member.All() {
+		if !pc.myOutsideAddrs.SameFamily(address).IP.IsZero() {
+			addrs = append(addrs, address)
+		}
+	}
+
+	return addrs
+}
+
+func (pc *PeerConnector) connectedPeer(member MemberAddrs) (*PeerConn, bool) {
+	for _, address := range member.All() {
+		if peer, ok := pc.store.GetByOutsideIpPort(address); ok {
+			return peer, true
+		}
+	}
+
+	return nil, false
+}
+
+func (pc *PeerConnector) newMembers(members []MemberAddrs, myIndex int) {
+	for i, member := range members {
+		if pc.isStopped() {
+			return
 		}
 
-		if address == pc.myOutsideAddr {
+		if i == myIndex {
 			// don't connect to myself
 			continue
 		}
 
-		if pc.AmServer(address) {
-			peer := NewPeerConn(netaddr.IP{}, address, nil, pc.tun)
-			pc.store.Add(&peer)
+		peer, connected := pc.connectedPeer(member)
 
-			// As the peer will initiate connection to our dTLS server we first
-			// need to make sure our firewall(s) are open to allow the peer to
-			// contact us
-			err := pc.openFirewallToPeer(address.UDPAddr())
+		if connected && !peer.relayed {
+			// we already know of this peer
+			continue
+		}
 
-			if err != nil {
-				log.Warn("Error opening firewall: ", err)
+		// Relayed peers are kept until a direct connection to them succeeds
+
+		addrs := pc.commonAddrs(member)
 
-				// Remove the peer so we can try again later
-				pc.store.RemoveByOutsideIPPort(address)
+		if len(addrs) == 0 {
+			log.Debug("No IP version in common with ", member)
+			continue
+		}
+
+		// Both sides prefer the same IP version, so will agree on who should
+		// be the server
+		if pc.AmServer(addrs[0]) {
+			// We don't know which of our addresses the peer will be able to
+			// reach us on, so wait for it on all of them
+			for _, address := range addrs {
+				if !pc.backoff.ready(address) {
+					continue
+				}
+
+				if connected {
+					// Keep using the relayed peer while waiting to see if
+					// the peer can now reach us directly
+					pc.openFirewallToPeer(address.UDPAddr())
+				} else {
+					pc.waitForPeer(address)
+				}
 			}
 		} else {
-			log.Info("Going to try to connect to ", address)
+			direct := false
 
-			if err := pc.connectToNewPeer(address); err != nil {
-				log.Warn("Could not connect to ", address, err)
-				continue
+			for _, address := range addrs {
+				if !pc.backoff.ready(address) {
+					// we've failed to connect to this peer recently
+					continue
+				}
+
+				log.Info("Going to try to connect to ", address)
+
+				if err := pc.connectToNewPeer(address); err != nil {
+					delay := pc.backoff.failed(address)
+					log.Warn("Could not connect to ", address, ", retrying in ", delay, ": ", err)
+					continue
+				}
+
+				direct = true
+				break
+			}
+
+			if !direct && !connected && len(pc.relays) > 0 {
+				if err := pc.connectViaRelay(addrs); err != nil {
+					log.Warn("Could not connect to ", member, " through the rolodex: ", err)
+				}
 			}
 		}
 	}
 }
 
+func (pc *PeerConnector) waitForPeer(address netaddr.IPPort) {
+	peer := NewPeerConn(nil, address, nil, pc.tun)
+	pc.store.Add(&peer)
+
+	// As the peer will initiate connection to our dTLS server we first
+	// need to make sure our firewall(s) are open to allow the peer to
+	// contact us
+	err := pc.openFirewallToPeer(address.UDPAddr())
+
+	if err != nil {
+		log.Warn("Error opening firewall: ", err)
+
+		// Remove the peer so we can try again later
+		pc.store.RemoveByOutsideIPPort(address)
+		pc.backoff.failed(address)
+	}
+}
+
+// AddRelay lets members that can't be reached directly be connected to through
+// the relay. Relays must be added before ListenForPeers is called.
+func (pc *PeerConnector) AddRelay(relay *Relay) {
+	pc.relays = append(pc.relays, relay)
+}
+
+// listenForRelayedPeers accepts connections from other members through the
+// relay until it's closed
+func (pc *PeerConnector) listenForRelayedPeers(relay *Relay) {
+	for {
+		conn, err := relay.Accept()
+
+		if err != nil {
+			return
+		}
+
+		// Don't hold up other members behind a slow handshake
+		go func() {
+			meshConn, err := pc.listenerDialer.StartMesh(conn, true)
+
+			if err != nil {
+				return
+			}
+
+			pc.addPeer(meshConn, true)
+		}()
+	}
+}
+
+// ListenForPeers accepts connections from other members until Stop is called
+// and the listener is closed
 func (pc *PeerConnector) ListenForPeers() {
+	for _, relay := range pc.relays {
+		go pc.listenForRelayedPeers(relay)
+	}
+
 	for {
 		conn, err := pc.listenerDialer.AcceptMesh()
 
 		if err != nil {
+			if pc.isStopped() {
+				return
+			}
+
 			log.Warn("Error accepting: ", err)
 			continue
 		}
@@ -197,6 +918,13 @@ func (pc *PeerConnector) ListenForPeers() {
 	}
 }
 
+// Stop closes the connections to all peers, sending any data still queued for
+// them first. No new peers will be connected to after Stop has been called.
 func (pc *PeerConnector) Stop() {
-	// todo: Properly shut down all the spawned peers
+	close(pc.quit)
+
+	for _, peer := range pc.store.GetAll() {
+		pc.store.Remove(peer)
+		peer.Close()
+	}
 }
@@ -1,9 +1,16 @@
 package meshboi
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"math/big"
 	"net"
+	"reflect"
 	"testing"
+	"time"
 
+	"golang.org/x/net/ipv4"
 	"inet.af/netaddr"
 )
 
@@ -17,8 +24,8 @@ func (t testListenerDialer) DialMesh(raddr net.Addr) (MeshConn, error) {
 	c, _ := net.Pipe()
 	ip := netaddr.MustParseIP("192.168.1.1")
 	return &meshConn{
-		Conn:           c,
-		remoteMeshAddr: ip,
+		Conn:            c,
+		remoteMeshAddrs: []netaddr.IP{ip},
 	}, nil
 }
 
@@ -31,12 +38,19 @@ func (t testListenerDialer) Dial(raddr net.Addr) (net.Conn, error) {
 	return fakeConn, nil
 }
 
+func (t testListenerDialer) StartMesh(conn net.Conn, isServer bool) (MeshConn, error) {
+	return &meshConn{
+		Conn:            conn,
+		remoteMeshAddrs: []netaddr.IP{netaddr.MustParseIP("192.168.1.1")},
+	}, nil
+}
+
 func TestPeerConnector(t *testing.T) {
 	td := testListenerDialer{dialed: make(chan net.Addr)}
 	store := NewPeerConnStore()
 	client, _ := net.Pipe()
 
-	pc := NewPeerConnector(td, store, client)
+	pc := NewPeerConnector(td, store, NewRouteTable(), client)
 
 	nm := NetworkMap{
 		Addresses: []netaddr.IPPort{netaddr.MustParseIPPort("192.168.33.1:3000"),
@@ -52,3 +66,372 @@ func TestPeerConnector(t *testing.T) {
 		t.Fatalf("Dialed wrong address")
 	}
 }
+
+func TestFailedPeerRemovedAndBackedOff(t *testing.T) {
+	td := testListenerDialer{dialed: make(chan net.Addr, 1)}
+	store := NewPeerConnStore()
+	client, _ := net.Pipe()
+
+	pc := NewPeerConnector(td, store, NewRouteTable(), client)
+
+	peer := NewFakePeerConn("192.168.1.2", "192.168.33.2:4000")
+	store.Add(peer)
+
+	pc.onPeerFailed(peer, errors.New("test failure"))
+
+	if _, ok := store.GetByOutsideIpPort(peer.outsideAddr); ok {
+		t.Fatalf("Failed peer wasn't removed")
+	}
+
+	nm := NetworkMap{
+		Addresses: []netaddr.IPPort{netaddr.MustParseIPPort("192.168.33.1:3000"),
+			netaddr.MustParseIPPort("192.168.33.2:4000")},
+		YourIndex: 0,
+	}
+
+	pc.OnNetworkMapUpdate(nm)
+
+	select {
+	case <-td.dialed:
+		t.Fatalf("Failed peer was redialed before its backoff expired")
+	default:
+	}
+}
+
+func TestPeerConnectorPrefersIPv6(t *testing.T) {
+	td := testListenerDialer{dialed: make(chan net.Addr)}
+	store := NewPeerConnStore()
+	client, _ := net.Pipe()
+
+	pc := NewPeerConnector(td, store, NewRouteTable(), client)
+
+	nm := NetworkMap{
+		Members: []MemberAddrs{
+			{IPv4: netaddr.MustParseIPPort("192.168.33.1:3000"), IPv6: netaddr.MustParseIPPort("[2001:db8::1]:3000")},
+			{IPv4: netaddr.MustParseIPPort("192.168.33.2:4000"), IPv6: netaddr.MustParseIPPort("[2001:db8::2]:4000")},
+		},
+		YourIndex: 0,
+	}
+
+	go pc.OnNetworkMapUpdate(nm)
+
+	dialed := <-td.dialed
+
+	if dialed.String() != "[2001:db8::2]:4000" {
+		t.Fatalf("Dialed wrong address %v", dialed)
+	}
+}
+
+type fakeRoutableTun struct {
+	FakeTun
+	added []string
+}
+
+func (f *fakeRoutableTun) AddRoute(prefix string) error {
+	f.added = append(f.added, prefix)
+	return nil
+}
+
+func (f *fakeRoutableTun) DelRoute(prefix string) error {
+	return nil
+}
+
+// Tests that a default route is only used when it's advertised by the chosen
+// exit node
+func TestExitNodeDefaultRoute(t *testing.T) {
+	td := testListenerDialer{dialed: make(chan net.Addr, 1)}
+	store := NewPeerConnStore()
+	routes := NewRouteTable()
+	tun := &fakeRoutableTun{}
+
+	pc := NewPeerConnector(td, store, routes, tun)
+
+	exitNode := NewFakePeerConn(tests[0].insideIP, tests[0].outsideIP)
+	other := NewFakePeerConn(tests[1].insideIP, tests[1].outsideIP)
+	internetIP := netaddr.MustParseIP("8.8.8.8")
+
+	pc.onPeerRoutes(other, []netaddr.IPPrefix{defaultRoute})
+
+	if _, ok := routes.Lookup(internetIP); ok {
+		t.Fatalf("Used default route from a peer that isn't an exit node")
+	}
+
+	pc.UseExitNode(exitNode.insideIPs[0], nil)
+	pc.onPeerRoutes(exitNode, []netaddr.IPPrefix{defaultRoute})
+
+	if peer, ok := routes.Lookup(internetIP); !ok || peer != exitNode {
+		t.Fatalf("Default route wasn't through the exit node")
+	}
+
+	if len(tun.added) != 2 || tun.added[0] != "0.0.0.0/1" || tun.added[1] != "128.0.0.0/1" {
+		t.Fatalf("Unexpected kernel routes %v", tun.added)
+	}
+}
+
+// Tests that a direct connection replaces a relayed one, but not the other way
+// around
+func TestDirectConnectionReplacesRelayed(t *testing.T) {
+	td := testListenerDialer{dialed: make(chan net.Addr, 1)}
+	store := NewPeerConnStore()
+	client, _ := net.Pipe()
+
+	pc := NewPeerConnector(td, store, NewRouteTable(), client)
+	defer pc.Stop()
+
+	outsideAddr := &net.UDPAddr{IP: net.ParseIP("192.168.33.2"), Port: 4000}
+	newConn := func() MeshConn {
+		c, _ := net.Pipe()
+		return &meshConn{
+			Conn:            fakeRolodexConn{Conn: c, addr: outsideAddr},
+			remoteMeshAddrs: []netaddr.IP{netaddr.MustParseIP("192.168.1.1")},
+		}
+	}
+
+	if err := pc.addPeer(newConn(), true); err != nil {
+		t.Fatal("Error adding relayed peer: ", err)
+	}
+
+	relayed, _ := store.GetByOutsideIpPort(netaddr.MustParseIPPort(outsideAddr.String()))
+
+	if err := pc.OnNewPeerConnection(newConn()); err != nil {
+		t.Fatal("Error adding direct peer: ", err)
+	}
+
+	direct, _ := store.GetByOutsideIpPort(netaddr.MustParseIPPort(outsideAddr.String()))
+
+	if direct == relayed || direct.relayed {
+		t.Fatalf("Direct peer didn't replace relayed peer")
+	}
+
+	if !relayed.isClosed() {
+		t.Fatalf("Relayed peer wasn't closed")
+	}
+
+	if err := pc.addPeer(newConn(), true); err == nil {
+		t.Fatalf("Relayed peer replaced direct peer")
+	}
+}
+
+// Tests that a relay forwards packets between peers and tells peers who it
+// can relay to
+func TestRelayForPeers(t *testing.T) {
+	td := testListenerDialer{dialed: make(chan net.Addr, 1)}
+	store := NewPeerConnStore()
+	client, _ := net.Pipe()
+
+	pc := NewPeerConnector(td, store, NewRouteTable(), client)
+	pc.RelayForPeers()
+
+	from := NewFakePeerConn(tests[0].insideIP, tests[0].outsideIP)
+	to := NewFakePeerConn(tests[1].insideIP, tests[1].outsideIP)
+	store.Add(from)
+	store.Add(to)
+
+	hdr := ipv4.Header{
+		Src:     net.ParseIP(tests[0].insideIP),
+		Dst:     net.ParseIP(tests[1].insideIP),
+		Len:     20,
+		Version: 4,
+	}
+
+	packet, _ := hdr.Marshal()
+
+	if !pc.forwardPacket(from, packet) {
+		t.Fatalf("Packet wasn't forwarded")
+	}
+
+	if forwarded := <-to.outgoing; !reflect.DeepEqual(forwarded, packet) {
+		t.Fatalf("Wrong packet forwarded %v", forwarded)
+	}
+
+	// Packets for the relay itself aren't forwarded
+	hdr.Dst = net.ParseIP("192.168.4.200")
+	packet, _ = hdr.Marshal()
+
+	if pc.forwardPacket(from, packet) {
+		t.Fatalf("Packet for the relay was forwarded")
+	}
+
+	announcements := pc.currentAnnouncements()
+
+	if len(announcements) != 1 || announcements[0][0] != relayedMembersMessage {
+		t.Fatalf("Expected relayed members to be announced %v", announcements)
+	}
+
+	ips, _ := parseRelayedMembersMessage(announcements[0])
+
+	if len(ips) != 2 {
+		t.Fatalf("Expected both peers to be relayed to %v", ips)
+	}
+
+	// Probes are passed on, but only from the peer they say they're from
+	probe := relayProbe{From: from.insideIPs[0], To: to.insideIPs[0], Nonce: []byte("nonce")}
+	pc.onPeerRelayProbe(to, probe)
+	pc.onPeerRelayProbe(from, probe)
+
+	if forwarded := <-to.outgoing; forwarded[0] != relayProbeMessage {
+		t.Fatalf("Probe wasn't forwarded %v", forwarded)
+	}
+
+	select {
+	case msg := <-to.outgoing:
+		t.Fatalf("Forwarded a probe from the wrong peer %v", msg)
+	default:
+	}
+
+	// A peer that can't keep up has packets dropped rather than holding up
+	// the peer sending them
+	hdr.Dst = net.ParseIP(tests[1].insideIP)
+	packet, _ = hdr.Marshal()
+
+	for i := 0; i <= outgoingQueueLen; i++ {
+		pc.forwardPacket(from, packet)
+	}
+
+	if dropped := pc.RelayDropped(); dropped != 1 {
+		t.Fatalf("Expected 1 packet to be dropped but got %v", dropped)
+	}
+}
+
+// Tests that members offered by a relay are only routed to once they've
+// answered a probe through it
+func TestRelayedMembersProven(t *testing.T) {
+	td := testListenerDialer{dialed: make(chan net.Addr, 1)}
+	client, _ := net.Pipe()
+	routes := NewRouteTable()
+	networkPublic, networkKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	prover := newRelayProver([]netaddr.IP{netaddr.MustParseIP("192.168.4.1")})
+	prover.networkKey = networkPublic
+	prover.credentials, _ = IssueMembership(networkKey, prover.vpnIPs)
+
+	pc := NewPeerConnector(td, NewPeerConnStore(), routes, client)
+	pc.UseRelayProver(prover)
+
+	relay := NewFakePeerConn("192.168.4.2", "1.1.1.1:2000")
+	memberIP := netaddr.MustParseIP("192.168.4.3")
+	pc.onPeerRelayedMembers(relay, []netaddr.IP{memberIP, prover.vpnIPs[0]})
+
+	if _, ok := routes.Lookup(memberIP); ok {
+		t.Fatalf("Member was routed to before answering a probe")
+	}
+
+	probe, err := parseRelayProbeMessage(<-relay.outgoing)
+
+	if err != nil || probe.To != memberIP {
+		t.Fatalf("Expected a probe to the member %v %v", probe, err)
+	}
+
+	// Only the member can answer the probe
+	impostor := newRelayProver([]netaddr.IP{netaddr.MustParseIP("192.168.4.4")})
+	impostor.credentials, _ = IssueMembership(networkKey, impostor.vpnIPs)
+	forged, _ := impostor.answer(probe)
+	forged.From = memberIP
+	pc.onPeerRelayProof(relay, forged)
+
+	if _, ok := routes.Lookup(memberIP); ok {
+		t.Fatalf("Member was routed to after a forged proof")
+	}
+
+	member := newRelayProver([]netaddr.IP{memberIP})
+	member.credentials, _ = IssueMembership(networkKey, member.vpnIPs)
+	proof, _ := member.answer(probe)
+	pc.onPeerRelayProof(relay, proof)
+
+	if peer, ok := routes.Lookup(memberIP); !ok || peer != relay {
+		t.Fatalf("Member wasn't routed to through the relay")
+	}
+
+	select {
+	case msg := <-relay.outgoing:
+		t.Fatalf("Probed ourselves %v", msg)
+	default:
+	}
+}
+
+// Tests that peers are refused once their certificate is revoked, and that
+// peers that are already connected are disconnected
+func TestRevokedPeersDisconnected(t *testing.T) {
+	td := testListenerDialer{dialed: make(chan net.Addr, 1)}
+	store := NewPeerConnStore()
+	client, _ := net.Pipe()
+	ca := newTestCA(t)
+
+	pc := NewPeerConnector(td, store, NewRouteTable(), client)
+	defer pc.Stop()
+
+	revocations := NewRevocationList(ca.cert)
+	pc.UseRevocationList(revocations)
+
+	revoked := testIdentity(t, ca, "192.168.1.1")
+	kept := testIdentity(t, ca, "192.168.1.2")
+
+	newConn := func(identity *CertIdentity, port int) MeshConn {
+		c, _ := net.Pipe()
+		return &meshConn{
+			Conn:            fakeRolodexConn{Conn: c, addr: &net.UDPAddr{IP: net.ParseIP("192.168.33.2"), Port: port}},
+			remoteMeshAddrs: identity.VpnIPs,
+			remoteIdentity:  identity,
+		}
+	}
+
+	if err := pc.OnNewPeerConnection(newConn(revoked, 4000)); err != nil {
+		t.Fatal("Error adding peer: ", err)
+	}
+
+	if err := pc.OnNewPeerConnection(newConn(kept, 4001)); err != nil {
+		t.Fatal("Error adding peer: ", err)
+	}
+
+	revokedPeer, _ := store.GetByInsideIp(revoked.VpnIPs[0])
+
+	crl, _ := RevokeCerts(ca.cert, ca.key, nil, []*big.Int{revoked.Serial}, time.Hour)
+	revocations.Update(crl)
+
+	if _, ok := store.GetByInsideIp(revoked.VpnIPs[0]); ok || !revokedPeer.isClosed() {
+		t.Fatalf("Revoked peer wasn't disconnected")
+	}
+
+	if _, ok := store.GetByInsideIp(kept.VpnIPs[0]); !ok {
+		t.Fatalf("Peer that wasn't revoked was disconnected")
+	}
+
+	if err := pc.OnNewPeerConnection(newConn(revoked, 4002)); err == nil {
+		t.Fatalf("Revoked peer was able to connect")
+	}
+}
+
+// Tests that rolling the PSK forward reconnects only the peers using the old
+// PSK
+func TestReconnectOlderPSKs(t *testing.T) {
+	td := testListenerDialer{dialed: make(chan net.Addr, 1)}
+	store := NewPeerConnStore()
+	client, _ := net.Pipe()
+
+	pc := NewPeerConnector(td, store, NewRouteTable(), client)
+	defer pc.Stop()
+
+	newConn := func(vpnIP string, port int, pskID uint32) MeshConn {
+		c, _ := net.Pipe()
+		return &meshConn{
+			Conn:            fakeRolodexConn{Conn: c, addr: &net.UDPAddr{IP: net.ParseIP("192.168.33.2"), Port: port}},
+			remoteMeshAddrs: []netaddr.IP{netaddr.MustParseIP(vpnIP)},
+			pskID:           pskID,
+		}
+	}
+
+	pc.OnNewPeerConnection(newConn("192.168.1.1", 4000, 0))
+	pc.OnNewPeerConnection(newConn("192.168.1.2", 4001, 1))
+
+	old, _ := store.GetByInsideIp(netaddr.MustParseIP("192.168.1.1"))
+
+	pc.ReconnectOlderPSKs(1)
+
+	if _, ok := store.GetByInsideIp(netaddr.MustParseIP("192.168.1.1")); ok || !old.isClosed() {
+		t.Fatalf("Peer using the old PSK wasn't disconnected")
+	}
+
+	if _, ok := store.GetByInsideIp(netaddr.MustParseIP("192.168.1.2")); !ok {
+		t.Fatalf("Peer using the new PSK was disconnected")
+	}
+}
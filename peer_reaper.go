@@ -0,0 +1,71 @@
+package meshboi
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PeerReaper periodically evicts peers that haven't been heard from within a
+// timeout. Once evicted, the next NetworkMap from the rolodex will cause a
+// fresh connection to be made to the peer if it's still part of the mesh.
+type PeerReaper struct {
+	store    *PeerConnStore
+	timeout  time.Duration
+	interval time.Duration
+	quit     chan struct{}
+}
+
+// MinPeerTimeout is the shortest timeout that lets a peer miss a keep alive
+// before it's evicted. Shorter timeouts would evict healthy peers.
+const MinPeerTimeout = 2 * keepAliveInterval
+
+func NewPeerReaper(store *PeerConnStore, timeout time.Duration) PeerReaper {
+	if timeout < MinPeerTimeout {
+		log.Warn("Peer timeout of ", timeout, " is too short, using ", MinPeerTimeout)
+		timeout = MinPeerTimeout
+	}
+
+	return PeerReaper{
+		store:    store,
+		timeout:  timeout,
+		interval: timeout / 2,
+		quit:     make(chan struct{}),
+	}
+}
+
+func (r *PeerReaper) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.reap()
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+func (r *PeerReaper) reap() {
+	now := time.Now()
+
+	for _, peer := range r.store.GetAll() {
+		if now.Sub(peer.LastContacted()) <= r.timeout {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"insideIPs":   peer.insideIPs,
+			"outsideAddr": peer.outsideAddr,
+		}).Info("Evicting peer due to inactivity")
+
+		r.store.Remove(peer)
+		peer.Close()
+	}
+}
+
+func (r *PeerReaper) Stop() {
+	close(r.quit)
+}
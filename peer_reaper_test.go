@@ -0,0 +1,51 @@
+package meshboi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReaperEvictsIdlePeers(t *testing.T) {
+	store := NewPeerConnStore()
+	reaper := NewPeerReaper(store, time.Minute)
+
+	idle := NewFakePeerConn(tests[0].insideIP, tests[0].outsideIP)
+	idle.lastContacted = time.Now().Add(-2 * time.Minute)
+	store.Add(idle)
+
+	active := NewFakePeerConn(tests[1].insideIP, tests[1].outsideIP)
+	store.Add(active)
+
+	reaper.reap()
+
+	if _, ok := store.GetByOutsideIpPort(idle.outsideAddr); ok {
+		t.Errorf("Idle peer wasn't evicted")
+	}
+
+	if _, ok := store.GetByInsideIp(idle.insideIPs[0]); ok {
+		t.Errorf("Idle peer wasn't evicted by inside IP")
+	}
+
+	if !idle.isClosed() {
+		t.Errorf("Idle peer wasn't closed")
+	}
+
+	if _, ok := store.GetByOutsideIpPort(active.outsideAddr); !ok {
+		t.Errorf("Active peer was evicted")
+	}
+
+	if active.isClosed() {
+		t.Errorf("Active peer was closed")
+	}
+}
+
+// Tests that timeouts too short to hear a keep alive in are lengthened
+func TestReaperMinimumTimeout(t *testing.T) {
+	for _, timeout := range []time.Duration{0, -time.Second, keepAliveInterval} {
+		reaper := NewPeerReaper(NewPeerConnStore(), timeout)
+
+		if reaper.timeout != MinPeerTimeout || reaper.interval <= 0 {
+			t.Errorf("Timeout of %v gave %v with interval %v", timeout, reaper.timeout, reaper.interval)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package meshboi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The Argon2id parameters used to derive the PSK, which follow the second
+// recommended option of RFC 9106. The derivation is only done once at start
+// up so it can afford to be slow.
+const (
+	pskArgonTime    = 3
+	pskArgonMemory  = 64 * 1024
+	pskArgonThreads = 4
+	pskLen          = 32
+)
+
+// DerivePSK stretches the passphrase into the key used for DTLS. The network
+// name salts the key so that the same passphrase used for different networks
+// gives different keys. Members from before PSKs were derived use the
+// passphrase as the key, so can't connect to members using a derived key.
+func DerivePSK(passphrase []byte, networkName string) []byte {
+	// Argon2 wants salts of at least 16 bytes, which network names often
+	// aren't, so hash the name to get the salt
+	salt := sha256.Sum256([]byte("meshboi-psk:" + networkName))
+
+	return argon2.IDKey(passphrase, salt[:], pskArgonTime, pskArgonMemory, pskArgonThreads, pskLen)
+}
+
+// PSKRing holds the PSKs that handshakes can use, each with an ID that's sent
+// in the PSK identity hint. New PSKs are added to every member's ring before
+// any member rolls forward to them, so that members that have rolled can
+// still connect to members that haven't yet.
+type PSKRing struct {
+	keys map[uint32][]byte
+	// The ID of the PSK this member uses
+	current uint32
+	// Whether the PSK with ID 0 is used without being derived, so that
+	// members connected with it may be older members
+	legacy bool
+}
+
+// NewPSKRing makes a ring with a single PSK. The ID 0 is used by members
+// without a ring, so a ring with just a PSK of ID 0 works with them.
+func NewPSKRing(id uint32, key []byte) *PSKRing {
+	return &PSKRing{keys: map[uint32][]byte{id: key}, current: id}
+}
+
+// Current returns the ID of the PSK this member uses
+func (r *PSKRing) Current() uint32 {
+	return r.current
+}
+
+// key returns the PSK to use with a member that uses the PSK with peerID.
+// Both sides pick the newest of the two PSKs, which the side that hasn't
+// rolled forward yet has as its next PSK.
+func (r *PSKRing) key(peerID uint32) ([]byte, error) {
+	id := negotiatedPSKID(r.current, peerID)
+	key, ok := r.keys[id]
+
+	if !ok {
+		return nil, fmt.Errorf("no PSK with ID %v", id)
+	}
+
+	return key, nil
+}
+
+// handshakePSKID returns the ID of the PSK that a handshake between members
+// with the given identity hints used
+func handshakePSKID(ourHint []byte, peerHint []byte) (uint32, error) {
+	ourID, err := parsePSKID(ourHint)
+
+	if err != nil {
+		return 0, err
+	}
+
+	peerID, err := parsePSKID(peerHint)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return negotiatedPSKID(ourID, peerID), nil
+}
+
+func negotiatedPSKID(ourID uint32, peerID uint32) uint32 {
+	if peerID > ourID {
+		return peerID
+	}
+
+	return ourID
+}
+
+// PSKRingFile is how a PSKRing is stored. The passphrases are kept rather
+// than the keys, as the keys depend on the network name.
+type PSKRingFile struct {
+	Current     uint32
+	Passphrases map[uint32]string
+	// Legacy uses the passphrase with ID 0 as the key, without deriving it,
+	// as members from before PSKs were derived do. Once every member has the
+	// ring, rolling forward moves the network to a derived key.
+	Legacy bool `json:",omitempty"`
+}
+
+// NewPSKRingFile starts a ring with the passphrase, or a random passphrase if
+// it's empty. The passphrase has the ID 0 so that the ring can be used by some
+// members while others still use the passphrase directly.
+func NewPSKRingFile(passphrase string) (*PSKRingFile, error) {
+	if passphrase == "" {
+		var err error
+		passphrase, err = randomPassphrase()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &PSKRingFile{Passphrases: map[uint32]string{0: passphrase}}, nil
+}
+
+func randomPassphrase() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// next returns the ID of the PSK after the current one, if there is one
+func (f *PSKRingFile) next() (uint32, bool) {
+	found := false
+	var next uint32
+
+	for id := range f.Passphrases {
+		if id > f.Current && (!found || id < next) {
+			next = id
+			found = true
+		}
+	}
+
+	return next, found
+}
+
+// AddNext adds a random passphrase to the ring to be rolled forward to later,
+// returning its ID
+func (f *PSKRingFile) AddNext() (uint32, error) {
+	if _, ok := f.next(); ok {
+		return 0, errors.New("ring already has a next PSK")
+	}
+
+	passphrase, err := randomPassphrase()
+
+	if err != nil {
+		return 0, err
+	}
+
+	id := f.Current + 1
+	f.Passphrases[id] = passphrase
+
+	return id, nil
+}
+
+// Roll moves the ring forward to the next PSK and forgets about the older
+// ones, returning the ID of the new current PSK
+func (f *PSKRingFile) Roll() (uint32, error) {
+	next, ok := f.next()
+
+	if !ok {
+		return 0, errors.New("ring has no next PSK to roll forward to")
+	}
+
+	for id := range f.Passphrases {
+		if id < next {
+			delete(f.Passphrases, id)
+		}
+	}
+
+	f.Current = next
+	// The only underived passphrase has been forgotten
+	f.Legacy = false
+
+	return next, nil
+}
+
+// Ring derives the keys of the ring for the network
+func (f *PSKRingFile) Ring(networkName string) (*PSKRing, error) {
+	if _, ok := f.Passphrases[f.Current]; !ok {
+		return nil, fmt.Errorf("ring has no passphrase for its current ID %v", f.Current)
+	}
+
+	_, hasLegacy := f.Passphrases[0]
+	ring := &PSKRing{keys: make(map[uint32][]byte, len(f.Passphrases)), current: f.Current, legacy: f.Legacy && hasLegacy}
+
+	for id, passphrase := range f.Passphrases {
+		if id == 0 && f.Legacy {
+			ring.keys[id] = []byte(passphrase)
+			continue
+		}
+
+		ring.keys[id] = DerivePSK([]byte(passphrase), networkName)
+	}
+
+	return ring, nil
+}
+
+func LoadPSKRingFile(path string) (*PSKRingFile, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var f PSKRingFile
+
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (f *PSKRingFile) Save(path string) error {
+	b, err := json.MarshalIndent(f, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0600)
+}
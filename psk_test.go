@@ -0,0 +1,187 @@
+package meshboi
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/pion/dtls/v2"
+	"inet.af/netaddr"
+)
+
+func TestDerivePSK(t *testing.T) {
+	key := DerivePSK([]byte("testpassword"), "network")
+
+	if len(key) != pskLen {
+		t.Fatalf("Expected a %v byte key but got %v bytes", pskLen, len(key))
+	}
+
+	if !bytes.Equal(key, DerivePSK([]byte("testpassword"), "network")) {
+		t.Fatalf("Same passphrase and network gave different keys")
+	}
+
+	if bytes.Equal(key, DerivePSK([]byte("testpassword"), "othernetwork")) {
+		t.Fatalf("Same passphrase on different networks gave the same key")
+	}
+
+	if bytes.Equal(key, DerivePSK([]byte("otherpassword"), "network")) {
+		t.Fatalf("Different passphrases gave the same key")
+	}
+
+	if bytes.Equal(key, []byte("testpassword")) {
+		t.Fatalf("Passphrase used as the key")
+	}
+}
+
+func TestPSKRingFileRoll(t *testing.T) {
+	ringFile, err := NewPSKRingFile("testpassword")
+
+	if err != nil {
+		t.Fatal("Error creating ring: ", err)
+	}
+
+	if _, err := ringFile.Roll(); err == nil {
+		t.Fatalf("Rolled forward without a next PSK")
+	}
+
+	next, err := ringFile.AddNext()
+
+	if err != nil || next != 1 {
+		t.Fatalf("Expected to add PSK 1 but got %v %v", next, err)
+	}
+
+	if _, err := ringFile.AddNext(); err == nil {
+		t.Fatalf("Added a second next PSK")
+	}
+
+	before, _ := ringFile.Ring("network")
+
+	if before.Current() != 0 {
+		t.Fatalf("Ring rolled forward when a PSK was added")
+	}
+
+	if rolled, err := ringFile.Roll(); err != nil || rolled != 1 {
+		t.Fatalf("Expected to roll to PSK 1 but got %v %v", rolled, err)
+	}
+
+	if _, ok := ringFile.Passphrases[0]; ok {
+		t.Fatalf("Old PSK kept after rolling")
+	}
+
+	after, _ := ringFile.Ring("network")
+
+	// A member that has rolled and one that hasn't should agree on the new PSK
+	beforeKey, err := before.key(after.Current())
+
+	if err != nil {
+		t.Fatal("Member that hasn't rolled has no key for member that has: ", err)
+	}
+
+	afterKey, _ := after.key(before.Current())
+
+	if !bytes.Equal(beforeKey, afterKey) {
+		t.Fatalf("Members picked different PSKs")
+	}
+}
+
+func TestPSKRingFileLegacy(t *testing.T) {
+	ringFile, _ := NewPSKRingFile("testpassword")
+	ringFile.Legacy = true
+	ringFile.AddNext()
+
+	ring, err := ringFile.Ring("network")
+
+	if err != nil {
+		t.Fatal("Error making ring: ", err)
+	}
+
+	if key, _ := ring.key(0); !bytes.Equal(key, []byte("testpassword")) {
+		t.Fatalf("Legacy PSK was derived")
+	}
+
+	if key, _ := ring.key(1); !bytes.Equal(key, DerivePSK([]byte(ringFile.Passphrases[1]), "network")) {
+		t.Fatalf("Next PSK wasn't derived")
+	}
+
+	ringFile.Roll()
+
+	if ringFile.Legacy {
+		t.Fatalf("Ring still legacy after rolling off the legacy PSK")
+	}
+}
+
+// handshake connects members with the given configs, returning the conns
+// from both sides
+func handshake(t *testing.T, serverConfig *dtls.Config, clientConfig *dtls.Config) (MeshConn, MeshConn, error) {
+	localhost := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+	server, err := NewMultiplexedDTLSConn(localhost, serverConfig)
+
+	if err != nil {
+		t.Fatal("Error creating server: ", err)
+	}
+
+	t.Cleanup(func() { server.Close() })
+
+	client, err := NewMultiplexedDTLSConn(localhost, clientConfig)
+
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	accepted := make(chan MeshConn, 1)
+
+	go func() {
+		conn, err := server.AcceptMesh()
+
+		if err != nil {
+			conn = nil
+		}
+
+		accepted <- conn
+	}()
+
+	clientConn, err := client.DialMesh(server.listener.Addr())
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t.Cleanup(func() { clientConn.Close() })
+
+	serverConn := <-accepted
+
+	if serverConn != nil {
+		t.Cleanup(func() { serverConn.Close() })
+	}
+
+	return serverConn, clientConn, nil
+}
+
+// Tests that a member that has rolled forward to a new PSK can still connect
+// to a member that has only added it
+func TestPSKRingHandshake(t *testing.T) {
+	oldKey := []byte("oldpassword")
+	newKey := []byte("newpassword")
+	serverIP := []netaddr.IP{netaddr.MustParseIP("192.168.50.1")}
+	clientIP := []netaddr.IP{netaddr.MustParseIP("192.168.50.2")}
+
+	rolled := &PSKRing{keys: map[uint32][]byte{1: newKey}, current: 1}
+	added := &PSKRing{keys: map[uint32][]byte{0: oldKey, 1: newKey}, current: 0}
+
+	serverConn, clientConn, err := handshake(t, getDtlsConfig(serverIP, rolled, nil), getDtlsConfig(clientIP, added, nil))
+
+	if err != nil || serverConn == nil {
+		t.Fatal("Members couldn't connect: ", err)
+	}
+
+	if serverConn.PSKID() != 1 || clientConn.PSKID() != 1 {
+		t.Fatalf("Expected both sides to use PSK 1 but got %v and %v", serverConn.PSKID(), clientConn.PSKID())
+	}
+
+	if !reflect.DeepEqual(serverConn.RemoteMeshAddrs(), clientIP) {
+		t.Fatalf("Server got client VPN IPs %v", serverConn.RemoteMeshAddrs())
+	}
+}
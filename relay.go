@@ -0,0 +1,300 @@
+package meshboi
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"inet.af/netaddr"
+)
+
+const (
+	// How many datagrams can be waiting to be read from a relayed conn before
+	// new ones are dropped
+	relayQueueLen = 64
+	// How many relayed conns can be waiting to be accepted
+	relayBacklog = 16
+)
+
+var errRelayClosed = errors.New("relay closed")
+
+type relayTimeoutError struct{}
+
+func (relayTimeoutError) Error() string   { return "relay read timeout" }
+func (relayTimeoutError) Timeout() bool   { return true }
+func (relayTimeoutError) Temporary() bool { return true }
+
+// Relay carries datagrams to and from members that we can't reach directly by
+// sending them through the rolodex. The datagrams are still DTLS records so the
+// rolodex can't read or tamper with the traffic between members.
+type Relay struct {
+	conn   net.Conn
+	family netaddr.IPPort
+	conns  map[netaddr.IPPort]*relayConn
+	lock   sync.Mutex
+	accept chan *relayConn
+	quit   chan struct{}
+}
+
+// NewRelay makes a relay through the rolodex on the other side of the conn
+func NewRelay(rolodexConn net.Conn) (*Relay, error) {
+	rolodexAddr, err := netaddr.ParseIPPort(rolodexConn.RemoteAddr().String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Relay{
+		conn:   rolodexConn,
+		family: rolodexAddr,
+		conns:  make(map[netaddr.IPPort]*relayConn),
+		accept: make(chan *relayConn, relayBacklog),
+		quit:   make(chan struct{}),
+	}, nil
+}
+
+// CanReach reports whether the member address is of the same IP version as
+// the rolodex, which is the only way the rolodex knows the member by
+func (r *Relay) CanReach(addr netaddr.IPPort) bool {
+	return addr.IP.Is4() == r.family.IP.Is4()
+}
+
+// Dial returns a conn to the member at addr through the rolodex
+func (r *Relay) Dial(addr netaddr.IPPort) (net.Conn, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.isClosed() {
+		return nil, errRelayClosed
+	}
+
+	if _, ok := r.conns[addr]; ok {
+		return nil, errors.New("relayed conn already exists")
+	}
+
+	return r.newConn(addr), nil
+}
+
+// Accept waits for a member to start a DTLS handshake with us through the
+// rolodex
+func (r *Relay) Accept() (net.Conn, error) {
+	select {
+	case conn := <-r.accept:
+		return conn, nil
+	case <-r.quit:
+		return nil, errRelayClosed
+	}
+}
+
+// HandleFrame passes a relay frame received from the rolodex to the conn it's
+// for. Frames from members we have no conn with are only accepted if they
+// start a DTLS handshake.
+func (r *Relay) HandleFrame(frame []byte) {
+	src, payload, err := parseRelayFrame(frame)
+
+	if err != nil {
+		log.Warn("Error parsing relay frame: ", err)
+		return
+	}
+
+	r.lock.Lock()
+	conn, ok := r.conns[src]
+
+	if !ok && !r.isClosed() && isDtlsHandshake(payload) {
+		conn = r.newConn(src)
+
+		select {
+		case r.accept <- conn:
+			ok = true
+		default:
+			log.Warn("Dropping relayed connection from ", src, " as too many are waiting")
+			delete(r.conns, src)
+		}
+	}
+	r.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// The frame is read into a buffer that gets reused, so take a copy
+	packet := append([]byte(nil), payload...)
+
+	select {
+	case conn.incoming <- packet:
+	default:
+		// Like any other UDP socket, drop packets that can't be read in time
+	}
+}
+
+// newConn must be called with the lock held
+func (r *Relay) newConn(addr netaddr.IPPort) *relayConn {
+	conn := &relayConn{
+		relay:           r,
+		remoteAddr:      addr,
+		incoming:        make(chan []byte, relayQueueLen),
+		closed:          make(chan struct{}),
+		deadlineChanged: make(chan struct{}, 1),
+	}
+
+	r.conns[addr] = conn
+
+	return conn
+}
+
+func (r *Relay) remove(conn *relayConn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.conns[conn.remoteAddr] == conn {
+		delete(r.conns, conn.remoteAddr)
+	}
+}
+
+func (r *Relay) isClosed() bool {
+	select {
+	case <-r.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes all relayed conns. The conn to the rolodex is left for the
+// RolodexClient to close.
+func (r *Relay) Close() {
+	r.lock.Lock()
+
+	if r.isClosed() {
+		r.lock.Unlock()
+		return
+	}
+
+	close(r.quit)
+	conns := make([]*relayConn, 0, len(r.conns))
+
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// relayConn is a net.Conn to a single member through the rolodex
+type relayConn struct {
+	relay      *Relay
+	remoteAddr netaddr.IPPort
+	incoming   chan []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	readDeadline    time.Time
+	deadlineLock    sync.Mutex
+	deadlineChanged chan struct{}
+}
+
+func (c *relayConn) Read(p []byte) (int, error) {
+	for {
+		c.deadlineLock.Lock()
+		deadline := c.readDeadline
+		c.deadlineLock.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+
+			if remaining <= 0 {
+				return 0, relayTimeoutError{}
+			}
+
+			timer = time.NewTimer(remaining)
+			timeout = timer.C
+		}
+
+		var n int
+		var err error
+		retry := false
+
+		select {
+		case packet := <-c.incoming:
+			n = copy(p, packet)
+		case <-timeout:
+			err = relayTimeoutError{}
+		case <-c.deadlineChanged:
+			retry = true
+		case <-c.closed:
+			err = errRelayClosed
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if !retry {
+			return n, err
+		}
+	}
+}
+
+func (c *relayConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errRelayClosed
+	default:
+	}
+
+	if _, err := c.relay.conn.Write(newRelayFrame(c.remoteAddr, p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *relayConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.relay.remove(c)
+	})
+
+	return nil
+}
+
+func (c *relayConn) LocalAddr() net.Addr {
+	return c.relay.conn.LocalAddr()
+}
+
+// RemoteAddr is the address the rolodex knows the member by, which is the same
+// address a direct connection to the member would use
+func (c *relayConn) RemoteAddr() net.Addr {
+	return c.remoteAddr.UDPAddr()
+}
+
+func (c *relayConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *relayConn) SetReadDeadline(t time.Time) error {
+	c.deadlineLock.Lock()
+	c.readDeadline = t
+	c.deadlineLock.Unlock()
+
+	// Wake up a pending read so that it uses the new deadline
+	select {
+	case c.deadlineChanged <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// SetWriteDeadline is a no-op as writes to the rolodex don't block
+func (c *relayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
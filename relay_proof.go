@@ -0,0 +1,205 @@
+package meshboi
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"inet.af/netaddr"
+)
+
+// What relay proofs sign, so a signature can't be reused for anything else
+const relayProofLabel = "meshboi-relay-proof"
+
+// relayProbe is sent through a relay to a member that the relay offers to
+// relay to. Routes to the member through the relay are only used once the
+// member has answered, so a peer can't take the traffic of members it can't
+// reach.
+type relayProbe struct {
+	From  netaddr.IP
+	To    netaddr.IP
+	Nonce []byte
+}
+
+// relayProof answers a relayProbe. Members with a certificate or membership
+// include it, along with a signature over the probe, to prove that they're
+// the member the probe was for.
+type relayProof struct {
+	From        netaddr.IP
+	To          netaddr.IP
+	Nonce       []byte
+	Certificate []byte            `json:",omitempty"`
+	Membership  *SignedMembership `json:",omitempty"`
+	Signature   []byte            `json:",omitempty"`
+}
+
+// signed returns the bytes that the member signs
+func (p relayProof) signed() []byte {
+	from, to := p.From.As16(), p.To.As16()
+	b := append([]byte(relayProofLabel), from[:]...)
+	b = append(b, to[:]...)
+
+	return append(b, p.Nonce...)
+}
+
+// relayProver answers the probes sent to us through relays, and checks the
+// answers to the probes we send through them
+type relayProver struct {
+	vpnIPs []netaddr.IP
+	// set when members identify themselves with certificates
+	certificate *tls.Certificate
+	caPool      *x509.CertPool
+	revocations *RevocationList
+	// set when members prove their VPN IPs with memberships
+	networkKey  ed25519.PublicKey
+	credentials *MemberCredentials
+}
+
+func newRelayProver(vpnIPs []netaddr.IP) *relayProver {
+	return &relayProver{vpnIPs: vpnIPs}
+}
+
+// isOurs reports whether the IP is one of our VPN IPs
+func (r *relayProver) isOurs(ip netaddr.IP) bool {
+	return containsIP(r.vpnIPs, ip)
+}
+
+func containsIP(ips []netaddr.IP, ip netaddr.IP) bool {
+	for _, other := range ips {
+		if other == ip {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newProbe makes a probe from us to the member
+func (r *relayProver) newProbe(to netaddr.IP) (relayProbe, error) {
+	nonce := make([]byte, 16)
+
+	if _, err := rand.Read(nonce); err != nil {
+		return relayProbe{}, err
+	}
+
+	return relayProbe{From: r.vpnIPs[0], To: to, Nonce: nonce}, nil
+}
+
+func (r *relayProver) answer(probe relayProbe) (relayProof, error) {
+	proof := relayProof{From: probe.To, To: probe.From, Nonce: probe.Nonce}
+
+	switch {
+	case r.certificate != nil:
+		cert, err := x509.ParseCertificate(r.certificate.Certificate[0])
+
+		if err != nil {
+			return relayProof{}, err
+		}
+
+		signer, ok := r.certificate.PrivateKey.(crypto.Signer)
+
+		if !ok {
+			return relayProof{}, errors.New("certificate key can't sign")
+		}
+
+		_, hash, err := relayProofAlgorithm(cert)
+
+		if err != nil {
+			return relayProof{}, err
+		}
+
+		signed := proof.signed()
+
+		if hash != 0 {
+			digest := sha256.Sum256(signed)
+			signed = digest[:]
+		}
+
+		proof.Certificate = cert.Raw
+		proof.Signature, err = signer.Sign(rand.Reader, signed, hash)
+
+		if err != nil {
+			return relayProof{}, err
+		}
+	case r.credentials != nil:
+		proof.Membership = &r.credentials.Membership
+		proof.Signature = ed25519.Sign(r.credentials.PrivateKey, proof.signed())
+	}
+
+	return proof, nil
+}
+
+// verify checks that the proof was made by a member allowed to use the VPN IP
+// it's from. Without a CA or network key, there's nothing to check it with.
+func (r *relayProver) verify(proof relayProof) error {
+	switch {
+	case r.caPool != nil:
+		identity, err := verifyMemberCert(proof.Certificate, r.caPool)
+
+		if err != nil {
+			return err
+		}
+
+		if r.revocations.IsRevoked(identity) {
+			return errors.New("certificate has been revoked")
+		}
+
+		if !containsIP(identity.VpnIPs, proof.From) {
+			return fmt.Errorf("certificate is for %v not %v", identity.VpnIPs, proof.From)
+		}
+
+		cert, err := x509.ParseCertificate(proof.Certificate)
+
+		if err != nil {
+			return err
+		}
+
+		algorithm, _, err := relayProofAlgorithm(cert)
+
+		if err != nil {
+			return err
+		}
+
+		return cert.CheckSignature(algorithm, proof.signed(), proof.Signature)
+	case r.networkKey != nil:
+		if proof.Membership == nil {
+			return errors.New("no membership in proof")
+		}
+
+		assertion, err := proof.Membership.Verify(r.networkKey)
+
+		if err != nil {
+			return err
+		}
+
+		if !containsIP(assertion.VpnIPs, proof.From) {
+			return fmt.Errorf("membership is for %v not %v", assertion.VpnIPs, proof.From)
+		}
+
+		if !ed25519.Verify(assertion.PublicKey, proof.signed(), proof.Signature) {
+			return errors.New("proof not signed by the member key")
+		}
+	}
+
+	return nil
+}
+
+// relayProofAlgorithm returns how relay proofs are signed with the key of the
+// certificate
+func relayProofAlgorithm(cert *x509.Certificate) (x509.SignatureAlgorithm, crypto.Hash, error) {
+	switch cert.PublicKeyAlgorithm {
+	case x509.ECDSA:
+		return x509.ECDSAWithSHA256, crypto.SHA256, nil
+	case x509.RSA:
+		return x509.SHA256WithRSA, crypto.SHA256, nil
+	case x509.Ed25519:
+		return x509.PureEd25519, 0, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported certificate key %v", cert.PublicKeyAlgorithm)
+	}
+}
@@ -0,0 +1,81 @@
+package meshboi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestRelayProofWithCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	memberIP := netaddr.MustParseIP("192.168.1.2")
+
+	verifier := newRelayProver([]netaddr.IP{netaddr.MustParseIP("192.168.1.1")})
+	verifier.caPool = ca.pool
+
+	member := newRelayProver([]netaddr.IP{memberIP})
+	cert := ca.sign(CertIdentity{VpnIPs: member.vpnIPs})
+	member.certificate = &cert
+
+	probe, _ := verifier.newProbe(memberIP)
+	proof, err := member.answer(probe)
+
+	if err != nil {
+		t.Fatal("Error answering probe: ", err)
+	}
+
+	if err := verifier.verify(proof); err != nil {
+		t.Fatal("Proof wasn't valid: ", err)
+	}
+
+	// A member with a certificate for another IP can't answer for the member
+	other := newRelayProver([]netaddr.IP{netaddr.MustParseIP("192.168.1.3")})
+	otherCert := ca.sign(CertIdentity{VpnIPs: other.vpnIPs})
+	other.certificate = &otherCert
+
+	forged, _ := other.answer(probe)
+
+	if err := verifier.verify(forged); err == nil {
+		t.Fatalf("Proof from another member was valid")
+	}
+
+	// Nor can a proof be used for another probe
+	proof.Nonce = []byte("another nonce")
+
+	if err := verifier.verify(proof); err == nil {
+		t.Fatalf("Proof for another probe was valid")
+	}
+}
+
+func TestRelayProofWithMemberships(t *testing.T) {
+	networkPublic, networkKey, _ := ed25519.GenerateKey(rand.Reader)
+	memberIP := netaddr.MustParseIP("192.168.1.2")
+
+	verifier := newRelayProver([]netaddr.IP{netaddr.MustParseIP("192.168.1.1")})
+	verifier.networkKey = networkPublic
+
+	member := newRelayProver([]netaddr.IP{memberIP})
+	member.credentials, _ = IssueMembership(networkKey, member.vpnIPs)
+
+	probe, _ := verifier.newProbe(memberIP)
+	proof, _ := member.answer(probe)
+
+	if err := verifier.verify(proof); err != nil {
+		t.Fatal("Proof wasn't valid: ", err)
+	}
+
+	// Members without credentials can't answer when they're needed
+	unproven, _ := newRelayProver(member.vpnIPs).answer(probe)
+
+	if err := verifier.verify(unproven); err == nil {
+		t.Fatalf("Proof without a membership was valid")
+	}
+
+	proof.Signature[0] ^= 0xff
+
+	if err := verifier.verify(proof); err == nil {
+		t.Fatalf("Proof with a bad signature was valid")
+	}
+}
@@ -0,0 +1,148 @@
+package meshboi
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// fakeRolodexConn is one end of a pipe standing in for the conn to a rolodex
+type fakeRolodexConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (f fakeRolodexConn) RemoteAddr() net.Addr {
+	return f.addr
+}
+
+// A DTLS record header for a handshake message with a single byte of payload
+var fakeHandshake = []byte{22, 0xfe, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1}
+
+// newTestRelay returns a relay and the rolodex end of its conn
+func newTestRelay(t *testing.T) (*Relay, net.Conn) {
+	client, rolodex := net.Pipe()
+	relay, err := NewRelay(fakeRolodexConn{Conn: client, addr: &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 6264}})
+
+	if err != nil {
+		t.Fatal("Error making relay: ", err)
+	}
+
+	return relay, rolodex
+}
+
+// forward reads a frame sent by one relay to the rolodex and passes it on to
+// the other relay, as the rolodex would
+func forward(t *testing.T, rolodex net.Conn, from netaddr.IPPort, to *Relay) {
+	buf := make([]byte, 1000)
+	n, err := rolodex.Read(buf)
+
+	if err != nil {
+		t.Fatal("Error reading frame: ", err)
+	}
+
+	_, payload, err := parseRelayFrame(buf[:n])
+
+	if err != nil {
+		t.Fatal("Error parsing frame: ", err)
+	}
+
+	to.HandleFrame(newRelayFrame(from, payload))
+}
+
+func TestRelayDialAndAccept(t *testing.T) {
+	relay1, rolodex1 := newTestRelay(t)
+	relay2, rolodex2 := newTestRelay(t)
+	defer relay1.Close()
+	defer relay2.Close()
+
+	addr1 := netaddr.MustParseIPPort("5.5.5.5:1000")
+	addr2 := netaddr.MustParseIPPort("6.6.6.6:2000")
+
+	conn1, err := relay1.Dial(addr2)
+
+	if err != nil {
+		t.Fatal("Error dialing: ", err)
+	}
+
+	go conn1.Write(fakeHandshake)
+	forward(t, rolodex1, addr1, relay2)
+
+	conn2, err := relay2.Accept()
+
+	if err != nil {
+		t.Fatal("Error accepting: ", err)
+	}
+
+	if conn2.RemoteAddr().String() != addr1.String() {
+		t.Fatalf("Accepted conn from wrong address %v", conn2.RemoteAddr())
+	}
+
+	buf := make([]byte, 1000)
+	n, _ := conn2.Read(buf)
+
+	if string(buf[:n]) != string(fakeHandshake) {
+		t.Fatalf("Didn't read handshake %v", buf[:n])
+	}
+
+	go conn2.Write([]byte("reply"))
+	forward(t, rolodex2, addr2, relay1)
+
+	n, _ = conn1.Read(buf)
+
+	if string(buf[:n]) != "reply" {
+		t.Fatalf("Didn't read reply %v", buf[:n])
+	}
+}
+
+// Tests that only handshakes can start a new relayed conn
+func TestRelayIgnoresUnknownNonHandshake(t *testing.T) {
+	relay, _ := newTestRelay(t)
+	defer relay.Close()
+
+	relay.HandleFrame(newRelayFrame(netaddr.MustParseIPPort("5.5.5.5:1000"), []byte("not a handshake")))
+
+	if len(relay.accept) != 0 {
+		t.Fatalf("Accepted a conn without a handshake")
+	}
+}
+
+func TestRelayReadDeadline(t *testing.T) {
+	relay, _ := newTestRelay(t)
+	defer relay.Close()
+
+	conn, _ := relay.Dial(netaddr.MustParseIPPort("5.5.5.5:1000"))
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	_, err := conn.Read(make([]byte, 100))
+
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("Expected a timeout but got %v", err)
+	}
+}
+
+// Tests that closing the relay unblocks reads on its conns
+func TestRelayClose(t *testing.T) {
+	relay, _ := newTestRelay(t)
+	conn, _ := relay.Dial(netaddr.MustParseIPPort("5.5.5.5:1000"))
+
+	done := make(chan error)
+
+	go func() {
+		_, err := conn.Read(make([]byte, 100))
+		done <- err
+	}()
+
+	relay.Close()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Expected an error reading from a closed relay")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Read wasn't unblocked")
+	}
+}
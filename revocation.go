@@ -0,0 +1,207 @@
+package meshboi
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RevocationList holds the serial numbers of member certificates that the CA
+// has revoked. It's updated from CRLs signed by the CA, which can come from a
+// file or the rolodex, so it doesn't matter who it was received from.
+type RevocationList struct {
+	ca      *x509.Certificate
+	revoked map[string]bool
+	number  *big.Int
+	lock    sync.RWMutex
+
+	// optional, called after a newer CRL is used
+	onUpdate func()
+}
+
+func NewRevocationList(ca *x509.Certificate) *RevocationList {
+	return &RevocationList{
+		ca:      ca,
+		revoked: make(map[string]bool),
+		number:  big.NewInt(-1),
+	}
+}
+
+// The extension holding the CRL number, which increases with each new CRL
+var crlNumberOID = asn1.ObjectIdentifier{2, 5, 29, 20}
+
+func crlNumber(crl *pkix.CertificateList) (*big.Int, error) {
+	for _, extension := range crl.TBSCertList.Extensions {
+		if !extension.Id.Equal(crlNumberOID) {
+			continue
+		}
+
+		number := new(big.Int)
+
+		if _, err := asn1.Unmarshal(extension.Value, &number); err != nil {
+			return nil, err
+		}
+
+		return number, nil
+	}
+
+	return nil, errors.New("CRL has no number")
+}
+
+// parseCRL parses a PEM or DER encoded CRL and checks that it was signed by
+// the CA
+func parseCRL(ca *x509.Certificate, b []byte) (*pkix.CertificateList, error) {
+	if block, _ := pem.Decode(b); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, errors.New("expected a CRL but found " + block.Type)
+		}
+
+		b = block.Bytes
+	}
+
+	crl, err := x509.ParseDERCRL(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ca.CheckCRLSignature(crl); err != nil {
+		return nil, err
+	}
+
+	return crl, nil
+}
+
+// Update replaces the revoked certificates with those in the CRL, as long as
+// it was signed by the CA and is newer than the CRL already in use. It returns
+// whether the CRL was used.
+func (r *RevocationList) Update(b []byte) (bool, error) {
+	crl, err := parseCRL(r.ca, b)
+
+	if err != nil {
+		return false, err
+	}
+
+	number, err := crlNumber(crl)
+
+	if err != nil {
+		return false, err
+	}
+
+	if crl.HasExpired(time.Now()) {
+		// Still better to use it than to forget about the certificates in it
+		log.Warn("Revocation list expired at ", crl.TBSCertList.NextUpdate, ", a new one should be made")
+	}
+
+	revoked := make(map[string]bool, len(crl.TBSCertList.RevokedCertificates))
+
+	for _, cert := range crl.TBSCertList.RevokedCertificates {
+		revoked[cert.SerialNumber.String()] = true
+	}
+
+	r.lock.Lock()
+
+	// Older CRLs are ignored so that they can't be replayed to unrevoke a
+	// certificate
+	if number.Cmp(r.number) <= 0 {
+		r.lock.Unlock()
+		return false, nil
+	}
+
+	r.revoked = revoked
+	r.number = number
+	onUpdate := r.onUpdate
+	r.lock.Unlock()
+
+	log.Info("Using revocation list from ", crl.TBSCertList.ThisUpdate, " with ", len(revoked), " revoked certificates")
+
+	if onUpdate != nil {
+		onUpdate()
+	}
+
+	return true, nil
+}
+
+// Load updates the revocation list from a CRL file
+func (r *RevocationList) Load(path string) error {
+	b, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = r.Update(b)
+
+	return err
+}
+
+// IsRevoked reports whether the member's certificate has been revoked. A nil
+// list or identity revokes nothing.
+func (r *RevocationList) IsRevoked(identity *CertIdentity) bool {
+	if r == nil || identity == nil || identity.Serial == nil {
+		return false
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return r.revoked[identity.Serial.String()]
+}
+
+// RevokeCerts creates a CRL that revokes the certificates with the given
+// serial numbers, along with those revoked by the previous CRL if there is
+// one. The CRL is returned PEM encoded.
+func RevokeCerts(caCert *x509.Certificate, caKey crypto.Signer, previous []byte, serials []*big.Int, validity time.Duration) ([]byte, error) {
+	now := time.Now()
+	var revoked []pkix.RevokedCertificate
+	seen := make(map[string]bool)
+
+	if previous != nil {
+		crl, err := parseCRL(caCert, previous)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cert := range crl.TBSCertList.RevokedCertificates {
+			seen[cert.SerialNumber.String()] = true
+			revoked = append(revoked, cert)
+		}
+	}
+
+	for _, serial := range serials {
+		if seen[serial.String()] {
+			continue
+		}
+
+		seen[serial.String()] = true
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: now})
+	}
+
+	template := &x509.RevocationList{
+		RevokedCertificates: revoked,
+		// Members only use CRLs newer than the one they have, so the number
+		// has to keep increasing
+		Number:     big.NewInt(now.UnixNano()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(validity),
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, caCert, caKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
@@ -0,0 +1,95 @@
+package meshboi
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// testIdentity signs a certificate for a member and returns the identity in it
+func testIdentity(t *testing.T, ca *testCA, vpnIP string) *CertIdentity {
+	cert := ca.sign(CertIdentity{VpnIPs: []netaddr.IP{netaddr.MustParseIP(vpnIP)}})
+	identity, err := identityFromRawCert(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatal("Error reading identity: ", err)
+	}
+
+	return identity
+}
+
+func TestRevocationList(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+	lost := testIdentity(t, ca, "192.168.50.1")
+	stolen := testIdentity(t, ca, "192.168.50.2")
+	kept := testIdentity(t, ca, "192.168.50.3")
+
+	first, err := RevokeCerts(ca.cert, ca.key, nil, []*big.Int{lost.Serial}, time.Hour)
+
+	if err != nil {
+		t.Fatal("Error creating CRL: ", err)
+	}
+
+	second, err := RevokeCerts(ca.cert, ca.key, first, []*big.Int{stolen.Serial}, time.Hour)
+
+	if err != nil {
+		t.Fatal("Error creating CRL: ", err)
+	}
+
+	revocations := NewRevocationList(ca.cert)
+
+	if used, err := revocations.Update(second); !used || err != nil {
+		t.Fatalf("CRL wasn't used %v", err)
+	}
+
+	if !revocations.IsRevoked(lost) || !revocations.IsRevoked(stolen) {
+		t.Fatalf("Certificates in the CRL aren't revoked")
+	}
+
+	if revocations.IsRevoked(kept) {
+		t.Fatalf("Certificate not in the CRL is revoked")
+	}
+
+	if used, _ := revocations.Update(first); used {
+		t.Fatalf("Older CRL replaced a newer one")
+	}
+
+	if !revocations.IsRevoked(stolen) {
+		t.Fatalf("Older CRL unrevoked a certificate")
+	}
+
+	forged, _ := RevokeCerts(otherCA.cert, otherCA.key, nil, []*big.Int{kept.Serial}, time.Hour)
+
+	if _, err := revocations.Update(forged); err == nil {
+		t.Fatalf("CRL from another CA was used")
+	}
+
+	if revocations.IsRevoked(kept) {
+		t.Fatalf("CRL from another CA revoked a certificate")
+	}
+}
+
+// Tests that a revoked certificate fails the DTLS handshake
+func TestRevokedCertRefused(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.sign(CertIdentity{VpnIPs: []netaddr.IP{netaddr.MustParseIP("192.168.50.1")}})
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+
+	revocations := NewRevocationList(ca.cert)
+	config := getCertDtlsConfig(cert, ca.pool, revocations, nil)
+
+	if err := config.VerifyPeerCertificate(cert.Certificate, nil); err != nil {
+		t.Fatal("Certificate refused before being revoked: ", err)
+	}
+
+	crl, _ := RevokeCerts(ca.cert, ca.key, nil, []*big.Int{leaf.SerialNumber}, time.Hour)
+	revocations.Update(crl)
+
+	if err := config.VerifyPeerCertificate(cert.Certificate, nil); err == nil {
+		t.Fatalf("Revoked certificate accepted")
+	}
+}
@@ -1,8 +1,13 @@
 package meshboi
 
 import (
+	"crypto/hmac"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"net"
+	"runtime"
 	"sync"
 	"time"
 
@@ -11,48 +16,197 @@ import (
 )
 
 type rolodex struct {
-	conn            *net.UDPConn
-	networks        map[string]*meshNetwork
+	transport    rolodexTransport
+	networks     map[string]*meshNetwork
+	networksLock sync.RWMutex
+	// the network that each member address belongs to, for checking relayed
+	// frames without going through every network
+	addrNetworks map[netaddr.IPPort]*meshNetwork
+	addrsLock    sync.RWMutex
+	// how many goroutines read and handle messages from members
+	workers         int
 	sendInterval    time.Duration
 	timeOutDuration time.Duration
+	// the most networks that can exist at once, so that heartbeats for made
+	// up networks can't use up the rolodex's memory
+	maxNetworks int
+	// whether to relay frames between members that can't reach each other
+	relay bool
+	// the CRL frame to send to members, if any
+	crl *cachedFile
+	// the ACL frame to send to the members of each network, if any
+	acls *cachedFile
+	// the secret members must know to join each network, if networks need
+	// one. Networks that aren't listed can't be joined.
+	joinSecrets map[string][]byte
+	challenger  *joinChallenger
+	invites     *inviteRegistry
 }
 
 const TimeOutSecs = 30
 
+// The most networks a rolodex holds by default
+const DefaultMaxNetworks = 10000
+
+type memberEndpoint struct {
+	addr     netaddr.IPPort
+	lastSeen time.Time
+	// the version of the map the member has over this address, or nil if it
+	// is sent the whole map
+	ack *mapAck
+	// whether the member is sent messages in the binary wire format
+	binaryWire bool
+}
+
+// A member of a mesh, which may be reachable over both IPv4 and IPv6
+type meshMember struct {
+	// identifies the member to other members in map updates
+	key  string
+	ipv4 memberEndpoint
+	ipv6 memberEndpoint
+}
+
+func (m *meshMember) endpoint(addr netaddr.IPPort) *memberEndpoint {
+	if addr.IP.Is4() {
+		return &m.ipv4
+	}
+
+	return &m.ipv6
+}
+
+func (m *meshMember) addrs() MemberAddrs {
+	return MemberAddrs{IPv4: m.ipv4.addr, IPv6: m.ipv6.addr}
+}
+
 type meshNetwork struct {
-	// make of IP address to last seen time
-	members     map[netaddr.IPPort]time.Time
+	// map of member ID to member
+	members     map[string]*meshMember
 	membersLock sync.RWMutex
 	rollo       *rolodex
 	name        string
-	newMember   chan struct{}
+	// signalled when a member joins so that the map is sent out straight away
+	newMember chan struct{}
+	// when the network last had no members, or zero if it has members
+	emptySince time.Time
+	// set once the network has been removed from the rolodex, after which
+	// members can't register with it
+	closed bool
+	// the version of the map, which goes up each time a member's addresses
+	// change, and the changes that were made to get to it
+	mapVersion uint64
+	mapChanges []mapChange
+	// picked at random so that versions of an earlier network with the same
+	// name aren't mistaken for versions of this one
+	mapEpoch uint64
+}
+
+func newMeshNetwork(rollo *rolodex, name string) *meshNetwork {
+	return &meshNetwork{
+		members: make(map[string]*meshMember),
+		rollo:   rollo,
+		name:    name,
+		// Only one notification is ever pending, so that a burst of new
+		// members is sent out in a single map
+		newMember:  make(chan struct{}, 1),
+		emptySince: time.Now(),
+		mapEpoch:   newMapEpoch(),
+	}
 }
 
-func (m *meshNetwork) register(addr netaddr.IPPort) {
+// register adds the member's address to the network, returning false if the
+// network has been closed. ack is the version of the map the member has, if
+// it wants map updates.
+func (m *meshNetwork) register(memberID string, addr netaddr.IPPort, ack *mapAck, binaryWire bool) bool {
 	m.membersLock.Lock()
-	_, ok := m.members[addr]
-	m.members[addr] = time.Now()
-	m.membersLock.Unlock()
+
+	if m.closed {
+		m.membersLock.Unlock()
+		return false
+	}
+
+	member, ok := m.members[memberID]
 
 	if !ok {
+		member = &meshMember{key: memberKey(memberID)}
+		m.members[memberID] = member
+		m.emptySince = time.Time{}
+	}
+
+	endpoint := member.endpoint(addr)
+	isNew := endpoint.addr != addr
+
+	if isNew {
+		m.rollo.indexAddr(endpoint.addr, addr, m)
+	}
+
+	endpoint.addr = addr
+	endpoint.lastSeen = time.Now()
+	endpoint.ack = ack
+	endpoint.binaryWire = binaryWire
+
+	if isNew {
+		m.recordChange(member.key, member.addrs())
+	}
+
+	m.membersLock.Unlock()
+
+	if isNew {
 		log.WithFields(log.Fields{
 			"address": addr,
+			"id":      memberID,
 			"name":    m.name,
-		}).Info("Registering new mesh member")
-		m.newMember <- struct{}{}
+		}).Info("Registering new mesh member address")
+
+		// Serve may be busy sending out the last map, in which case it's
+		// already been told to send another which will have this member too
+		select {
+		case m.newMember <- struct{}{}:
+		default:
+		}
+	}
+
+	return true
+}
+
+// indexAddr records that the member address belongs to the network, in place
+// of the member's old address if it had one
+func (r *rolodex) indexAddr(old netaddr.IPPort, addr netaddr.IPPort, mesh *meshNetwork) {
+	r.addrsLock.Lock()
+	defer r.addrsLock.Unlock()
+
+	if r.addrNetworks[old] == mesh {
+		delete(r.addrNetworks, old)
+	}
+
+	if !addr.IP.IsZero() {
+		r.addrNetworks[addr] = mesh
 	}
 }
 
+// getNetwork returns the network, creating it if it doesn't exist yet. Nil is
+// returned if the network would be one too many.
 func (r *rolodex) getNetwork(networkName string) *meshNetwork {
+	r.networksLock.RLock()
+	network, ok := r.networks[networkName]
+	r.networksLock.RUnlock()
+
+	if ok {
+		return network
+	}
+
+	r.networksLock.Lock()
+	defer r.networksLock.Unlock()
+
+	// Another worker may have made it in the meantime
 	if network, ok := r.networks[networkName]; ok {
 		return network
 	}
 
-	network := &meshNetwork{}
-	network.members = make(map[netaddr.IPPort]time.Time)
-	network.rollo = r
-	network.newMember = make(chan struct{})
-	network.name = networkName
+	if len(r.networks) >= r.maxNetworks {
+		return nil
+	}
+
+	network = newMeshNetwork(r, networkName)
 	r.networks[networkName] = network
 
 	go network.Serve()
@@ -61,41 +215,375 @@ func (r *rolodex) getNetwork(networkName string) *meshNetwork {
 }
 
 func NewRolodex(conn *net.UDPConn, sendInterval time.Duration, timeOutDuration time.Duration) (*rolodex, error) {
+	return newRolodex(udpTransport{conn: conn}, sendInterval, timeOutDuration)
+}
+
+func newRolodex(transport rolodexTransport, sendInterval time.Duration, timeOutDuration time.Duration) (*rolodex, error) {
+	challenger, err := newJoinChallenger()
+
+	if err != nil {
+		return nil, err
+	}
+
 	rollo := &rolodex{}
-	rollo.conn = conn
+	rollo.challenger = challenger
+	rollo.transport = transport
 	rollo.sendInterval = sendInterval
 	rollo.timeOutDuration = timeOutDuration
 	rollo.networks = make(map[string]*meshNetwork)
+	rollo.maxNetworks = DefaultMaxNetworks
+	rollo.addrNetworks = make(map[netaddr.IPPort]*meshNetwork)
+	rollo.workers = runtime.NumCPU()
 
 	return rollo, nil
 }
 
+// SetMaxNetworks limits how many networks the rolodex holds at once.
+// Heartbeats for new networks are ignored while there are that many.
+func (r *rolodex) SetMaxNetworks(n int) {
+	r.networksLock.Lock()
+	defer r.networksLock.Unlock()
+
+	r.maxNetworks = n
+}
+
+// SetWorkers sets how many goroutines read and handle messages from members
+func (r *rolodex) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	r.workers = n
+}
+
+// removeIfEmpty removes the network from the rolodex if it has had no members
+// for the timeout, returning whether it was removed
+func (r *rolodex) removeIfEmpty(mesh *meshNetwork) bool {
+	r.networksLock.Lock()
+	defer r.networksLock.Unlock()
+
+	mesh.membersLock.Lock()
+	defer mesh.membersLock.Unlock()
+
+	if len(mesh.members) > 0 || mesh.emptySince.IsZero() || time.Since(mesh.emptySince) < r.timeOutDuration {
+		return false
+	}
+
+	mesh.closed = true
+	delete(r.networks, mesh.name)
+
+	log.WithFields(log.Fields{
+		"name": mesh.name,
+	}).Info("Removing empty network")
+
+	return true
+}
+
+// EnableRelay makes the rolodex forward datagrams between members of the same
+// network that can't reach each other directly. The datagrams are encrypted
+// end to end between the members, but relaying uses the rolodex's bandwidth.
+func (r *rolodex) EnableRelay() {
+	r.relay = true
+}
+
+// RequireJoinSecrets only lets members join the networks listed, and only if
+// they prove that they know the network's secret
+func (r *rolodex) RequireJoinSecrets(secrets map[string][]byte) error {
+	r.joinSecrets = secrets
+	r.invites = newInviteRegistry()
+
+	return nil
+}
+
+// RecordInvites keeps the invites that have been used in the file, so that
+// they can't be used again after the rolodex restarts. Otherwise they're only
+// remembered in memory.
+func (r *rolodex) RecordInvites(path string) error {
+	if r.invites == nil {
+		return errors.New("invites need join secrets to be required")
+	}
+
+	return r.invites.load(path)
+}
+
+// authorized reports whether the heartbeat can join its network, challenging
+// the member to prove that it knows the join secret if it hasn't yet
+func (r *rolodex) authorized(message HeartbeatMessage, addr netaddr.IPPort) bool {
+	if r.joinSecrets == nil {
+		return true
+	}
+
+	secret, ok := r.joinSecrets[message.NetworkName]
+
+	if !ok {
+		log.Debug("Ignoring heartbeat from ", addr, " for unknown network")
+		return false
+	}
+
+	if message.Invite != nil {
+		secret = inviteSecret(secret, message.Invite.ID, message.Invite.Expires)
+	}
+
+	if r.challenger.valid(message.Challenge, addr) {
+		proof := joinProof(secret, message.Challenge, message.NetworkName, message.MemberID)
+
+		if hmac.Equal(message.Proof, proof) {
+			return r.redeemInvite(message, addr)
+		}
+	}
+
+	r.sendChallenge(addr)
+
+	return false
+}
+
+// provesMemberID reports whether the member answered a recent challenge with
+// the key its ID is from, challenging it to if not
+func (r *rolodex) provesMemberID(message HeartbeatMessage, addr netaddr.IPPort) bool {
+	if r.challenger.valid(message.Challenge, addr) &&
+		validMemberIDProof(message.MemberID, message.Challenge, message.NetworkName, message.IDProof) {
+		return true
+	}
+
+	r.sendChallenge(addr)
+
+	return false
+}
+
+func (r *rolodex) sendChallenge(addr netaddr.IPPort) {
+	if err := r.transport.WriteTo(newJoinChallengeFrame(r.challenger.challenge(addr)), addr); err != nil {
+		log.Debug("Error sending join challenge to ", addr, ": ", err)
+	}
+}
+
+// redeemInvite reports whether the member can use the invite it joined with,
+// which it can't if another member already has
+func (r *rolodex) redeemInvite(message HeartbeatMessage, addr netaddr.IPPort) bool {
+	if message.Invite == nil {
+		return true
+	}
+
+	// Without an ID, every member would look like the same one
+	if message.MemberID == "" {
+		return false
+	}
+
+	ok, err := r.invites.redeem(message.Invite, message.MemberID)
+
+	if err != nil {
+		log.Warn("Error recording used invite: ", err)
+	}
+
+	if !ok {
+		log.Debug("Ignoring heartbeat from ", addr, " with an invite that's expired or used by another member")
+	}
+
+	return ok
+}
+
+// ServeRevocationList sends the CRL in the file to every member along with
+// the network map. The file is read again whenever it changes so that newly
+// revoked certificates are sent out without restarting the rolodex.
+func (r *rolodex) ServeRevocationList(path string) {
+	r.crl = newCachedFile(path, func(b []byte) (interface{}, error) {
+		if block, _ := pem.Decode(b); block != nil {
+			b = block.Bytes
+		}
+
+		return newRevocationFrame(b), nil
+	})
+}
+
+// revocationFrame returns the CRL frame to send to members, or nil if there
+// isn't one
+func (r *rolodex) revocationFrame() []byte {
+	if r.crl == nil {
+		return nil
+	}
+
+	frame, _ := r.crl.get().([]byte)
+
+	return frame
+}
+
+// ServeACLs sends each network's ACL policy to its members along with the
+// network map. The file is a JSON object of network names to policies, and is
+// read again whenever it changes so that it can be changed without restarting
+// the rolodex.
+func (r *rolodex) ServeACLs(path string) {
+	r.acls = newCachedFile(path, func(b []byte) (interface{}, error) {
+		var policies map[string]json.RawMessage
+
+		if err := json.Unmarshal(b, &policies); err != nil {
+			return nil, err
+		}
+
+		frames := make(map[string][]byte, len(policies))
+
+		for networkName, policy := range policies {
+			frames[networkName] = newACLFrame(policy)
+		}
+
+		return frames, nil
+	})
+}
+
+// aclFrame returns the ACL frame to send to the network's members, or nil if
+// there isn't one
+func (r *rolodex) aclFrame(networkName string) []byte {
+	if r.acls == nil {
+		return nil
+	}
+
+	frames, _ := r.acls.get().(map[string][]byte)
+
+	return frames[networkName]
+}
+
+// sameNetwork reports whether both addresses belong to members of one network
+func (r *rolodex) sameNetwork(a netaddr.IPPort, b netaddr.IPPort) bool {
+	r.addrsLock.RLock()
+	defer r.addrsLock.RUnlock()
+
+	network, ok := r.addrNetworks[a]
+
+	return ok && r.addrNetworks[b] == network
+}
+
+// forwardRelayFrame sends a frame from one member on to the member it's
+// addressed to, rewriting the address so the receiver knows who it's from
+func (r *rolodex) forwardRelayFrame(src netaddr.IPPort, frame []byte) {
+	if !r.relay {
+		return
+	}
+
+	dst, payload, err := parseRelayFrame(frame)
+
+	if err != nil {
+		log.Debug("Error parsing relay frame: ", err)
+		return
+	}
+
+	if !r.sameNetwork(src, dst) {
+		log.Debug("Not relaying from ", src, " to ", dst, " as they aren't in the same network")
+		return
+	}
+
+	if err := r.transport.WriteTo(newRelayFrame(src, payload), dst); err != nil {
+		log.Warn("Error relaying to ", dst, ": ", err)
+	}
+}
+
+// Run reads and handles messages from members on several goroutines at once,
+// so that one rolodex can keep up with many members
 func (r *rolodex) Run() {
+	for i := 1; i < r.workers; i++ {
+		go r.readLoop()
+	}
+
+	r.readLoop()
+}
+
+func (r *rolodex) readLoop() {
 	buf := make([]byte, 65535)
 	for {
-		n, addr, err := r.conn.ReadFromUDP(buf)
+		n, ipPort, err := r.transport.ReadFrom(buf)
 
 		if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 			log.Warn("Temporary error reading data: ", nerr)
 			continue
 		}
 
-		var message HeartbeatMessage
-
-		if err := json.Unmarshal(buf[:n], &message); err != nil {
-			log.Error("Error unmarshalling ", err)
+		if err != nil {
+			log.Error("Error reading data: ", err)
 			continue
 		}
 
-		mesh := r.getNetwork(message.NetworkName)
-		ipPort, ok := netaddr.FromStdAddr(addr.IP, addr.Port, "")
+		r.handle(buf[:n], ipPort)
+	}
+}
 
-		if !ok {
-			log.Error("Error converting to netaddr ", err)
-			continue
+// handle deals with a message from a member, which is either a heartbeat or
+// a frame to relay to another member
+func (r *rolodex) handle(msg []byte, ipPort netaddr.IPPort) {
+	if isRelayFrame(msg) {
+		r.forwardRelayFrame(ipPort, msg)
+		return
+	}
+
+	message, binaryWire, err := parseHeartbeat(msg)
+
+	if err != nil {
+		log.Error("Error unmarshalling ", err)
+		return
+	}
+
+	if !r.authorized(message, ipPort) {
+		return
+	}
+
+	memberID := message.MemberID
+
+	if !isPublicMemberID(memberID) {
+		// Older members don't send an ID they can prove they hold, so
+		// identify them by address
+		memberID = ipPort.String()
+	} else if !r.provesMemberID(message, ipPort) {
+		return
+	}
+
+	var ack *mapAck
+
+	// Members identified by address change address too often to keep track
+	// of the map they have
+	if message.MapUpdates && memberID == message.MemberID {
+		ack = &mapAck{epoch: message.MapEpoch, version: message.MapVersion}
+	}
+
+	r.register(message.NetworkName, memberID, ipPort, ack, binaryWire)
+}
+
+// parseHeartbeat reads a heartbeat in either the binary or JSON format,
+// returning whether the member should be sent messages in the binary format
+func parseHeartbeat(msg []byte) (HeartbeatMessage, bool, error) {
+	var message HeartbeatMessage
+
+	if !isWireMessage(msg) {
+		err := json.Unmarshal(msg, &message)
+
+		return message, message.WireVersion >= wireVersion, err
+	}
+
+	msgType, fields, err := parseWireMessage(msg)
+
+	if err != nil {
+		return message, false, err
+	}
+
+	if msgType != wireHeartbeat {
+		return message, false, fmt.Errorf("unexpected binary message type %v", msgType)
+	}
+
+	message, err = decodeHeartbeat(fields)
+
+	return message, true, err
+}
+
+// register adds the member to the network, creating the network if needed
+func (r *rolodex) register(networkName string, memberID string, addr netaddr.IPPort, ack *mapAck, binaryWire bool) {
+	for {
+		mesh := r.getNetwork(networkName)
+
+		if mesh == nil {
+			log.Debug("Ignoring heartbeat from ", addr, " as the rolodex has too many networks")
+			return
 		}
 
-		mesh.register(ipPort)
+		// The network may have been removed for being empty since it was got,
+		// in which case a new one is made
+		if mesh.register(memberID, addr, ack, binaryWire) {
+			return
+		}
 	}
 }
 
@@ -105,23 +593,45 @@ func (mesh *meshNetwork) timeOutInactiveMembers() {
 
 	now := time.Now()
 
-	for member := range mesh.members {
-		timeSinceLastActive := now.Sub(mesh.members[member])
+	for id, member := range mesh.members {
+		changed := false
 
-		if timeSinceLastActive > mesh.rollo.timeOutDuration {
-			log.WithFields(log.Fields{
-				"address": member.IP,
-			}).Info("Removing member due to timeout")
-			delete(mesh.members, member)
+		for _, endpoint := range []*memberEndpoint{&member.ipv4, &member.ipv6} {
+			if endpoint.addr.IP.IsZero() {
+				continue
+			}
+
+			if now.Sub(endpoint.lastSeen) > mesh.rollo.timeOutDuration {
+				log.WithFields(log.Fields{
+					"address": endpoint.addr,
+					"id":      id,
+				}).Info("Removing member address due to timeout")
+				mesh.rollo.indexAddr(endpoint.addr, netaddr.IPPort{}, mesh)
+				*endpoint = memberEndpoint{}
+				changed = true
+			}
+		}
+
+		if changed {
+			mesh.recordChange(member.key, member.addrs())
+		}
+
+		if member.ipv4.addr.IP.IsZero() && member.ipv6.addr.IP.IsZero() {
+			delete(mesh.members, id)
 		}
 	}
+
+	if len(mesh.members) == 0 && mesh.emptySince.IsZero() {
+		mesh.emptySince = now
+	}
 }
 
 // Serve sends out messages to each member so that they're aware of other members they can connect to
 // It also serves as a heart beat of sorts from the rolodex to the member
 func (mesh *meshNetwork) Serve() {
 	ticker := time.NewTicker(mesh.rollo.sendInterval)
-	quit := make(chan int)
+	defer ticker.Stop()
+
 	for {
 		// Send out an update both periodically, and on the event of a new member joining
 		select {
@@ -129,9 +639,6 @@ func (mesh *meshNetwork) Serve() {
 			break
 		case <-mesh.newMember:
 			break
-		case <-quit:
-			ticker.Stop()
-			return
 		}
 
 		// reset the ticker in case we're sending an update due to a new member joining
@@ -139,23 +646,79 @@ func (mesh *meshNetwork) Serve() {
 
 		mesh.timeOutInactiveMembers()
 
+		// Networks that nobody is using any more are forgotten about, so that
+		// they don't build up over time
+		if mesh.rollo.removeIfEmpty(mesh) {
+			return
+		}
+
 		mesh.membersLock.RLock()
+		memberAddrs := make([]MemberAddrs, 0, len(mesh.members))
 		memberIps := make([]netaddr.IPPort, 0, len(mesh.members))
-		for member := range mesh.members {
-			memberIps = append(memberIps, member)
-		}
+		updates := make([][]endpointUpdate, 0, len(mesh.members))
+		frames := newMapFrames(mesh, false)
+		binaryFrames := newMapFrames(mesh, true)
+		for _, member := range mesh.members {
+			addrs := member.addrs()
+			memberAddrs = append(memberAddrs, addrs)
+			memberIps = append(memberIps, addrs.Primary())
+
+			// Send to every address the member has so that it can learn about
+			// other members over whichever IP versions work for it
+			var endpoints []endpointUpdate
+			for _, endpoint := range []*memberEndpoint{&member.ipv6, &member.ipv4} {
+				if endpoint.addr.IP.IsZero() {
+					continue
+				}
 
-		memberMessage := NetworkMap{Addresses: memberIps}
-		memberMessage.YourIndex = 0
+				update := endpointUpdate{addr: endpoint.addr, binaryWire: endpoint.binaryWire}
 
-		for _, member := range memberIps {
-			b, err := json.Marshal(memberMessage)
-			if err != nil {
-				panic(err)
+				if endpoint.binaryWire {
+					update.frames = binaryFrames.forMember(endpoint.ack)
+				} else {
+					update.frames = frames.forMember(endpoint.ack)
+				}
+
+				endpoints = append(endpoints, update)
 			}
-			mesh.rollo.conn.WriteToUDP(b, member.UDPAddr())
-			memberMessage.YourIndex += 1
+			updates = append(updates, endpoints)
 		}
 		mesh.membersLock.RUnlock()
+
+		crlFrame := mesh.rollo.revocationFrame()
+		aclFrame := mesh.rollo.aclFrame(mesh.name)
+		memberMessage := NetworkMap{Addresses: memberIps, Members: memberAddrs}
+
+		for i, endpoints := range updates {
+			for _, endpoint := range endpoints {
+				msgs := endpoint.frames
+
+				// Members that don't want map updates are sent the whole map
+				if msgs == nil {
+					memberMessage.YourIndex = i
+					msgs = [][]byte{memberMessage.encode(endpoint.binaryWire)}
+				}
+
+				for _, b := range msgs {
+					mesh.rollo.transport.WriteTo(b, endpoint.addr)
+				}
+
+				if crlFrame != nil {
+					mesh.rollo.transport.WriteTo(crlFrame, endpoint.addr)
+				}
+
+				if aclFrame != nil {
+					mesh.rollo.transport.WriteTo(aclFrame, endpoint.addr)
+				}
+			}
+		}
 	}
 }
+
+// endpointUpdate is what's sent to one of a member's addresses
+type endpointUpdate struct {
+	addr netaddr.IPPort
+	// the map updates to send, or nil to send the whole map
+	frames     [][]byte
+	binaryWire bool
+}
@@ -1,9 +1,12 @@
 package meshboi
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -11,32 +14,80 @@ import (
 
 type RolodexCallback func(member NetworkMap)
 
+// How many heartbeats can go unanswered before the session with the rolodex
+// is started again
+const rolodexSilenceIntervals = 4
+
 type RolodexClient struct {
 	networkName string
+	// the public ID we're known by to the rolodex, and the key that proves
+	// we hold it
+	memberID    string
+	memberIDKey ed25519.PrivateKey
 	conn        net.Conn
 	sendRate    time.Duration
 	callback    RolodexCallback
-	quit        chan bool
+	quit        chan struct{}
 	wg          *sync.WaitGroup
+
+	// optional, called with frames relayed from other members by the rolodex
+	onRelayFrame func(frame []byte)
+	// optional, called with CRLs sent by the rolodex
+	onRevocationList func(crl []byte)
+	// optional, called with ACL policies sent by the rolodex
+	onACL func(policy []byte)
+	// optional, starts a new session with the rolodex when the current one
+	// stops working
+	redial func() error
+
+	// optional, proves that we can join the network to the rolodex
+	joinSecret []byte
+	// the invite the join secret came from, if any
+	invite *InviteClaim
+	// the last challenge from the rolodex, which is answered with the join
+	// secret and member ID key
+	challenge     []byte
+	challengeLock *sync.Mutex
+	// signalled to send a heartbeat straight away with a new challenge
+	challenged chan struct{}
+
+	// our copy of the network map, for asking the rolodex for map updates
+	// rather than the whole map. Only used when we have a member ID.
+	maps *mapState
+	// when a message in the binary wire format was last received from the
+	// rolodex, in Unix nanoseconds
+	lastBinary *int64
 }
 
-func NewRolodexClient(networkName string, conn net.Conn, sendRate time.Duration, callback RolodexCallback) RolodexClient {
+func NewRolodexClient(networkName string, memberID string, conn net.Conn, sendRate time.Duration, callback RolodexCallback) RolodexClient {
 	client := RolodexClient{
 		networkName: networkName,
 		conn:        conn,
 		sendRate:    sendRate,
 		callback:    callback,
-		quit:        make(chan bool),
+		quit:        make(chan struct{}),
 		wg:          &sync.WaitGroup{},
+
+		challengeLock: &sync.Mutex{},
+		challenged:    make(chan struct{}, 1),
+		lastBinary:    new(int64),
+	}
+
+	if memberID != "" {
+		// The member ID itself is kept secret, so that only we can prove
+		// we hold the public ID
+		client.memberIDKey = memberIDKey(memberID)
+		client.memberID = publicMemberID(client.memberIDKey)
+		client.maps = newMapState(client.memberID)
 	}
 
 	return client
 }
 
 func (c *RolodexClient) Run() {
+	c.wg.Add(2)
 	go c.readLoop()
 	go c.sendLoop()
-	c.wg.Add(2)
 	c.wg.Wait()
 }
 
@@ -45,8 +96,34 @@ func (c *RolodexClient) readLoop() {
 
 	buf := make([]byte, 65535)
 	for {
+		if c.redial != nil {
+			// The rolodex sends a network map at least as often as we send
+			// heartbeats, so a long silence means the session has been lost
+			c.conn.SetReadDeadline(time.Now().Add(rolodexSilenceIntervals * c.sendRate))
+		}
+
 		n, err := c.conn.Read(buf)
 
+		if err != nil && c.isStopped() {
+			return
+		}
+
+		if err != nil && c.redial != nil {
+			log.Warn("Lost session with the rolodex, reconnecting: ", err)
+
+			if err := c.redial(); err != nil {
+				log.Warn("Error reconnecting to the rolodex: ", err)
+
+				select {
+				case <-c.quit:
+					return
+				case <-time.After(c.sendRate):
+				}
+			}
+
+			continue
+		}
+
 		if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 			log.Warn("Temporary error reading from rolloConn: ", nerr)
 			continue
@@ -57,6 +134,45 @@ func (c *RolodexClient) readLoop() {
 			break
 		}
 
+		if isRelayFrame(buf[:n]) {
+			if c.onRelayFrame != nil {
+				c.onRelayFrame(buf[:n])
+			}
+
+			continue
+		}
+
+		if isJoinChallengeFrame(buf[:n]) {
+			c.onJoinChallenge(buf[1:n])
+			continue
+		}
+
+		if isRevocationFrame(buf[:n]) {
+			if c.onRevocationList != nil {
+				c.onRevocationList(buf[1:n])
+			}
+
+			continue
+		}
+
+		if isACLFrame(buf[:n]) {
+			if c.onACL != nil {
+				c.onACL(buf[1:n])
+			}
+
+			continue
+		}
+
+		if isMapUpdateFrame(buf[:n]) {
+			c.onMapUpdate(buf[:n])
+			continue
+		}
+
+		if isWireMessage(buf[:n]) {
+			c.onWireMessage(buf[:n])
+			continue
+		}
+
 		var members NetworkMap
 
 		if err := json.Unmarshal(buf[:n], &members); err != nil {
@@ -73,10 +189,9 @@ func (c *RolodexClient) sendLoop() {
 
 	ticker := time.NewTicker(c.sendRate)
 	for {
-		heartbeat := HeartbeatMessage{NetworkName: c.networkName}
-		b, err := json.Marshal(heartbeat)
+		b, err := c.encodeHeartbeat(c.heartbeat())
 		if err != nil {
-			log.Fatalln("Error marshalling JSON heartbeat message: ", err)
+			log.Fatalln("Error marshalling heartbeat message: ", err)
 		}
 
 		_, err = c.conn.Write(b)
@@ -90,11 +205,141 @@ func (c *RolodexClient) sendLoop() {
 			return
 		case <-ticker.C:
 			break
+		case <-c.challenged:
+			break
 		}
 	}
 }
 
+func (c *RolodexClient) heartbeat() HeartbeatMessage {
+	heartbeat := HeartbeatMessage{NetworkName: c.networkName, MemberID: c.memberID, Invite: c.invite}
+
+	if c.maps != nil {
+		heartbeat.MapUpdates = true
+		heartbeat.MapEpoch, heartbeat.MapVersion = c.maps.ack()
+	}
+
+	c.challengeLock.Lock()
+	defer c.challengeLock.Unlock()
+
+	if c.challenge == nil {
+		return heartbeat
+	}
+
+	heartbeat.Challenge = c.challenge
+
+	if c.joinSecret != nil {
+		heartbeat.Proof = joinProof(c.joinSecret, c.challenge, c.networkName, c.memberID)
+	}
+
+	if c.memberIDKey != nil {
+		heartbeat.IDProof = memberIDProof(c.memberIDKey, c.challenge, c.networkName)
+	}
+
+	return heartbeat
+}
+
+func (c *RolodexClient) onJoinChallenge(challenge []byte) {
+	c.challengeLock.Lock()
+	answered := bytes.Equal(c.challenge, challenge)
+	c.challenge = append([]byte(nil), challenge...)
+	c.challengeLock.Unlock()
+
+	if c.joinSecret == nil && c.memberIDKey == nil {
+		log.Warn("The rolodex needs a join secret to join the network")
+		return
+	}
+
+	if answered {
+		// Our answer wasn't enough, so there's no use answering again
+		// straight away
+		log.Debug("Challenged again by the rolodex, which may need a join secret")
+		return
+	}
+
+	// Answer the challenge now rather than waiting for the next heartbeat
+	select {
+	case c.challenged <- struct{}{}:
+	default:
+	}
+}
+
+func (c *RolodexClient) onMapUpdate(frame []byte) {
+	if c.maps == nil {
+		return
+	}
+
+	nmap, ok, err := c.maps.apply(frame)
+
+	if err != nil {
+		log.Error("Error reading map update: ", err)
+		return
+	}
+
+	if ok {
+		c.callback(nmap)
+	}
+}
+
+func (c *RolodexClient) onWireMessage(msg []byte) {
+	msgType, fields, err := parseWireMessage(msg)
+
+	if err != nil {
+		log.Error("Error reading message from the rolodex: ", err)
+		return
+	}
+
+	atomic.StoreInt64(c.lastBinary, time.Now().UnixNano())
+
+	switch msgType {
+	case wireNetworkMap:
+		nmap, err := decodeNetworkMap(fields)
+
+		if err != nil {
+			log.Error("Error reading network map: ", err)
+			return
+		}
+
+		c.callback(nmap)
+	case wireMapDelta, wireMapSnapshot:
+		c.onMapUpdate(msg)
+	default:
+		// Newer rolodexes may send messages we don't know about yet
+		log.Debug("Ignoring binary message of unknown type ", msgType)
+	}
+}
+
+// encodeHeartbeat marshals the heartbeat in the binary wire format if the
+// rolodex has been using it, or JSON otherwise. A rolodex that stops using
+// the binary format, such as from being replaced with an older one, is sent
+// JSON again.
+func (c *RolodexClient) encodeHeartbeat(heartbeat HeartbeatMessage) ([]byte, error) {
+	lastBinary := time.Unix(0, atomic.LoadInt64(c.lastBinary))
+
+	if time.Since(lastBinary) < rolodexSilenceIntervals*c.sendRate {
+		return encodeHeartbeat(heartbeat), nil
+	}
+
+	heartbeat.WireVersion = wireVersion
+
+	return json.Marshal(heartbeat)
+}
+
+func (c *RolodexClient) isStopped() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop stops sending heartbeats and closes the connection to the rolodex
 func (c *RolodexClient) Stop() {
+	close(c.quit)
+
+	// Not all conns unblock pending reads when they're closed, so make sure
+	// the read loop wakes up to notice that we're stopping
+	c.conn.SetReadDeadline(time.Now())
 	c.conn.Close()
-	c.quit <- true
 }
@@ -2,6 +2,9 @@ package meshboi
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net"
 	"testing"
 	"time"
@@ -18,7 +21,7 @@ func TestNetworkCallback(t *testing.T) {
 		nmap = member
 	}
 	client, server := net.Pipe()
-	rolloClient := NewRolodexClient("testNet", client, time.Second, callback)
+	rolloClient := NewRolodexClient("testNet", "testMember", client, time.Second, callback)
 
 	go rolloClient.Run()
 	defer rolloClient.Stop()
@@ -47,7 +50,7 @@ func TestClientSendsHeartBeat(t *testing.T) {
 	callback := func(member NetworkMap) {
 	}
 	client, server := net.Pipe()
-	rolloClient := NewRolodexClient("testNet", client, time.Millisecond, callback)
+	rolloClient := NewRolodexClient("testNet", "testMember", client, time.Millisecond, callback)
 	go rolloClient.Run()
 	defer rolloClient.Stop()
 
@@ -60,3 +63,83 @@ func TestClientSendsHeartBeat(t *testing.T) {
 		t.Fatalf("Didn't contain the network name %v", string(b[:n]))
 	}
 }
+
+// Tests that the session with the rolodex is started again when the rolodex
+// goes quiet
+func TestClientRedialsSilentRolodex(t *testing.T) {
+	callback := func(member NetworkMap) {
+	}
+	client, server := net.Pipe()
+	go io.Copy(ioutil.Discard, server)
+
+	rolloClient := NewRolodexClient("testNet", "testMember", client, time.Millisecond, callback)
+	redialed := make(chan struct{}, 1)
+	rolloClient.redial = func() error {
+		select {
+		case redialed <- struct{}{}:
+		default:
+		}
+
+		return nil
+	}
+
+	go rolloClient.Run()
+	defer rolloClient.Stop()
+
+	select {
+	case <-redialed:
+	case <-time.After(time.Second):
+		t.Fatalf("Didn't redial the rolodex")
+	}
+}
+
+// Tests that heartbeats are sent in the binary format once the rolodex uses it
+func TestClientSwitchesToBinary(t *testing.T) {
+	maps := make(chan NetworkMap, 1)
+	callback := func(member NetworkMap) {
+		select {
+		case maps <- member:
+		default:
+		}
+	}
+	client, server := net.Pipe()
+	rolloClient := NewRolodexClient("testNet", "testMember", client, 10*time.Millisecond, callback)
+	go rolloClient.Run()
+	defer rolloClient.Stop()
+
+	b := make([]byte, 1000)
+	n, _ := server.Read(b)
+
+	var heartbeat HeartbeatMessage
+
+	if err := json.Unmarshal(b[:n], &heartbeat); err != nil || heartbeat.WireVersion != wireVersion {
+		t.Fatalf("Expected a JSON heartbeat with the wire version but got %v", string(b[:n]))
+	}
+
+	nmap := NetworkMap{Members: []MemberAddrs{{IPv4: netaddr.MustParseIPPort("192.168.4.1:2000")}}}
+	server.Write(nmap.encode(true))
+
+	select {
+	case got := <-maps:
+		if len(got.Members) != 1 || got.Addresses[0] != nmap.Members[0].IPv4 {
+			t.Fatalf("Wrong network map %v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Didn't get the network map")
+	}
+
+	// A JSON heartbeat may have been sent before the map arrived
+	server.SetReadDeadline(time.Now().Add(time.Second))
+
+	for {
+		n, err := server.Read(b)
+
+		if err != nil {
+			t.Fatal("Didn't get a binary heartbeat: ", err)
+		}
+
+		if isWireMessage(b[:n]) {
+			break
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package meshboi
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/samvrlewis/udp"
+	log "github.com/sirupsen/logrus"
+	"inet.af/netaddr"
+)
+
+// How long a handshake with the rolodex can take before giving up on it
+const rolodexHandshakeTimeout = 10 * time.Second
+
+// The most handshakes the rolodex does at once, and the most sessions it
+// holds at once. Members beyond these are refused until there's room, so a
+// flood of handshakes can't use up the rolodex's memory.
+const (
+	maxRolodexHandshakes = 256
+	maxRolodexSessions   = 4 * DefaultMaxNetworks
+)
+
+// How many messages from members can wait to be handled before the sessions
+// they're from wait for room
+const rolodexIncomingLen = 1024
+
+// rolodexTransport is how the rolodex exchanges messages with members
+type rolodexTransport interface {
+	// ReadFrom reads the next message from any member
+	ReadFrom(p []byte) (int, netaddr.IPPort, error)
+	WriteTo(p []byte, addr netaddr.IPPort) error
+}
+
+// udpTransport sends messages to members in plain UDP datagrams
+type udpTransport struct {
+	conn *net.UDPConn
+}
+
+func (t udpTransport) ReadFrom(p []byte) (int, netaddr.IPPort, error) {
+	n, addr, err := t.conn.ReadFromUDP(p)
+
+	if err != nil {
+		return 0, netaddr.IPPort{}, err
+	}
+
+	ipPort, ok := netaddr.FromStdAddr(addr.IP, addr.Port, "")
+
+	if !ok {
+		return 0, netaddr.IPPort{}, errors.New("invalid address " + addr.String())
+	}
+
+	return n, ipPort, nil
+}
+
+func (t udpTransport) WriteTo(p []byte, addr netaddr.IPPort) error {
+	_, err := t.conn.WriteToUDP(p, addr.UDPAddr())
+
+	return err
+}
+
+type rolodexMessage struct {
+	addr netaddr.IPPort
+	data []byte
+}
+
+// dtlsTransport sends messages to members over a DTLS session with each
+// member, so that they can't be read or forged by anyone else on the path
+type dtlsTransport struct {
+	listener *udp.Listener
+	config   *dtls.Config
+	// How long a session can go without hearing from the member before it's
+	// closed
+	timeout  time.Duration
+	sessions map[netaddr.IPPort]*dtls.Conn
+	lock     sync.Mutex
+	incoming chan rolodexMessage
+	// Hold a slot for each handshake or session in progress
+	handshakes   chan struct{}
+	sessionSlots chan struct{}
+}
+
+func newDTLSTransport(laddr *net.UDPAddr, cert tls.Certificate, timeout time.Duration) (*dtlsTransport, error) {
+	lc := udp.ListenConfig{
+		AcceptFilter: isDtlsHandshake,
+	}
+
+	listener, err := lc.Listen("udp", laddr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &dtlsTransport{
+		listener: listener.(*udp.Listener),
+		config: &dtls.Config{
+			Certificates:         []tls.Certificate{cert},
+			CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+			ConnectContextMaker: func() (context.Context, func()) {
+				return context.WithTimeout(context.Background(), rolodexHandshakeTimeout)
+			},
+		},
+		timeout:      timeout,
+		sessions:     make(map[netaddr.IPPort]*dtls.Conn),
+		incoming:     make(chan rolodexMessage, rolodexIncomingLen),
+		handshakes:   make(chan struct{}, maxRolodexHandshakes),
+		sessionSlots: make(chan struct{}, maxRolodexSessions),
+	}
+
+	go t.acceptLoop()
+
+	return t, nil
+}
+
+func (t *dtlsTransport) acceptLoop() {
+	for {
+		conn, err := t.listener.Accept()
+
+		if err != nil {
+			log.Error("Error accepting member session: ", err)
+			close(t.incoming)
+			return
+		}
+
+		if !t.admit() {
+			log.Debug("Too many handshakes or sessions, refusing ", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// Handshakes are done separately so that a slow member can't hold up
+		// the others
+		go t.serve(conn)
+	}
+}
+
+// admit takes a handshake slot and a session slot for a new member, if there
+// are both. serve gives them back.
+func (t *dtlsTransport) admit() bool {
+	select {
+	case t.sessionSlots <- struct{}{}:
+	default:
+		return false
+	}
+
+	select {
+	case t.handshakes <- struct{}{}:
+		return true
+	default:
+		<-t.sessionSlots
+		return false
+	}
+}
+
+func (t *dtlsTransport) serve(conn net.Conn) {
+	defer func() { <-t.sessionSlots }()
+
+	addr, err := netaddr.ParseIPPort(conn.RemoteAddr().String())
+
+	if err != nil {
+		<-t.handshakes
+		conn.Close()
+		return
+	}
+
+	session, err := dtls.Server(conn, t.config)
+	<-t.handshakes
+
+	if err != nil {
+		log.Debug("Error in handshake with ", addr, ": ", err)
+		conn.Close()
+		return
+	}
+
+	t.lock.Lock()
+	if old, ok := t.sessions[addr]; ok {
+		old.Close()
+	}
+	t.sessions[addr] = session
+	t.lock.Unlock()
+
+	defer func() {
+		t.lock.Lock()
+		if t.sessions[addr] == session {
+			delete(t.sessions, addr)
+		}
+		t.lock.Unlock()
+
+		session.Close()
+	}()
+
+	buf := make([]byte, 65535)
+
+	for {
+		session.SetReadDeadline(time.Now().Add(t.timeout))
+		n, err := session.Read(buf)
+
+		if err != nil {
+			log.Debug("Closing session with ", addr, ": ", err)
+			return
+		}
+
+		t.incoming <- rolodexMessage{addr: addr, data: append([]byte(nil), buf[:n]...)}
+	}
+}
+
+func (t *dtlsTransport) ReadFrom(p []byte) (int, netaddr.IPPort, error) {
+	msg, ok := <-t.incoming
+
+	if !ok {
+		return 0, netaddr.IPPort{}, errors.New("rolodex listener closed")
+	}
+
+	return copy(p, msg.data), msg.addr, nil
+}
+
+func (t *dtlsTransport) WriteTo(p []byte, addr netaddr.IPPort) error {
+	t.lock.Lock()
+	session, ok := t.sessions[addr]
+	t.lock.Unlock()
+
+	if !ok {
+		return errors.New("no session with " + addr.String())
+	}
+
+	_, err := session.Write(p)
+
+	return err
+}
+
+// NewDTLSRolodex makes a rolodex that members talk to over DTLS. Members
+// check that the rolodex has the certificate they expect, so nobody else can
+// read or forge the messages between them.
+func NewDTLSRolodex(laddr *net.UDPAddr, cert tls.Certificate, sendInterval time.Duration, timeOutDuration time.Duration) (*rolodex, error) {
+	transport, err := newDTLSTransport(laddr, cert, timeOutDuration)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newRolodex(transport, sendInterval, timeOutDuration)
+}
+
+// LoadOrCreateRolodexCert loads the rolodex's certificate and key from the
+// file, creating a self signed one if the file doesn't exist yet. Members
+// trust the certificate by its fingerprint, so it doesn't need a CA.
+func LoadOrCreateRolodexCert(path string) (tls.Certificate, error) {
+	b, err := ioutil.ReadFile(path)
+
+	if err == nil {
+		return tls.X509KeyPair(b, b)
+	}
+
+	if !os.IsNotExist(err) {
+		return tls.Certificate{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := randomSerial()
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "meshboi rolodex"},
+		NotBefore:    now.Add(-time.Minute),
+		// The certificate is pinned rather than checked against a CA, so it
+		// doesn't need to expire
+		NotAfter:    now.Add(100 * 365 * 24 * time.Hour),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certPEM, keyPEM, err := encodeCertAndKey(der, key)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := ioutil.WriteFile(path, append(certPEM, keyPEM...), 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// CertFingerprint returns the SHA-256 hash of the certificate, which members
+// use to recognise the rolodex
+func CertFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+
+	return hex.EncodeToString(sum[:])
+}
+
+func ParseCertFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) != sha256.Size {
+		return nil, errors.New("fingerprint is the wrong size")
+	}
+
+	return b, nil
+}
+
+// dialRolodex starts a DTLS session with the rolodex from the same socket
+// that's used to talk to members, so that the rolodex learns our address
+func dialRolodex(multiplexConn *MultiplexedDTLSConn, addr net.Addr, fingerprint []byte) (net.Conn, error) {
+	conn, err := multiplexConn.Dial(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := dtls.Client(conn, getRolodexDtlsConfig(fingerprint))
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// redialConn is a conn to the rolodex that can be replaced with a new
+// session, for when the rolodex has lost the old one such as by restarting
+type redialConn struct {
+	dial func() (net.Conn, error)
+	conn net.Conn
+	lock sync.RWMutex
+}
+
+func newRedialConn(dial func() (net.Conn, error)) (*redialConn, error) {
+	conn, err := dial()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &redialConn{dial: dial, conn: conn}, nil
+}
+
+func (c *redialConn) current() net.Conn {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.conn
+}
+
+// Redial closes the current session and starts a new one
+func (c *redialConn) Redial() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// The old conn has to be closed first as only one conn to an address can
+	// be dialed at a time
+	c.conn.Close()
+
+	conn, err := c.dial()
+
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+
+	return nil
+}
+
+func (c *redialConn) Read(p []byte) (int, error)         { return c.current().Read(p) }
+func (c *redialConn) Write(p []byte) (int, error)        { return c.current().Write(p) }
+func (c *redialConn) Close() error                       { return c.current().Close() }
+func (c *redialConn) LocalAddr() net.Addr                { return c.current().LocalAddr() }
+func (c *redialConn) RemoteAddr() net.Addr               { return c.current().RemoteAddr() }
+func (c *redialConn) SetDeadline(t time.Time) error      { return c.current().SetDeadline(t) }
+func (c *redialConn) SetReadDeadline(t time.Time) error  { return c.current().SetReadDeadline(t) }
+func (c *redialConn) SetWriteDeadline(t time.Time) error { return c.current().SetWriteDeadline(t) }
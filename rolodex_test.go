@@ -2,9 +2,19 @@ package meshboi
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+	"inet.af/netaddr"
 )
 
 func TestRolodex(t *testing.T) {
@@ -31,3 +41,567 @@ func TestRolodex(t *testing.T) {
 		t.Fatalf("Didn't get back expected IP")
 	}
 }
+
+// Tests that heartbeats from the same member over IPv4 and IPv6 are combined
+// into a single member with both addresses
+func TestRolodexDualStack(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6unspecified, Port: 33334})
+
+	if err != nil {
+		t.Skip("Dual stack sockets not supported: ", err)
+	}
+
+	rollo, _ := NewRolodex(conn, 100*time.Millisecond, 5*time.Second)
+	go rollo.Run()
+
+	client4, err := net.Dial("udp", "127.0.0.1:33334")
+
+	if err != nil {
+		t.Fatal("Couldn't dial over IPv4: ", err)
+	}
+
+	client6, err := net.Dial("udp", "[::1]:33334")
+
+	if err != nil {
+		t.Skip("IPv6 loopback not available: ", err)
+	}
+
+	// Heartbeats over both IP versions prove they're from the same member
+	maps := make(chan NetworkMap, 100)
+	member4 := NewRolodexClient("dualstack", "member", client4, 100*time.Millisecond, func(nmap NetworkMap) {
+		select {
+		case maps <- nmap:
+		default:
+		}
+	})
+	member6 := NewRolodexClient("dualstack", "member", client6, 100*time.Millisecond, func(NetworkMap) {})
+
+	go member4.Run()
+	defer member4.Stop()
+	go member6.Run()
+	defer member6.Stop()
+
+	deadline := time.After(2 * time.Second)
+
+	for {
+		select {
+		case nmap := <-maps:
+			if len(nmap.Members) != 1 {
+				t.Fatalf("Expected a single member but got %v", nmap.Members)
+			}
+
+			if !nmap.Members[0].IPv4.IP.IsZero() && !nmap.Members[0].IPv6.IP.IsZero() {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("Didn't get a network map with both addresses")
+		}
+	}
+}
+
+// Tests that relay frames are forwarded between members of the same network
+func TestRolodexRelay(t *testing.T) {
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 33335})
+	rollo, _ := NewRolodex(conn, time.Second, 5*time.Second)
+	rollo.EnableRelay()
+	go rollo.Run()
+
+	client1, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	client2, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	outsider, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	rolloAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	client1.WriteToUDP([]byte(`{"networkName": "relay", "memberID": "1"}`), rolloAddr)
+	client2.WriteToUDP([]byte(`{"networkName": "relay", "memberID": "2"}`), rolloAddr)
+	outsider.WriteToUDP([]byte(`{"networkName": "other", "memberID": "3"}`), rolloAddr)
+
+	time.Sleep(100 * time.Millisecond)
+
+	addr1 := netaddr.MustParseIPPort(client1.LocalAddr().String())
+	addr2 := netaddr.MustParseIPPort(client2.LocalAddr().String())
+
+	// Members of another network can't use the relay to reach the mesh
+	outsider.WriteToUDP(newRelayFrame(addr2, []byte("intruder")), rolloAddr)
+	client1.WriteToUDP(newRelayFrame(addr2, []byte("hello")), rolloAddr)
+
+	buf := make([]byte, 1000)
+	client2.SetReadDeadline(time.Now().Add(time.Second))
+
+	for {
+		n, err := client2.Read(buf)
+
+		if err != nil {
+			t.Fatal("Didn't receive relayed frame: ", err)
+		}
+
+		if !isRelayFrame(buf[:n]) {
+			// a network map
+			continue
+		}
+
+		src, payload, err := parseRelayFrame(buf[:n])
+
+		if err != nil || src != addr1 || string(payload) != "hello" {
+			t.Fatalf("Unexpected relayed frame %v %v %v", src, string(payload), err)
+		}
+
+		break
+	}
+}
+
+// Tests that members can talk to a rolodex over DTLS, but only if it has the
+// certificate they expect
+func TestDTLSRolodex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rolodex")
+
+	if err != nil {
+		t.Fatal("Error creating temp dir: ", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	certPath := filepath.Join(dir, "rolodex.pem")
+	cert, err := LoadOrCreateRolodexCert(certPath)
+
+	if err != nil {
+		t.Fatal("Error creating rolodex certificate: ", err)
+	}
+
+	if reloaded, _ := LoadOrCreateRolodexCert(certPath); CertFingerprint(reloaded) != CertFingerprint(cert) {
+		t.Fatalf("Rolodex certificate changed when reloaded")
+	}
+
+	rolodexAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 33336}
+	rollo, err := NewDTLSRolodex(rolodexAddr, cert, 100*time.Millisecond, 5*time.Second)
+
+	if err != nil {
+		t.Fatal("Error creating rolodex: ", err)
+	}
+
+	go rollo.Run()
+
+	member, _ := NewMultiplexedDTLSConn(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	defer member.Close()
+
+	otherCert, _ := LoadOrCreateRolodexCert(filepath.Join(dir, "other.pem"))
+	wrongFingerprint, _ := ParseCertFingerprint(CertFingerprint(otherCert))
+
+	if _, err := dialRolodex(member, rolodexAddr, wrongFingerprint); err == nil {
+		t.Fatalf("Connected to a rolodex with the wrong certificate")
+	}
+
+	fingerprint, _ := ParseCertFingerprint(CertFingerprint(cert))
+	conn, err := dialRolodex(member, rolodexAddr, fingerprint)
+
+	if err != nil {
+		t.Fatal("Error connecting to rolodex: ", err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte(`{"networkName": "dtls", "memberID": "member"}`))
+
+	buf := make([]byte, 1000)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+
+	if err != nil {
+		t.Fatal("Didn't get a network map: ", err)
+	}
+
+	var nmap NetworkMap
+
+	if err := json.Unmarshal(buf[:n], &nmap); err != nil {
+		t.Fatal("Error unmarshalling network map: ", err)
+	}
+
+	if len(nmap.Addresses) != 1 || nmap.Addresses[0].String() != member.listener.Addr().String() {
+		t.Fatalf("Expected our address in the network map but got %v", nmap.Addresses)
+	}
+}
+
+// Tests that members are refused once there are too many handshakes or
+// sessions
+func TestDTLSTransportAdmit(t *testing.T) {
+	transport := &dtlsTransport{
+		handshakes:   make(chan struct{}, 1),
+		sessionSlots: make(chan struct{}, 2),
+	}
+
+	if !transport.admit() {
+		t.Fatalf("First member refused")
+	}
+
+	if transport.admit() {
+		t.Fatalf("Admitted a member while handshake slots were full")
+	}
+
+	// The first handshake finishes, leaving its session
+	<-transport.handshakes
+
+	if !transport.admit() {
+		t.Fatalf("Second member refused")
+	}
+
+	<-transport.handshakes
+
+	if transport.admit() {
+		t.Fatalf("Admitted a member while session slots were full")
+	}
+}
+
+// Tests that only members that know the join secret learn about other members
+func TestRolodexJoinSecrets(t *testing.T) {
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 33337})
+	rollo, _ := NewRolodex(conn, 100*time.Millisecond, 5*time.Second)
+
+	if err := rollo.RequireJoinSecrets(map[string][]byte{"secure": []byte("secret")}); err != nil {
+		t.Fatal("Error requiring join secrets: ", err)
+	}
+
+	go rollo.Run()
+
+	outsider, _ := net.Dial("udp", "127.0.0.1:33337")
+	outsider.Write([]byte(`{"networkName": "secure", "memberID": "outsider"}`))
+
+	buf := make([]byte, 1000)
+	outsider.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := outsider.Read(buf)
+
+	if err != nil || !isJoinChallengeFrame(buf[:n]) {
+		t.Fatalf("Expected a join challenge but got %v %v", string(buf[:n]), err)
+	}
+
+	maps := make(chan NetworkMap, 10)
+	memberConn, _ := net.Dial("udp", "127.0.0.1:33337")
+	member := NewRolodexClient("secure", "member", memberConn, 100*time.Millisecond, func(nmap NetworkMap) {
+		maps <- nmap
+	})
+	member.joinSecret = []byte("secret")
+
+	go member.Run()
+	defer member.Stop()
+
+	select {
+	case nmap := <-maps:
+		if len(nmap.Addresses) != 1 || nmap.Addresses[0].String() != memberConn.LocalAddr().String() {
+			t.Fatalf("Expected only the member in the network map but got %v", nmap.Addresses)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Member with the join secret didn't get a network map")
+	}
+
+	// Neither a wrong secret nor an unknown network gets a network map
+	intruderConn, _ := net.Dial("udp", "127.0.0.1:33337")
+	intruderConn.Write([]byte(`{"networkName": "unknown", "memberID": "intruder"}`))
+
+	intruder := NewRolodexClient("secure", "intruder", intruderConn, 100*time.Millisecond, func(nmap NetworkMap) {
+		t.Errorf("Member with the wrong join secret got a network map")
+	})
+	intruder.joinSecret = []byte("wrong")
+
+	go intruder.Run()
+	defer intruder.Stop()
+
+	time.Sleep(300 * time.Millisecond)
+}
+
+// Tests that an invite can only be used by the first member to use it
+func TestRolodexInviteSingleUse(t *testing.T) {
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 33338})
+	rollo, _ := NewRolodex(conn, 100*time.Millisecond, 5*time.Second)
+
+	if err := rollo.RequireJoinSecrets(map[string][]byte{"secure": []byte("secret")}); err != nil {
+		t.Fatal("Error requiring join secrets: ", err)
+	}
+
+	go rollo.Run()
+
+	invite, err := NewInvite("secure", []byte("secret"), time.Minute)
+
+	if err != nil {
+		t.Fatal("Error creating invite: ", err)
+	}
+
+	maps := make(chan NetworkMap, 10)
+	firstConn, _ := net.Dial("udp", "127.0.0.1:33338")
+	first := NewRolodexClient("secure", "first", firstConn, 100*time.Millisecond, func(nmap NetworkMap) {
+		maps <- nmap
+	})
+	first.joinSecret = invite.Secret
+	first.invite = invite.Claim()
+
+	go first.Run()
+	defer first.Stop()
+
+	select {
+	case <-maps:
+	case <-time.After(time.Second):
+		t.Fatalf("Member with the invite didn't get a network map")
+	}
+
+	secondConn, _ := net.Dial("udp", "127.0.0.1:33338")
+	second := NewRolodexClient("secure", "second", secondConn, 100*time.Millisecond, func(nmap NetworkMap) {
+		t.Errorf("Second member using the invite got a network map")
+	})
+	second.joinSecret = invite.Secret
+	second.invite = invite.Claim()
+
+	go second.Run()
+	defer second.Stop()
+
+	time.Sleep(300 * time.Millisecond)
+}
+
+// discardTransport drops everything the rolodex sends
+type discardTransport struct{}
+
+func (discardTransport) ReadFrom(p []byte) (int, netaddr.IPPort, error) {
+	select {}
+}
+
+func (discardTransport) WriteTo(p []byte, addr netaddr.IPPort) error {
+	return nil
+}
+
+// challengeTransport keeps the challenges the rolodex sends
+type challengeTransport struct {
+	discardTransport
+	challenges chan []byte
+}
+
+func (c challengeTransport) WriteTo(p []byte, addr netaddr.IPPort) error {
+	if isJoinChallengeFrame(p) {
+		c.challenges <- p[1:]
+	}
+
+	return nil
+}
+
+// Tests that members are only known by their ID once they prove they hold it,
+// so that nobody else can move them to another address
+func TestRolodexMemberIDProof(t *testing.T) {
+	transport := challengeTransport{challenges: make(chan []byte, 10)}
+	rollo, _ := newRolodex(transport, time.Second, time.Minute)
+	key := memberIDKey("secret")
+	memberID := publicMemberID(key)
+	addr := netaddr.MustParseIPPort("192.168.4.1:2000")
+
+	heartbeat := func(msg HeartbeatMessage, from netaddr.IPPort) {
+		b, _ := json.Marshal(msg)
+		rollo.handle(b, from)
+	}
+
+	members := func() map[string]*meshMember {
+		mesh := rollo.getNetwork("test")
+		mesh.membersLock.Lock()
+		defer mesh.membersLock.Unlock()
+
+		members := make(map[string]*meshMember)
+
+		for id, member := range mesh.members {
+			copied := *member
+			members[id] = &copied
+		}
+
+		return members
+	}
+
+	heartbeat(HeartbeatMessage{NetworkName: "test", MemberID: memberID}, addr)
+
+	if len(members()) != 0 {
+		t.Fatalf("Member registered without proving its ID")
+	}
+
+	challenge := <-transport.challenges
+	heartbeat(HeartbeatMessage{
+		NetworkName: "test",
+		MemberID:    memberID,
+		Challenge:   challenge,
+		IDProof:     memberIDProof(key, challenge, "test"),
+	}, addr)
+
+	if member, ok := members()[memberID]; !ok || member.ipv4.addr != addr {
+		t.Fatalf("Member that proved its ID wasn't registered")
+	}
+
+	// Someone who has seen the member's heartbeats can't take its place
+	otherAddr := netaddr.MustParseIPPort("192.168.4.2:2000")
+	heartbeat(HeartbeatMessage{NetworkName: "test", MemberID: memberID}, otherAddr)
+	otherChallenge := <-transport.challenges
+	heartbeat(HeartbeatMessage{
+		NetworkName: "test",
+		MemberID:    memberID,
+		Challenge:   otherChallenge,
+		IDProof:     memberIDProof(memberIDKey("guess"), otherChallenge, "test"),
+	}, otherAddr)
+
+	if member := members()[memberID]; member.ipv4.addr != addr || len(members()) != 1 {
+		t.Fatalf("Member was moved by someone without its key")
+	}
+
+	// Members without a public ID are known by their address
+	heartbeat(HeartbeatMessage{NetworkName: "test", MemberID: "legacy"}, otherAddr)
+
+	if _, ok := members()[otherAddr.String()]; !ok {
+		t.Fatalf("Member without a public ID wasn't known by its address")
+	}
+}
+
+func (r *rolodex) networkCount() int {
+	r.networksLock.Lock()
+	defer r.networksLock.Unlock()
+
+	return len(r.networks)
+}
+
+// Tests that networks are removed once their members have all gone
+func TestEmptyNetworkRemoved(t *testing.T) {
+	rollo, _ := newRolodex(discardTransport{}, 10*time.Millisecond, 50*time.Millisecond)
+	rollo.register("test", "member", netaddr.MustParseIPPort("192.168.4.1:2000"), nil, false)
+	mesh := rollo.getNetwork("test")
+
+	deadline := time.Now().Add(time.Second)
+
+	for rollo.networkCount() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Empty network wasn't removed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if mesh.register("member", netaddr.MustParseIPPort("192.168.4.1:2000"), nil, false) {
+		t.Fatalf("Member registered with a removed network")
+	}
+
+	// Members can still join the network again
+	rollo.register("test", "member", netaddr.MustParseIPPort("192.168.4.1:2000"), nil, false)
+
+	if rollo.networkCount() != 1 {
+		t.Fatalf("Network wasn't made again")
+	}
+}
+
+func TestMaxNetworks(t *testing.T) {
+	rollo, _ := newRolodex(discardTransport{}, time.Second, 5*time.Second)
+	rollo.SetMaxNetworks(1)
+
+	rollo.register("first", "member", netaddr.MustParseIPPort("192.168.4.1:2000"), nil, false)
+	rollo.register("second", "member", netaddr.MustParseIPPort("192.168.4.2:2000"), nil, false)
+
+	if rollo.networkCount() != 1 {
+		t.Fatalf("Expected 1 network but got %v", rollo.networkCount())
+	}
+
+	if rollo.getNetwork("second") != nil {
+		t.Fatalf("Network made past the limit")
+	}
+}
+
+// syntheticHeartbeats makes heartbeats from members spread over the networks,
+// along with the address each is from
+func syntheticHeartbeats(networks int, members int) ([][]byte, []netaddr.IPPort) {
+	heartbeats := make([][]byte, members)
+	addrs := make([]netaddr.IPPort, members)
+
+	for i := range heartbeats {
+		heartbeats[i], _ = json.Marshal(HeartbeatMessage{
+			NetworkName: fmt.Sprint("network", i%networks),
+			MemberID:    fmt.Sprint("member", i),
+		})
+		addrs[i] = netaddr.IPPort{IP: netaddr.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 2000}
+	}
+
+	return heartbeats, addrs
+}
+
+// Tests that heartbeats can be handled from several goroutines at once
+func TestRolodexConcurrentHeartbeats(t *testing.T) {
+	rollo, _ := newRolodex(discardTransport{}, time.Second, time.Minute)
+	heartbeats, addrs := syntheticHeartbeats(10, 100)
+
+	var wg sync.WaitGroup
+
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+
+		go func(worker int) {
+			defer wg.Done()
+
+			for i := worker; i < len(heartbeats); i += 4 {
+				rollo.handle(heartbeats[i], addrs[i])
+			}
+		}(worker)
+	}
+
+	wg.Wait()
+
+	if rollo.networkCount() != 10 {
+		t.Fatalf("Expected 10 networks but got %v", rollo.networkCount())
+	}
+
+	if !rollo.sameNetwork(addrs[0], addrs[10]) {
+		t.Fatalf("Members of the same network weren't found together")
+	}
+
+	if rollo.sameNetwork(addrs[0], addrs[1]) {
+		t.Fatalf("Members of different networks were found together")
+	}
+}
+
+// Drives synthetic heartbeats from tens of thousands of members of thousands
+// of networks through the rolodex
+func BenchmarkRolodexHeartbeats(b *testing.B) {
+	rollo, _ := newRolodex(discardTransport{}, time.Minute, time.Hour)
+	heartbeats, addrs := syntheticHeartbeats(2000, 40000)
+
+	// Logging every new member would swamp the benchmark
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	// Register everyone first so that the benchmark measures the steady state
+	for i := range heartbeats {
+		rollo.handle(heartbeats[i], addrs[i])
+	}
+
+	var next uint64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddUint64(&next, 1) % uint64(len(heartbeats))
+			rollo.handle(heartbeats[i], addrs[i])
+		}
+	})
+}
+
+// Tests that registering members doesn't wait for the network map to be sent,
+// and that new members are sent out together
+func TestRegisterDoesntBlock(t *testing.T) {
+	rollo, _ := newRolodex(discardTransport{}, time.Second, time.Minute)
+	// Not served, so nothing takes the notifications
+	mesh := newMeshNetwork(rollo, "test")
+	_, addrs := syntheticHeartbeats(1, 10)
+
+	registered := make(chan struct{})
+
+	go func() {
+		for i, addr := range addrs {
+			mesh.register(fmt.Sprint("member", i), addr, nil, false)
+		}
+
+		close(registered)
+	}()
+
+	select {
+	case <-registered:
+	case <-time.After(time.Second):
+		t.Fatalf("Registering blocked")
+	}
+
+	if len(mesh.newMember) != 1 {
+		t.Fatalf("Expected one pending notification but got %v", len(mesh.newMember))
+	}
+}
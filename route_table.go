@@ -0,0 +1,122 @@
+package meshboi
+
+import (
+	"sync"
+
+	"inet.af/netaddr"
+)
+
+// RouteTable holds the subnets that peers have advertised as being reachable
+// through them, as well as the members that peers have offered to relay to,
+// and finds the most specific route for a destination
+type RouteTable struct {
+	routes map[netaddr.IPPrefix]route
+	lock   sync.RWMutex
+}
+
+type route struct {
+	peer *PeerConn
+	// whether the route is to a member relayed by the peer, rather than a
+	// subnet advertised by it
+	relayed bool
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{
+		routes: make(map[netaddr.IPPrefix]route),
+	}
+}
+
+// masked zeroes the host bits of the prefix so that equivalent prefixes are
+// stored under the same key
+func masked(prefix netaddr.IPPrefix) (netaddr.IPPrefix, error) {
+	return prefix.IP.Prefix(prefix.Bits)
+}
+
+// SetPeerRoutes replaces the routes through the peer with the given prefixes.
+// It returns the prefixes that weren't previously routed anywhere and the
+// prefixes that are no longer routed anywhere.
+func (r *RouteTable) SetPeerRoutes(peer *PeerConn, prefixes []netaddr.IPPrefix) (added []netaddr.IPPrefix, removed []netaddr.IPPrefix) {
+	return r.setRoutes(peer, prefixes, false)
+}
+
+// SetRelayedMembers replaces the members that are relayed through the peer.
+// Unlike subnets, these are within the VPN's subnet so the kernel already
+// routes them into the tun.
+func (r *RouteTable) SetRelayedMembers(peer *PeerConn, ips []netaddr.IP) {
+	prefixes := make([]netaddr.IPPrefix, 0, len(ips))
+
+	for _, ip := range ips {
+		prefixes = append(prefixes, netaddr.IPPrefix{IP: ip, Bits: ip.BitLen()})
+	}
+
+	r.setRoutes(peer, prefixes, true)
+}
+
+func (r *RouteTable) setRoutes(peer *PeerConn, prefixes []netaddr.IPPrefix, relayed bool) (added []netaddr.IPPrefix, removed []netaddr.IPPrefix) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	wanted := make(map[netaddr.IPPrefix]bool)
+
+	for _, prefix := range prefixes {
+		prefix, err := masked(prefix)
+
+		if err != nil {
+			continue
+		}
+
+		wanted[prefix] = true
+
+		if _, ok := r.routes[prefix]; ok {
+			// If another peer already advertises this prefix then it keeps the
+			// route until it goes away, rather than it flapping between them
+			continue
+		}
+
+		r.routes[prefix] = route{peer: peer, relayed: relayed}
+		added = append(added, prefix)
+	}
+
+	for prefix, existing := range r.routes {
+		if existing.peer == peer && existing.relayed == relayed && !wanted[prefix] {
+			delete(r.routes, prefix)
+			removed = append(removed, prefix)
+		}
+	}
+
+	return added, removed
+}
+
+// RemovePeer removes all routes through the peer, returning the subnets that
+// are no longer routed anywhere
+func (r *RouteTable) RemovePeer(peer *PeerConn) []netaddr.IPPrefix {
+	r.setRoutes(peer, nil, true)
+	_, removed := r.setRoutes(peer, nil, false)
+
+	return removed
+}
+
+// Lookup returns the peer with the longest prefix match for the IP
+func (r *RouteTable) Lookup(ip netaddr.IP) (*PeerConn, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if len(r.routes) == 0 {
+		return nil, false
+	}
+
+	for bits := int(ip.BitLen()); bits >= 0; bits-- {
+		prefix, err := ip.Prefix(uint8(bits))
+
+		if err != nil {
+			continue
+		}
+
+		if route, ok := r.routes[prefix]; ok {
+			return route.peer, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,102 @@
+package meshboi
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestLongestPrefixMatch(t *testing.T) {
+	routes := NewRouteTable()
+
+	wide := NewFakePeerConn(tests[0].insideIP, tests[0].outsideIP)
+	narrow := NewFakePeerConn(tests[1].insideIP, tests[1].outsideIP)
+
+	routes.SetPeerRoutes(wide, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.20.0.0/16")})
+	routes.SetPeerRoutes(narrow, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.20.30.0/24")})
+
+	peer, ok := routes.Lookup(netaddr.MustParseIP("10.20.30.4"))
+
+	if !ok || peer != narrow {
+		t.Errorf("Expected the most specific route")
+	}
+
+	peer, ok = routes.Lookup(netaddr.MustParseIP("10.20.1.1"))
+
+	if !ok || peer != wide {
+		t.Errorf("Expected the wider route")
+	}
+
+	if _, ok := routes.Lookup(netaddr.MustParseIP("10.21.0.1")); ok {
+		t.Errorf("Shouldn't have found a route")
+	}
+}
+
+func TestReplaceAndRemoveRoutes(t *testing.T) {
+	routes := NewRouteTable()
+	peer := NewFakePeerConn(tests[0].insideIP, tests[0].outsideIP)
+
+	// Prefixes that aren't masked are treated the same as masked ones
+	added, removed := routes.SetPeerRoutes(peer, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.20.1.1/16"), netaddr.MustParseIPPrefix("fd00:20::/64")})
+
+	if len(added) != 2 || len(removed) != 0 {
+		t.Fatalf("Unexpected changes %v %v", added, removed)
+	}
+
+	if added[0] != netaddr.MustParseIPPrefix("10.20.0.0/16") {
+		t.Fatalf("Prefix wasn't masked %v", added[0])
+	}
+
+	added, removed = routes.SetPeerRoutes(peer, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.20.0.0/16")})
+
+	if len(added) != 0 || len(removed) != 1 || removed[0] != netaddr.MustParseIPPrefix("fd00:20::/64") {
+		t.Fatalf("Unexpected changes %v %v", added, removed)
+	}
+
+	if _, ok := routes.Lookup(netaddr.MustParseIP("fd00:20::1")); ok {
+		t.Fatalf("Found removed route")
+	}
+
+	removed = routes.RemovePeer(peer)
+
+	if len(removed) != 1 {
+		t.Fatalf("Expected one route removed but got %v", removed)
+	}
+
+	if _, ok := routes.Lookup(netaddr.MustParseIP("10.20.0.1")); ok {
+		t.Fatalf("Found removed route")
+	}
+}
+
+// Tests that relayed members and subnets through the same peer are kept
+// separately
+func TestRelayedMembers(t *testing.T) {
+	routes := NewRouteTable()
+	relay := NewFakePeerConn(tests[0].insideIP, tests[0].outsideIP)
+	member := netaddr.MustParseIP("192.168.4.9")
+
+	routes.SetPeerRoutes(relay, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.20.0.0/16")})
+	routes.SetRelayedMembers(relay, []netaddr.IP{member})
+
+	if peer, ok := routes.Lookup(member); !ok || peer != relay {
+		t.Fatalf("Expected relayed member to be routed through the relay")
+	}
+
+	// Updating the subnets doesn't affect the relayed members
+	routes.SetPeerRoutes(relay, nil)
+
+	if _, ok := routes.Lookup(member); !ok {
+		t.Fatalf("Relayed member was removed along with subnets")
+	}
+
+	routes.SetPeerRoutes(relay, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.20.0.0/16")})
+	removed := routes.RemovePeer(relay)
+
+	if len(removed) != 1 || removed[0] != netaddr.MustParseIPPrefix("10.20.0.0/16") {
+		t.Fatalf("Expected only the subnet to be returned but got %v", removed)
+	}
+
+	if _, ok := routes.Lookup(member); ok {
+		t.Fatalf("Relayed member wasn't removed with the relay")
+	}
+}
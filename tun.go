@@ -28,6 +28,13 @@ type TunConn interface {
 	io.ReadWriteCloser
 }
 
+// A TunConn that the kernel can be told to route subnets into
+type RoutableTun interface {
+	TunConn
+	AddRoute(prefix string) error
+	DelRoute(prefix string) error
+}
+
 //https://www.kernel.org/doc/Documentation/networking/tuntap.txt
 func NewTun(name string) (*Tun, error) {
 	tunFile, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
@@ -54,15 +61,17 @@ func NewTun(name string) (*Tun, error) {
 }
 
 // Makes a Tun with the desired config and immediately sets it up
-func NewTunWithConfig(name string, ip string, mtu int) (*Tun, error) {
+func NewTunWithConfig(name string, ips []string, mtu int) (*Tun, error) {
 	tun, err := NewTun(name)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if err := tun.SetNetwork(ip); err != nil {
-		return nil, err
+	for _, ip := range ips {
+		if err := tun.SetNetwork(ip); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := tun.SetMtu(mtu); err != nil {
@@ -105,3 +114,23 @@ func (t Tun) SetMtu(mtu int) error {
 
 	return nil
 }
+
+func (t Tun) AddRoute(prefix string) error {
+	cmd := exec.Command("/sbin/ip", "route", "add", prefix, "dev", t.Name)
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t Tun) DelRoute(prefix string) error {
+	cmd := exec.Command("/sbin/ip", "route", "del", prefix, "dev", t.Name)
+
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -1,29 +1,38 @@
 package meshboi
 
 import (
+	"errors"
+	"fmt"
 	"net"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"inet.af/netaddr"
 
 	log "github.com/sirupsen/logrus"
 )
 
 type TunRouter struct {
-	tun     TunConn
-	store   *PeerConnStore
-	stopped bool
+	tun    TunConn
+	store  *PeerConnStore
+	routes *RouteTable
+	quit   chan struct{}
+	// optional, drops packets to peers that the ACL doesn't allow
+	acl *ACL
 }
 
-func NewTunRouter(tun TunConn, store *PeerConnStore) TunRouter {
+func NewTunRouter(tun TunConn, store *PeerConnStore, routes *RouteTable) TunRouter {
 	return TunRouter{
-		tun:     tun,
-		store:   store,
-		stopped: false,
+		tun:    tun,
+		store:  store,
+		routes: routes,
+		quit:   make(chan struct{}),
 	}
 }
 
-func (tr *TunRouter) Run() {
+// Run routes packets read from the tun to peers until the router is stopped,
+// in which case nil is returned, or until the tun fails
+func (tr *TunRouter) Run() error {
 	packet := make([]byte, bufSize)
 
 	for {
@@ -34,30 +43,41 @@ func (tr *TunRouter) Run() {
 		}
 
 		if err != nil {
-			if !tr.stopped {
-				log.Fatalln("Serious error reading from tun device: ", err)
+			select {
+			case <-tr.quit:
+				return nil
+			default:
+				log.Error("Serious error reading from tun device: ", err)
+				return err
 			}
-			break
 		}
 
-		header, err := ipv4.ParseHeader(packet[:n])
+		vpnIP, err := destinationIP(packet[:n])
 
 		if err != nil {
-			log.Error("Error parsing ipv4 header of tun packet: ", err)
+			log.Error("Error parsing header of tun packet: ", err)
 			continue
 		}
 
-		vpnIP, ok := netaddr.FromStdIP(header.Dst)
+		peer, ok := tr.store.GetByInsideIp(vpnIP)
 
 		if !ok {
-			log.Error("Error converting to netaddr IP")
-			continue
+			// Not destined for a peer itself, but maybe for a subnet behind one
+			peer, ok = tr.routes.Lookup(vpnIP)
 		}
 
-		peer, ok := tr.store.GetByInsideIp(vpnIP)
-
 		if !ok {
-			log.Warn("Dropping data destined for ", vpnIP)
+			if vpnIP.IsMulticast() {
+				// The kernel regularly sends multicast (eg IPv6 router
+				// solicitations) that isn't destined for any peer
+				log.Debug("Dropping multicast data destined for ", vpnIP)
+			} else {
+				log.Warn("Dropping data destined for ", vpnIP)
+			}
+			continue
+		}
+
+		if !tr.acl.allowEgress(packet[:n], peer) {
 			continue
 		}
 
@@ -68,7 +88,45 @@ func (tr *TunRouter) Run() {
 	}
 }
 
+// destinationIP returns the destination address of an IPv4 or IPv6 packet
+func destinationIP(packet []byte) (netaddr.IP, error) {
+	if len(packet) == 0 {
+		return netaddr.IP{}, errors.New("empty packet")
+	}
+
+	var dst net.IP
+
+	switch version := int(packet[0] >> 4); version {
+	case ipv4.Version:
+		header, err := ipv4.ParseHeader(packet)
+
+		if err != nil {
+			return netaddr.IP{}, err
+		}
+
+		dst = header.Dst
+	case ipv6.Version:
+		header, err := ipv6.ParseHeader(packet)
+
+		if err != nil {
+			return netaddr.IP{}, err
+		}
+
+		dst = header.Dst
+	default:
+		return netaddr.IP{}, fmt.Errorf("unknown IP version %v", version)
+	}
+
+	ip, ok := netaddr.FromStdIP(dst)
+
+	if !ok {
+		return netaddr.IP{}, errors.New("error converting to netaddr IP")
+	}
+
+	return ip, nil
+}
+
 func (tr *TunRouter) Stop() error {
-	tr.stopped = true
+	close(tr.quit)
 	return tr.tun.Close()
 }
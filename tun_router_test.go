@@ -6,19 +6,20 @@ import (
 	"testing"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 	"inet.af/netaddr"
 )
 
 func TestRouter(t *testing.T) {
 	store := NewPeerConnStore()
 	tunClient, tunServer := net.Pipe()
-	tr := NewTunRouter(tunClient, store)
+	tr := NewTunRouter(tunClient, store, NewRouteTable())
 	go tr.Run()
 	defer tr.Stop()
 
 	peerClient, peerServer := net.Pipe()
 
-	peer := NewPeerConn(netaddr.MustParseIP("192.168.4.3"), netaddr.MustParseIPPort("192.152.12.2:2222"), peerClient, tunClient)
+	peer := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.4.3")}, netaddr.MustParseIPPort("192.152.12.2:2222"), peerClient, tunClient)
 	go peer.readLoop()
 	go peer.sendLoop()
 	store.Add(&peer)
@@ -44,3 +45,104 @@ func TestRouter(t *testing.T) {
 		t.Errorf("Messages not equal")
 	}
 }
+
+func TestRouterIPv6(t *testing.T) {
+	store := NewPeerConnStore()
+	tunClient, tunServer := net.Pipe()
+	tr := NewTunRouter(tunClient, store, NewRouteTable())
+	go tr.Run()
+	defer tr.Stop()
+
+	peerClient, peerServer := net.Pipe()
+
+	insideIPs := []netaddr.IP{netaddr.MustParseIP("192.168.4.3"), netaddr.MustParseIP("fd00:4::3")}
+	peer := NewPeerConn(insideIPs, netaddr.MustParseIPPort("192.152.12.2:2222"), peerClient, tunClient)
+	go peer.sendLoop()
+	store.Add(&peer)
+
+	hdr := make([]byte, ipv6.HeaderLen)
+	hdr[0] = ipv6.Version << 4
+	copy(hdr[8:24], net.ParseIP("fd00:4::2"))
+	copy(hdr[24:40], net.ParseIP("fd00:4::3"))
+
+	msg := append(hdr, []byte("hello")...)
+
+	tunServer.Write(msg)
+
+	readBytes := make([]byte, 1000)
+
+	n, _ := peerServer.Read(readBytes)
+
+	if !reflect.DeepEqual(readBytes[:n], msg) {
+		t.Errorf("Messages not equal")
+	}
+}
+
+func TestRouterSubnetRoute(t *testing.T) {
+	store := NewPeerConnStore()
+	routes := NewRouteTable()
+	tunClient, tunServer := net.Pipe()
+	tr := NewTunRouter(tunClient, store, routes)
+	go tr.Run()
+	defer tr.Stop()
+
+	peerClient, peerServer := net.Pipe()
+
+	peer := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.4.3")}, netaddr.MustParseIPPort("192.152.12.2:2222"), peerClient, tunClient)
+	go peer.sendLoop()
+	store.Add(&peer)
+	routes.SetPeerRoutes(&peer, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.1.0.0/16")})
+
+	hdr := ipv4.Header{
+		Src:     net.ParseIP("192.168.4.2"),
+		Dst:     net.ParseIP("10.1.2.3"),
+		Len:     20,
+		Version: 4,
+	}
+
+	hdrBytes, _ := hdr.Marshal()
+
+	msg := append(hdrBytes[:], []byte("hello")...)
+
+	tunServer.Write(msg)
+
+	readBytes := make([]byte, 1000)
+
+	n, _ := peerServer.Read(readBytes)
+
+	if !reflect.DeepEqual(readBytes[:n], msg) {
+		t.Errorf("Messages not equal")
+	}
+}
+
+func TestRouterACL(t *testing.T) {
+	store := NewPeerConnStore()
+	tunClient, tunServer := net.Pipe()
+	tr := NewTunRouter(tunClient, store, NewRouteTable())
+	tr.acl = NewACL(nil)
+	tr.acl.Update(&ACLPolicy{Rules: []ACLRule{{From: []string{"*"}, To: []string{"*"}, Protocol: "udp"}}})
+	go tr.Run()
+	defer tr.Stop()
+
+	peerClient, peerServer := net.Pipe()
+
+	peer := NewPeerConn([]netaddr.IP{netaddr.MustParseIP("192.168.4.3")}, netaddr.MustParseIPPort("192.152.12.2:2222"), peerClient, tunClient)
+	go peer.sendLoop()
+	store.Add(&peer)
+
+	tunServer.Write(ipv4Packet("192.168.4.2", "192.168.4.3", protocolTCP, 50000, 80))
+	allowed := ipv4Packet("192.168.4.2", "192.168.4.3", protocolUDP, 50000, 53)
+	tunServer.Write(allowed)
+
+	readBytes := make([]byte, 1000)
+
+	n, _ := peerServer.Read(readBytes)
+
+	if !reflect.DeepEqual(readBytes[:n], allowed) {
+		t.Errorf("Expected only the allowed packet to be sent")
+	}
+
+	if _, egress := tr.acl.Dropped(); egress != 1 {
+		t.Errorf("Expected 1 dropped packet but got %v", egress)
+	}
+}
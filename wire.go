@@ -0,0 +1,486 @@
+package meshboi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"inet.af/netaddr"
+)
+
+// Messages between the rolodex and members can be sent in a binary wire
+// format as well as the original JSON. Each binary message starts with a
+// magic number, the version of the format and the type of message, followed
+// by the message's fields. Each field is a tag, the length of the value as a
+// uvarint and the value, so fields that a receiver doesn't know about can be
+// skipped over. Only changes that older receivers can't cope with need a new
+// version.
+//
+// Members say which version they understand in their JSON heartbeats, and
+// the rolodex replies in the binary format to members that understand it.
+// Members only send binary heartbeats once they've heard the rolodex use the
+// binary format, so both sides can be upgraded independently.
+
+// The magic number can't be mistaken for the start of a JSON message or any
+// of the frames
+var wireMagic = [2]byte{'m', 'b'}
+
+// The newest version of the binary format that's understood
+const wireVersion byte = 1
+
+const wireHeaderSize = len(wireMagic) + 2
+
+// The types of binary message
+const (
+	wireHeartbeat   byte = 1
+	wireNetworkMap  byte = 2
+	wireMapDelta    byte = 3
+	wireMapSnapshot byte = 4
+)
+
+// Field tags of heartbeats
+const (
+	heartbeatNetworkName byte = iota + 1
+	heartbeatMemberID
+	heartbeatChallenge
+	heartbeatProof
+	heartbeatInviteID
+	heartbeatInviteExpires
+	heartbeatMapUpdates
+	heartbeatMapEpoch
+	heartbeatMapVersion
+	heartbeatIDProof
+)
+
+// Field tags of network maps
+const (
+	networkMapYourIndex byte = iota + 1
+	networkMapMember
+)
+
+// Field tags of map deltas
+const (
+	mapDeltaEpoch byte = iota + 1
+	mapDeltaFrom
+	mapDeltaVersion
+	mapDeltaChanged
+	mapDeltaLeft
+)
+
+// Field tags of map snapshots
+const (
+	mapSnapshotEpoch byte = iota + 1
+	mapSnapshotVersion
+	mapSnapshotFragment
+	mapSnapshotFragments
+	mapSnapshotMember
+)
+
+// Field tags of the members in network maps, deltas and snapshots
+const (
+	memberIPv4 byte = iota + 1
+	memberIPv6
+	memberKeyField
+)
+
+var errWireTruncated = errors.New("binary message truncated")
+
+func isWireMessage(msg []byte) bool {
+	return len(msg) >= len(wireMagic) && msg[0] == wireMagic[0] && msg[1] == wireMagic[1]
+}
+
+// parseWireMessage returns the type and fields of a binary message
+func parseWireMessage(msg []byte) (byte, []byte, error) {
+	if !isWireMessage(msg) {
+		return 0, nil, errors.New("not a binary message")
+	}
+
+	if len(msg) < wireHeaderSize {
+		return 0, nil, errWireTruncated
+	}
+
+	version := msg[len(wireMagic)]
+
+	if version == 0 || version > wireVersion {
+		return 0, nil, fmt.Errorf("unsupported binary message version %v", version)
+	}
+
+	return msg[len(wireMagic)+1], msg[wireHeaderSize:], nil
+}
+
+type wireWriter struct {
+	buf []byte
+}
+
+func newWireMessage(msgType byte) *wireWriter {
+	w := &wireWriter{}
+	w.buf = append(w.buf, wireMagic[:]...)
+	w.buf = append(w.buf, wireVersion, msgType)
+
+	return w
+}
+
+func (w *wireWriter) bytes(tag byte, value []byte) {
+	var length [binary.MaxVarintLen64]byte
+
+	w.buf = append(w.buf, tag)
+	w.buf = append(w.buf, length[:binary.PutUvarint(length[:], uint64(len(value)))]...)
+	w.buf = append(w.buf, value...)
+}
+
+func (w *wireWriter) string(tag byte, value string) {
+	w.bytes(tag, []byte(value))
+}
+
+func (w *wireWriter) uint(tag byte, value uint64) {
+	var b [binary.MaxVarintLen64]byte
+
+	w.bytes(tag, b[:binary.PutUvarint(b[:], value)])
+}
+
+func (w *wireWriter) int(tag byte, value int64) {
+	var b [binary.MaxVarintLen64]byte
+
+	w.bytes(tag, b[:binary.PutVarint(b[:], value)])
+}
+
+// ipPort writes the address as its IP followed by the port, unless it's zero
+func (w *wireWriter) ipPort(tag byte, addr netaddr.IPPort) {
+	if addr.IP.IsZero() {
+		return
+	}
+
+	var b []byte
+
+	if addr.IP.Is4() {
+		ip := addr.IP.As4()
+		b = append(b, ip[:]...)
+	} else {
+		ip := addr.IP.As16()
+		b = append(b, ip[:]...)
+	}
+
+	w.bytes(tag, append(b, byte(addr.Port>>8), byte(addr.Port)))
+}
+
+// member writes the member's addresses, along with its key if it has one
+func (w *wireWriter) member(tag byte, key string, addrs MemberAddrs) {
+	member := &wireWriter{}
+
+	if key != "" {
+		member.string(memberKeyField, key)
+	}
+
+	member.ipPort(memberIPv4, addrs.IPv4)
+	member.ipPort(memberIPv6, addrs.IPv6)
+	w.bytes(tag, member.buf)
+}
+
+// readWireFields calls fn with the tag and value of each field
+func readWireFields(fields []byte, fn func(tag byte, value []byte) error) error {
+	for len(fields) > 0 {
+		length, n := binary.Uvarint(fields[1:])
+
+		if n <= 0 || length > uint64(len(fields)-1-n) {
+			return errWireTruncated
+		}
+
+		start := 1 + n
+		end := start + int(length)
+
+		if err := fn(fields[0], fields[start:end]); err != nil {
+			return err
+		}
+
+		fields = fields[end:]
+	}
+
+	return nil
+}
+
+func wireUint(value []byte) (uint64, error) {
+	v, n := binary.Uvarint(value)
+
+	if n <= 0 || n != len(value) {
+		return 0, errors.New("invalid uint in binary message")
+	}
+
+	return v, nil
+}
+
+func wireInt(value []byte) (int64, error) {
+	v, n := binary.Varint(value)
+
+	if n <= 0 || n != len(value) {
+		return 0, errors.New("invalid int in binary message")
+	}
+
+	return v, nil
+}
+
+func wireIPPort(value []byte) (netaddr.IPPort, error) {
+	var ip netaddr.IP
+
+	switch len(value) {
+	case 6:
+		ip = netaddr.IPv4(value[0], value[1], value[2], value[3])
+	case 18:
+		var b [16]byte
+		copy(b[:], value)
+		ip = netaddr.IPFrom16(b)
+	default:
+		return netaddr.IPPort{}, errors.New("invalid address in binary message")
+	}
+
+	return netaddr.IPPort{IP: ip, Port: uint16(value[len(value)-2])<<8 | uint16(value[len(value)-1])}, nil
+}
+
+func wireMember(value []byte) (string, MemberAddrs, error) {
+	var key string
+	var addrs MemberAddrs
+
+	err := readWireFields(value, func(tag byte, value []byte) error {
+		var err error
+
+		switch tag {
+		case memberKeyField:
+			key = string(value)
+		case memberIPv4:
+			addrs.IPv4, err = wireIPPort(value)
+		case memberIPv6:
+			addrs.IPv6, err = wireIPPort(value)
+		}
+
+		return err
+	})
+
+	return key, addrs, err
+}
+
+func encodeHeartbeat(heartbeat HeartbeatMessage) []byte {
+	w := newWireMessage(wireHeartbeat)
+	w.string(heartbeatNetworkName, heartbeat.NetworkName)
+
+	if heartbeat.MemberID != "" {
+		w.string(heartbeatMemberID, heartbeat.MemberID)
+	}
+
+	if heartbeat.Challenge != nil {
+		w.bytes(heartbeatChallenge, heartbeat.Challenge)
+		w.bytes(heartbeatProof, heartbeat.Proof)
+	}
+
+	if heartbeat.IDProof != nil {
+		w.bytes(heartbeatIDProof, heartbeat.IDProof)
+	}
+
+	if heartbeat.Invite != nil {
+		w.string(heartbeatInviteID, heartbeat.Invite.ID)
+		w.int(heartbeatInviteExpires, heartbeat.Invite.Expires)
+	}
+
+	if heartbeat.MapUpdates {
+		w.bytes(heartbeatMapUpdates, nil)
+		w.uint(heartbeatMapEpoch, heartbeat.MapEpoch)
+		w.uint(heartbeatMapVersion, heartbeat.MapVersion)
+	}
+
+	return w.buf
+}
+
+func decodeHeartbeat(fields []byte) (HeartbeatMessage, error) {
+	var heartbeat HeartbeatMessage
+
+	err := readWireFields(fields, func(tag byte, value []byte) error {
+		var err error
+
+		switch tag {
+		case heartbeatNetworkName:
+			heartbeat.NetworkName = string(value)
+		case heartbeatMemberID:
+			heartbeat.MemberID = string(value)
+		case heartbeatChallenge:
+			heartbeat.Challenge = append([]byte(nil), value...)
+		case heartbeatProof:
+			heartbeat.Proof = append([]byte(nil), value...)
+		case heartbeatIDProof:
+			heartbeat.IDProof = append([]byte(nil), value...)
+		case heartbeatInviteID, heartbeatInviteExpires:
+			if heartbeat.Invite == nil {
+				heartbeat.Invite = &InviteClaim{}
+			}
+
+			if tag == heartbeatInviteID {
+				heartbeat.Invite.ID = string(value)
+			} else {
+				heartbeat.Invite.Expires, err = wireInt(value)
+			}
+		case heartbeatMapUpdates:
+			heartbeat.MapUpdates = true
+		case heartbeatMapEpoch:
+			heartbeat.MapEpoch, err = wireUint(value)
+		case heartbeatMapVersion:
+			heartbeat.MapVersion, err = wireUint(value)
+		}
+
+		return err
+	})
+
+	return heartbeat, err
+}
+
+func encodeNetworkMap(nmap NetworkMap) []byte {
+	w := newWireMessage(wireNetworkMap)
+	w.uint(networkMapYourIndex, uint64(nmap.YourIndex))
+
+	for _, member := range nmap.MemberAddrs() {
+		w.member(networkMapMember, "", member)
+	}
+
+	return w.buf
+}
+
+func decodeNetworkMap(fields []byte) (NetworkMap, error) {
+	var nmap NetworkMap
+
+	err := readWireFields(fields, func(tag byte, value []byte) error {
+		switch tag {
+		case networkMapYourIndex:
+			index, err := wireUint(value)
+
+			if err != nil {
+				return err
+			}
+
+			if index > 1<<31-1 {
+				return errors.New("network map index out of range")
+			}
+
+			nmap.YourIndex = int(index)
+		case networkMapMember:
+			_, addrs, err := wireMember(value)
+
+			if err != nil {
+				return err
+			}
+
+			nmap.Members = append(nmap.Members, addrs)
+			nmap.Addresses = append(nmap.Addresses, addrs.Primary())
+		}
+
+		return nil
+	})
+
+	return nmap, err
+}
+
+func encodeMapDelta(delta MapDelta) []byte {
+	w := newWireMessage(wireMapDelta)
+	w.uint(mapDeltaEpoch, delta.Epoch)
+	w.uint(mapDeltaFrom, delta.From)
+	w.uint(mapDeltaVersion, delta.Version)
+
+	for key, addrs := range delta.Changed {
+		w.member(mapDeltaChanged, key, addrs)
+	}
+
+	for _, key := range delta.Left {
+		w.string(mapDeltaLeft, key)
+	}
+
+	return w.buf
+}
+
+func decodeMapDelta(fields []byte) (MapDelta, error) {
+	var delta MapDelta
+
+	err := readWireFields(fields, func(tag byte, value []byte) error {
+		var err error
+
+		switch tag {
+		case mapDeltaEpoch:
+			delta.Epoch, err = wireUint(value)
+		case mapDeltaFrom:
+			delta.From, err = wireUint(value)
+		case mapDeltaVersion:
+			delta.Version, err = wireUint(value)
+		case mapDeltaChanged:
+			var key string
+			var addrs MemberAddrs
+
+			if key, addrs, err = wireMember(value); err != nil {
+				return err
+			}
+
+			if delta.Changed == nil {
+				delta.Changed = make(map[string]MemberAddrs)
+			}
+
+			delta.Changed[key] = addrs
+		case mapDeltaLeft:
+			delta.Left = append(delta.Left, string(value))
+		}
+
+		return err
+	})
+
+	return delta, err
+}
+
+func encodeMapSnapshot(snapshot MapSnapshot) []byte {
+	w := newWireMessage(wireMapSnapshot)
+	w.uint(mapSnapshotEpoch, snapshot.Epoch)
+	w.uint(mapSnapshotVersion, snapshot.Version)
+	w.uint(mapSnapshotFragment, uint64(snapshot.Fragment))
+	w.uint(mapSnapshotFragments, uint64(snapshot.Fragments))
+
+	for key, addrs := range snapshot.Members {
+		w.member(mapSnapshotMember, key, addrs)
+	}
+
+	return w.buf
+}
+
+func decodeMapSnapshot(fields []byte) (MapSnapshot, error) {
+	snapshot := MapSnapshot{Members: make(map[string]MemberAddrs)}
+
+	err := readWireFields(fields, func(tag byte, value []byte) error {
+		var err error
+		var v uint64
+
+		switch tag {
+		case mapSnapshotEpoch:
+			snapshot.Epoch, err = wireUint(value)
+		case mapSnapshotVersion:
+			snapshot.Version, err = wireUint(value)
+		case mapSnapshotFragment, mapSnapshotFragments:
+			if v, err = wireUint(value); err != nil {
+				return err
+			}
+
+			// Limited so that it fits in an int everywhere
+			if v > 1<<31-1 {
+				return errors.New("snapshot fragment out of range")
+			}
+
+			if tag == mapSnapshotFragment {
+				snapshot.Fragment = int(v)
+			} else {
+				snapshot.Fragments = int(v)
+			}
+		case mapSnapshotMember:
+			var key string
+			var addrs MemberAddrs
+
+			if key, addrs, err = wireMember(value); err != nil {
+				return err
+			}
+
+			snapshot.Members[key] = addrs
+		}
+
+		return err
+	})
+
+	return snapshot, err
+}
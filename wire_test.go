@@ -0,0 +1,150 @@
+package meshboi
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestWireHeartbeat(t *testing.T) {
+	heartbeat := HeartbeatMessage{
+		NetworkName: "test",
+		MemberID:    "member",
+		Challenge:   []byte{1, 2, 3},
+		Proof:       []byte{4, 5, 6},
+		IDProof:     []byte{7, 8, 9},
+		Invite:      &InviteClaim{ID: "invite", Expires: 1234567890},
+		MapUpdates:  true,
+		MapEpoch:    1 << 63,
+		MapVersion:  42,
+	}
+
+	msgType, fields, err := parseWireMessage(encodeHeartbeat(heartbeat))
+
+	if err != nil || msgType != wireHeartbeat {
+		t.Fatalf("Error parsing heartbeat: %v %v", msgType, err)
+	}
+
+	decoded, err := decodeHeartbeat(fields)
+
+	if err != nil {
+		t.Fatal("Error decoding heartbeat: ", err)
+	}
+
+	if !reflect.DeepEqual(decoded, heartbeat) {
+		t.Fatalf("Expected %v but got %v", heartbeat, decoded)
+	}
+}
+
+func TestWireNetworkMap(t *testing.T) {
+	nmap := NetworkMap{
+		Members: []MemberAddrs{
+			{IPv4: netaddr.MustParseIPPort("192.168.4.1:2000")},
+			{IPv6: netaddr.MustParseIPPort("[2001:db8::1]:3000")},
+			{IPv4: netaddr.MustParseIPPort("192.168.4.2:2000"), IPv6: netaddr.MustParseIPPort("[2001:db8::2]:3000")},
+		},
+		YourIndex: 2,
+	}
+
+	_, fields, err := parseWireMessage(nmap.encode(true))
+
+	if err != nil {
+		t.Fatal("Error parsing network map: ", err)
+	}
+
+	decoded, err := decodeNetworkMap(fields)
+
+	if err != nil {
+		t.Fatal("Error decoding network map: ", err)
+	}
+
+	if !reflect.DeepEqual(decoded.Members, nmap.Members) || decoded.YourIndex != 2 {
+		t.Fatalf("Expected %v but got %v", nmap, decoded)
+	}
+
+	if decoded.Addresses[1] != nmap.Members[1].IPv6 {
+		t.Fatalf("Addresses weren't filled in %v", decoded.Addresses)
+	}
+}
+
+func TestWireMapUpdates(t *testing.T) {
+	rollo, _ := newRolodex(discardTransport{}, time.Second, time.Minute)
+	mesh := newMeshNetwork(rollo, "test")
+
+	for i := 0; i < 20; i++ {
+		mesh.register(fmt.Sprint("member", i), memberAddr(i), nil, true)
+	}
+
+	state := newMapState("member0")
+	frames := newMapFrames(mesh, true).forMember(currentAck(state))
+
+	if len(frames) != 3 || !isWireMessage(frames[0]) {
+		t.Fatalf("Expected a binary snapshot in 3 fragments")
+	}
+
+	if nmap, ok := applyFrames(t, state, frames); !ok || len(nmap.Members) != 20 {
+		t.Fatalf("Snapshot wasn't applied: %v", nmap)
+	}
+
+	mesh.register("member20", memberAddr(20), nil, true)
+	mesh.members["member5"].ipv4.lastSeen = time.Time{}
+	mesh.timeOutInactiveMembers()
+
+	frames = newMapFrames(mesh, true).forMember(currentAck(state))
+
+	if len(frames) != 1 {
+		t.Fatalf("Expected a single delta")
+	}
+
+	if nmap, ok := applyFrames(t, state, frames); !ok || len(nmap.Members) != 20 {
+		t.Fatalf("Delta wasn't applied: %v", nmap)
+	}
+}
+
+func TestWireCompatibility(t *testing.T) {
+	msg := encodeHeartbeat(HeartbeatMessage{NetworkName: "test"})
+
+	// Fields added later are skipped over
+	withUnknown := append(append([]byte(nil), msg...), 200, 3, 'n', 'e', 'w')
+	heartbeat, binaryWire, err := parseHeartbeat(withUnknown)
+
+	if err != nil || !binaryWire || heartbeat.NetworkName != "test" {
+		t.Fatalf("Didn't skip an unknown field: %v %v", heartbeat, err)
+	}
+
+	newer := append([]byte(nil), msg...)
+	newer[len(wireMagic)] = wireVersion + 1
+
+	if _, _, err := parseHeartbeat(newer); err == nil {
+		t.Fatalf("Parsed a heartbeat from a newer version")
+	}
+
+	if _, _, err := parseHeartbeat(msg[:len(msg)-1]); err == nil {
+		t.Fatalf("Parsed a truncated heartbeat")
+	}
+
+	// Members that send JSON are replied to in binary if they understand it
+	for _, tc := range []struct {
+		heartbeat  string
+		binaryWire bool
+	}{
+		{`{"networkName": "test"}`, false},
+		{`{"networkName": "test", "wireVersion": 1}`, true},
+	} {
+		heartbeat, binaryWire, err := parseHeartbeat([]byte(tc.heartbeat))
+
+		if err != nil || heartbeat.NetworkName != "test" || binaryWire != tc.binaryWire {
+			t.Fatalf("Wrong result for %v: %v %v %v", tc.heartbeat, heartbeat, binaryWire, err)
+		}
+	}
+
+	b, _ := json.Marshal(HeartbeatMessage{NetworkName: "test"})
+
+	if isWireMessage(b) {
+		t.Fatalf("JSON mistaken for a binary message")
+	}
+}